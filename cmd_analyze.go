@@ -0,0 +1,185 @@
+// cmd_analyze.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"filecompressor/compress"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// analysis is the JSON form of compress.Statistics for one file.
+type analysis struct {
+	File            string     `json:"file"`
+	Size            int        `json:"size"`
+	Distinct        int        `json:"distinct"`
+	Entropy         float64    `json:"entropy"`
+	Order1Entropy   float64    `json:"order1_entropy"`
+	MinSize         int        `json:"min_size"`
+	Order1MinSize   int        `json:"order1_min_size"`
+	Runs            int        `json:"runs"`
+	LongestRun      int        `json:"longest_run"`
+	RunLengths      []int      `json:"run_lengths"`
+	LZ              lzStat     `json:"lz"`
+	HuffmanBits     int        `json:"huffman_bits"`
+	ShannonFanoBits int        `json:"shannon_fano_bits"`
+	Bytes           []byteStat `json:"bytes"`
+}
+
+type lzStat struct {
+	Window       int     `json:"window"`
+	MinMatch     int     `json:"min_match"`
+	Matches      int     `json:"matches"`
+	MatchedBytes int     `json:"matched_bytes"`
+	Literals     int     `json:"literals"`
+	LongestMatch int     `json:"longest_match"`
+	MeanLength   float64 `json:"mean_length"`
+	MeanDistance float64 `json:"mean_distance"`
+}
+
+type byteStat struct {
+	Value       byte `json:"value"`
+	Count       int  `json:"count"`
+	Huffman     int  `json:"huffman_length"`
+	ShannonFano int  `json:"shannon_fano_length"`
+}
+
+func runAnalyze(args []string) error {
+	var format string
+	var top int
+	fs := newFlagSet("analyze", "[flags] <file>|-...", "Report byte statistics, entropy, runs, LZ repeats and the Huffman and\nShannon-Fano code lengths of each file, to explain how the algorithms fare.")
+	fs.StringVar(&format, "format", "text", "Output format: text or json")
+	fs.IntVar(&top, "top", 16, "Show only the most frequent byte values in text output (0 for all)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if format != "text" && format != "json" {
+		return withCode(codeUsage, fmt.Errorf("unknown format %q (want text or json)", format))
+	}
+	if fs.NArg() == 0 {
+		return withCode(codeUsage, errors.New("no input files (use - for standard input)"))
+	}
+
+	var results []analysis
+	err := forEachFile(fs.Args(), func(name string) error {
+		data, err := readInput(name)
+		if err != nil {
+			return err
+		}
+		stats := compress.ComputeStatistics(data)
+		if format == "json" {
+			results = append(results, newAnalysis(name, stats, 0))
+			return nil
+		}
+		return printAnalysis(os.Stdout, newAnalysis(name, stats, top))
+	})
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if werr := enc.Encode(results); werr != nil {
+			return werr
+		}
+	}
+	return err
+}
+
+// newAnalysis keeps the top most frequent byte values of s, all if top is 0.
+func newAnalysis(name string, s compress.Statistics, top int) analysis {
+	a := analysis{
+		File:            name,
+		Size:            s.Size,
+		Distinct:        s.Distinct,
+		Entropy:         s.Entropy,
+		Order1Entropy:   s.Order1Entropy,
+		MinSize:         s.MinSize,
+		Order1MinSize:   s.Order1MinSize,
+		Runs:            s.Runs,
+		LongestRun:      s.LongestRun,
+		RunLengths:      s.RunLengths,
+		LZ:              lzStat(s.LZ),
+		HuffmanBits:     s.HuffmanBits,
+		ShannonFanoBits: s.ShannonFanoBits,
+	}
+	for b, count := range s.Histogram {
+		if count > 0 {
+			a.Bytes = append(a.Bytes, byteStat{
+				Value:       byte(b),
+				Count:       count,
+				Huffman:     s.HuffmanLengths[b],
+				ShannonFano: s.ShannonFanoLengths[b],
+			})
+		}
+	}
+	sort.SliceStable(a.Bytes, func(i, j int) bool { return a.Bytes[i].Count > a.Bytes[j].Count })
+	if top > 0 && len(a.Bytes) > top {
+		a.Bytes = a.Bytes[:top]
+	}
+	return a
+}
+
+func printAnalysis(out io.Writer, a analysis) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	percent := func(n int) float64 {
+		if a.Size == 0 {
+			return 0
+		}
+		return float64(n) / float64(a.Size) * 100
+	}
+
+	fmt.Fprintf(w, "%s:\n", a.File)
+	fmt.Fprintf(w, "  size:\t%d bytes, %d distinct values\n", a.Size, a.Distinct)
+	fmt.Fprintf(w, "  entropy (order 0):\t%.3f bits/byte, minimum %d bytes (%.2f%%)\n", a.Entropy, a.MinSize, percent(a.MinSize))
+	fmt.Fprintf(w, "  entropy (order 1):\t%.3f bits/byte, minimum %d bytes (%.2f%%)\n", a.Order1Entropy, a.Order1MinSize, percent(a.Order1MinSize))
+	fmt.Fprintf(w, "  huffman payload:\t%d bytes (%.2f%%)\n", (a.HuffmanBits+7)/8, percent((a.HuffmanBits+7)/8))
+	fmt.Fprintf(w, "  shannon-fano payload:\t%d bytes (%.2f%%)\n", (a.ShannonFanoBits+7)/8, percent((a.ShannonFanoBits+7)/8))
+	meanRun := 0.0
+	if a.Runs > 0 {
+		meanRun = float64(a.Size) / float64(a.Runs)
+	}
+	fmt.Fprintf(w, "  runs:\t%d, mean length %.2f, longest %d\n", a.Runs, meanRun, a.LongestRun)
+	fmt.Fprintf(w, "  lz repeats:\t%d matches cover %d bytes (%.2f%%), mean length %.1f, mean distance %.1f, longest %d\n",
+		a.LZ.Matches, a.LZ.MatchedBytes, percent(a.LZ.MatchedBytes), a.LZ.MeanLength, a.LZ.MeanDistance, a.LZ.LongestMatch)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(a.RunLengths) > 0 {
+		fmt.Fprintf(w, "\n  RUN LENGTH\tRUNS\n")
+		for i, n := range a.RunLengths {
+			lo, hi := 1<<i, 1<<(i+1)-1
+			if lo == hi {
+				fmt.Fprintf(w, "  %d\t%d\n", lo, n)
+			} else {
+				fmt.Fprintf(w, "  %d-%d\t%d\n", lo, hi, n)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if len(a.Bytes) > 0 {
+		fmt.Fprintf(w, "\n  BYTE\tCOUNT\tPERCENT\tHUFFMAN\tSHANNON-FANO\n")
+		for _, b := range a.Bytes {
+			fmt.Fprintf(w, "  %s\t%d\t%.2f%%\t%d\t%d\n", byteLabel(b.Value), b.Count, percent(b.Count), b.Huffman, b.ShannonFano)
+		}
+		if a.Distinct > len(a.Bytes) {
+			fmt.Fprintf(w, "  (%d more)\n", a.Distinct-len(a.Bytes))
+		}
+	}
+	fmt.Fprintln(w)
+	return w.Flush()
+}
+
+// byteLabel shows printable ASCII as a quoted character and anything else
+// in hex.
+func byteLabel(b byte) string {
+	if b >= 0x20 && b < 0x7f {
+		return fmt.Sprintf("%q", rune(b))
+	}
+	return fmt.Sprintf("0x%02x", b)
+}
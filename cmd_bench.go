@@ -0,0 +1,312 @@
+// cmd_bench.go
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"filecompressor/compress"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// benchResult is one chain measured on one file, or the total of a chain
+// over all files when File is "TOTAL".
+type benchResult struct {
+	File            string  `json:"file"`
+	Chain           string  `json:"chain"`
+	Size            int     `json:"size"`
+	Compressed      int     `json:"compressed"`
+	Ratio           float64 `json:"ratio"`
+	CompressNanos   int64   `json:"compress_ns"`
+	DecompressNanos int64   `json:"decompress_ns"`
+	CompressMBps    float64 `json:"compress_mb_s"`
+	DecompressMBps  float64 `json:"decompress_mb_s"`
+	PeakMemory      uint64  `json:"peak_memory"`
+	Verified        bool    `json:"verified"`
+	Error           string  `json:"error,omitempty"`
+}
+
+func runBench(args []string) error {
+	var algorithms, format string
+	var runs int
+	var dicts dictList
+	fs := newFlagSet("bench", "[flags] <file>...", "Compress and decompress each file with each chain, verify the round trip and\nreport ratio, speed and peak memory.")
+	fs.StringVar(&algorithms, "algo", "", "Chains to compare, separated by | (e.g. 'lzw|bwt,rle'); default: every algorithm on its own")
+	fs.StringVar(&format, "format", "table", "Output format: table, csv or json")
+	fs.IntVar(&runs, "runs", 1, "Repeat each measurement and keep the fastest")
+	dicts.flags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return withCode(codeUsage, errors.New("no input files"))
+	}
+	if runs < 1 {
+		return withCode(codeUsage, errors.New("-runs must be at least 1"))
+	}
+	switch format {
+	case "table", "csv", "json":
+	default:
+		return withCode(codeUsage, fmt.Errorf("unknown format %q (want table, csv or json)", format))
+	}
+
+	if err := dicts.load(); err != nil {
+		return err
+	}
+
+	specs := strings.Split(algorithms, "|")
+	if algorithms == "" {
+		specs = specs[:0]
+		for _, algo := range compress.Algorithms() {
+			specs = append(specs, algo.Name)
+		}
+	}
+	chains := make([]*compress.CompressionChain, len(specs))
+	for i, spec := range specs {
+		chain, err := parseChain(spec)
+		if err != nil {
+			return err
+		}
+		chains[i] = chain
+	}
+
+	var results []benchResult
+	totals := make([]benchResult, len(specs))
+	for i, spec := range specs {
+		totals[i] = benchResult{File: "TOTAL", Chain: spec, Verified: true}
+	}
+	failed := 0
+	err := forEachFile(fs.Args(), func(name string) error {
+		data, err := readInput(name)
+		if err != nil {
+			return err
+		}
+		for i, chain := range chains {
+			r := benchChain(name, specs[i], chain, data, runs)
+			if r.Error != "" {
+				failed++
+			}
+			results = append(results, r)
+			totals[i].add(r)
+		}
+		return nil
+	})
+	if fs.NArg() > 1 {
+		for i := range totals {
+			totals[i].finish()
+		}
+		results = append(results, totals...)
+	}
+
+	if werr := writeBench(os.Stdout, format, results); werr != nil {
+		return werr
+	}
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d of %d runs failed", failed, fs.NArg()*len(chains))
+	}
+	return err
+}
+
+// benchChain measures one chain on data. Failures, including panics of a
+// broken stage, are recorded in the result.
+func benchChain(name, spec string, chain *compress.CompressionChain, data []byte, runs int) benchResult {
+	r := benchResult{File: name, Chain: spec, Size: len(data)}
+
+	var compressed, restored []byte
+	for i := 0; i < runs; i++ {
+		elapsed, peak, err := measure(func() (err error) {
+			compressed, err = chain.Compress(data)
+			return err
+		})
+		if err != nil {
+			r.Error = fmt.Sprintf("compression failed: %v", err)
+			return r
+		}
+		r.keep(&r.CompressNanos, elapsed, peak)
+
+		elapsed, peak, err = measure(func() (err error) {
+			restored, err = chain.Decompress(compressed)
+			return err
+		})
+		if err != nil {
+			r.Error = fmt.Sprintf("decompression failed: %v", err)
+			return r
+		}
+		r.keep(&r.DecompressNanos, elapsed, peak)
+	}
+
+	r.Compressed = len(compressed)
+	r.Verified = bytes.Equal(data, restored)
+	if !r.Verified {
+		r.Error = "round trip mismatch"
+	}
+	r.finish()
+	return r
+}
+
+// keep records the fastest time and the largest memory peak over runs.
+func (r *benchResult) keep(nanos *int64, elapsed time.Duration, peak uint64) {
+	if *nanos == 0 || elapsed.Nanoseconds() < *nanos {
+		*nanos = elapsed.Nanoseconds()
+	}
+	if peak > r.PeakMemory {
+		r.PeakMemory = peak
+	}
+}
+
+func (r *benchResult) add(other benchResult) {
+	if other.Error != "" {
+		r.Verified = false
+		r.Error = "some files failed"
+		return
+	}
+	r.Size += other.Size
+	r.Compressed += other.Compressed
+	r.CompressNanos += other.CompressNanos
+	r.DecompressNanos += other.DecompressNanos
+	if other.PeakMemory > r.PeakMemory {
+		r.PeakMemory = other.PeakMemory
+	}
+}
+
+// finish derives the ratio and speeds from sizes and times.
+func (r *benchResult) finish() {
+	if r.Size > 0 {
+		r.Ratio = float64(r.Compressed) / float64(r.Size) * 100
+	}
+	r.CompressMBps = mbPerSecond(r.Size, r.CompressNanos)
+	r.DecompressMBps = mbPerSecond(r.Size, r.DecompressNanos)
+}
+
+func mbPerSecond(size int, nanos int64) float64 {
+	if nanos <= 0 {
+		return 0
+	}
+	return float64(size) / 1e6 / (float64(nanos) / 1e9)
+}
+
+// heapMetric is the live heap size, cheap enough to sample while a stage
+// runs.
+const heapMetric = "/memory/classes/heap/objects:bytes"
+
+func heapBytes() uint64 {
+	sample := []metrics.Sample{{Name: heapMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+// measure runs fn and returns its duration and the peak heap growth while
+// it ran. The heap is sampled, so very short peaks can be missed. A panic
+// in fn is returned as an error.
+func measure(fn func() error) (elapsed time.Duration, peak uint64, err error) {
+	runtime.GC()
+	base := heapBytes()
+	high := base
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if v := heapBytes(); v > high {
+					high = v
+				}
+			}
+		}
+	}()
+
+	start := time.Now()
+	func() {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("panic: %v", p)
+			}
+		}()
+		err = fn()
+	}()
+	elapsed = time.Since(start)
+
+	close(done)
+	wg.Wait()
+	if v := heapBytes(); v > high {
+		high = v
+	}
+	return elapsed, high - base, err
+}
+
+func writeBench(w io.Writer, format string, results []benchResult) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"file", "chain", "size", "compressed", "ratio", "compress_mb_s", "decompress_mb_s", "peak_memory", "verified", "error"})
+		for _, r := range results {
+			cw.Write([]string{r.File, r.Chain, strconv.Itoa(r.Size), strconv.Itoa(r.Compressed),
+				strconv.FormatFloat(r.Ratio, 'f', 2, 64),
+				strconv.FormatFloat(r.CompressMBps, 'f', 2, 64),
+				strconv.FormatFloat(r.DecompressMBps, 'f', 2, 64),
+				strconv.FormatUint(r.PeakMemory, 10), strconv.FormatBool(r.Verified), r.Error})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "FILE\tCHAIN\tSIZE\tCOMPRESSED\tRATIO\tCOMP MB/s\tDECOMP MB/s\tPEAK MEM\tOK\t\n")
+	var failures []string
+	for _, r := range results {
+		if r.Error != "" {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t-\t-\t-\t-\t-\tFAIL\t\n", r.File, r.Chain, r.Size)
+			if r.File != "TOTAL" {
+				failures = append(failures, fmt.Sprintf("%s (%s): %s", r.File, r.Chain, r.Error))
+			}
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.2f%%\t%.2f\t%.2f\t%s\tyes\t\n", r.File, r.Chain, r.Size, r.Compressed,
+			r.Ratio, r.CompressMBps, r.DecompressMBps, formatBytes(r.PeakMemory))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, failure := range failures {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", failure)
+	}
+	return nil
+}
+
+// formatBytes prints a byte count with a binary unit.
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
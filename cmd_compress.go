@@ -0,0 +1,483 @@
+// cmd_compress.go
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"filecompressor/compress"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// options holds the flags shared by the commands that read compressed or
+// uncompressed files.
+type options struct {
+	algorithms string
+	autoTrial  bool
+	verbose    bool
+	toStdout   bool
+	json       bool
+	quiet      bool
+
+	output    string
+	outputDir string
+	suffix    string
+	keep      bool
+	force     bool
+	maxStdin  int
+	// legacy is set without a command, where -k and -f are the defaults.
+	legacy bool
+
+	encrypt        bool
+	passphraseFile string
+	keyFile        string
+	cipherName     string
+	kdfName        string
+
+	dicts dictList
+
+	walk   walkOptions
+	meta   metadataOptions
+	limits compress.Limits
+
+	// log receives status messages; it is stderr when data goes to stdout.
+	log io.Writer
+}
+
+// outputFlags registers the flags on where output goes. The legacy form
+// keeps its inputs and overwrites its outputs by default, as it did before
+// the commands.
+func (o *options) outputFlags(fs *flag.FlagSet, legacy bool) {
+	o.legacy = legacy
+	fs.BoolVar(&o.verbose, "v", false, "Verbose output")
+	fs.BoolVar(&o.quiet, "q", false, "Quiet: no progress bar or success messages")
+	fs.BoolVar(&o.quiet, "quiet", false, "Same as -q")
+	fs.BoolVar(&o.toStdout, "c", false, "Write to standard output; with no file, read standard input")
+	fs.StringVar(&o.output, "o", "", "Write the output to this path (single input only)")
+	fs.StringVar(&o.outputDir, "output-dir", "", "Write outputs to this directory, keeping the layout below directories walked with -r")
+	fs.StringVar(&o.suffix, "S", defaultSuffix, "Suffix of compressed files")
+	fs.StringVar(&o.suffix, "suffix", defaultSuffix, "Same as -S")
+	fs.BoolVar(&o.keep, "k", legacy, "Keep input files instead of deleting them")
+	fs.BoolVar(&o.keep, "keep", legacy, "Same as -k")
+	fs.BoolVar(&o.force, "f", legacy, "Overwrite existing output files")
+	fs.BoolVar(&o.force, "force", legacy, "Same as -f")
+	o.maxStdin = defaultMaxStdin
+	fs.Var((*sizeValue)(&o.maxStdin), "max-stdin", "Fail if standard input, which is read into memory whole, is larger than `size` bytes (suffixes k, m, g; 0 for no limit)")
+}
+
+func (o *options) chainFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.algorithms, "algo", "lzw", "Compression algorithms (comma-separated: "+algorithmNames()+"; parameters as bwt:block=900k), auto, or max for the best and slowest")
+	fs.BoolVar(&o.autoTrial, "auto-trial", true, "With -algo=auto, trial-compress a sample with each candidate chain")
+}
+
+// legacyChainFlag is -algo for commands that only need it to read files
+// written before the container header existed.
+func (o *options) legacyChainFlag(fs *flag.FlagSet) {
+	fs.StringVar(&o.algorithms, "algo", "lzw", "Chain of files without a header (comma-separated: "+algorithmNames()+")")
+}
+
+func (o *options) keyFlags(fs *flag.FlagSet, withEncrypt bool) {
+	if withEncrypt {
+		fs.BoolVar(&o.encrypt, "encrypt", false, "Encrypt the compressed output (requires -passphrase-file or -key-file)")
+	}
+	fs.StringVar(&o.passphraseFile, "passphrase-file", "", "File containing the encryption passphrase")
+	fs.StringVar(&o.keyFile, "key-file", "", "File containing a 32-byte encryption key (raw or hex)")
+	fs.StringVar(&o.cipherName, "cipher", "aes-gcm", "Encryption cipher (aes-gcm, chacha20)")
+	fs.StringVar(&o.kdfName, "kdf", "scrypt", "Passphrase key derivation (scrypt, argon2id)")
+}
+
+// limitFlags bounds the output and memory of decompression, against files
+// crafted to expand enormously.
+func (o *options) limitFlags(fs *flag.FlagSet) {
+	o.limits = compress.DefaultLimits
+	fs.Var((*sizeValue)(&o.limits.MaxOutput), "max-output", "Fail if any stage would decompress to more than `size` bytes (suffixes k, m, g; 0 for no limit)")
+	fs.IntVar(&o.limits.MaxRatio, "max-ratio", o.limits.MaxRatio, "Fail if any stage would expand its input more than this many times, above 1m of output (0 for no limit)")
+	fs.Var((*sizeValue)(&o.limits.MaxMemory), "max-memory", "Fail if a stage would allocate a model of more than `size` bytes to decode, as cm does (0 for no limit)")
+}
+
+// sizeValue is a byte count flag accepting the suffixes of
+// compress.ParseSize.
+type sizeValue int
+
+func (s *sizeValue) String() string {
+	n := int(*s)
+	for _, unit := range []struct {
+		suffix string
+		size   int
+	}{{"g", 1 << 30}, {"m", 1 << 20}, {"k", 1 << 10}} {
+		if n != 0 && n%unit.size == 0 {
+			return strconv.Itoa(n/unit.size) + unit.suffix
+		}
+	}
+	return strconv.Itoa(n)
+}
+
+func (s *sizeValue) Set(value string) error {
+	n, err := compress.ParseSize(value)
+	if err != nil {
+		return err
+	}
+	*s = sizeValue(n)
+	return nil
+}
+
+// encryptor returns the encryption stage, or nil when none is configured.
+// Decryption is implied by a key source; encryption must be asked for.
+func (o *options) encryptor(decrypt bool) (*compress.EncryptionCompressor, error) {
+	if !o.encrypt && !(decrypt && (o.passphraseFile != "" || o.keyFile != "")) {
+		return nil, nil
+	}
+	enc, err := newEncryptor(o.passphraseFile, o.keyFile, o.cipherName, o.kdfName)
+	if err != nil {
+		return nil, withCode(codeUsage, fmt.Errorf("setting up encryption: %w", err))
+	}
+	return enc, nil
+}
+
+// inputs returns the files to process, defaulting to standard input with -c,
+// and points the log at stderr if any data will be written to stdout.
+func (o *options) inputs(files []string) ([]string, error) {
+	if len(files) == 0 {
+		if !o.toStdout {
+			return nil, withCode(codeUsage, errors.New("no input files (use - for standard input)"))
+		}
+		files = []string{"-"}
+	}
+
+	// Records replace the messages with -json.
+	if o.json {
+		o.verbose = false
+	}
+	o.log = os.Stdout
+	for _, name := range files {
+		if o.writesStdout(name) {
+			o.log = os.Stderr
+		}
+	}
+	return files, nil
+}
+
+func (o *options) writesStdout(name string) bool {
+	return o.toStdout || (name == "-" && o.output == "")
+}
+
+// forEachFile runs fn on every file. A single failure is returned as is;
+// with several files each failure is reported and processing continues.
+func forEachFile(files []string, fn func(name string) error) error {
+	if len(files) == 1 {
+		if err := fn(files[0]); err != nil {
+			return fmt.Errorf("%s: %w", files[0], err)
+		}
+		return nil
+	}
+
+	failures := &filesError{total: len(files)}
+	for _, name := range files {
+		if err := fn(name); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", name, err)
+			failures.add(err)
+		}
+	}
+	if failures.failed > 0 {
+		return failures
+	}
+	return nil
+}
+
+func runCompress(args []string) error {
+	var o options
+	fs := newFlagSet("compress", "[flags] <file>|-...", "Compress each file to <file>.comp and remove it (unless -k), or standard input to standard output.")
+	o.outputFlags(fs, false)
+	o.chainFlags(fs)
+	o.dicts.flags(fs)
+	o.keyFlags(fs, true)
+	o.walk.flags(fs)
+	o.meta.flags(fs)
+	o.jsonFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	return o.finishJSON(compressFiles(&o, fs.Args()))
+}
+
+func runDecompress(args []string) error {
+	var o options
+	fs := newFlagSet("decompress", "[flags] <file>|-...", "Decompress each <file>.comp to <file> and remove it (unless -k), or standard input to standard output.")
+	o.outputFlags(fs, false)
+	o.legacyChainFlag(fs)
+	o.dicts.flags(fs)
+	o.keyFlags(fs, false)
+	o.limitFlags(fs)
+	o.walk.flags(fs)
+	o.meta.flags(fs)
+	o.jsonFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	return o.finishJSON(decompressFiles(&o, fs.Args()))
+}
+
+func compressFiles(o *options, files []string) error {
+	files, err := o.inputs(files)
+	if err != nil {
+		return err
+	}
+	encryptor, err := o.encryptor(false)
+	if err != nil {
+		return err
+	}
+	if err := o.dicts.load(); err != nil {
+		return err
+	}
+	if o.algorithms == "max" {
+		o.algorithms = compress.MaxChain
+	}
+	if o.algorithms != "auto" {
+		if _, err := parseChain(o.algorithms); err != nil {
+			return err
+		}
+	}
+
+	// Already compressed files are skipped when walking directories.
+	files, walkFailures, err := o.walk.expand(files, func(path string) bool {
+		return !strings.HasSuffix(path, o.suffix)
+	})
+	if err != nil {
+		return err
+	}
+	if err := o.checkOutputFlags(files); err != nil {
+		return err
+	}
+
+	summary := walkSummary{failed: walkFailures}
+	err = forEachFile(files, func(name string) error {
+		rec, err := compressFile(o, name, encryptor)
+		summary.add(rec.InputSize, rec.OutputSize, err)
+		return o.report("compress", rec, err)
+	})
+	return o.finishWalk(&summary, err)
+}
+
+// finishWalk prints the summary of a recursive run and makes unreadable
+// paths fail the command.
+func (o *options) finishWalk(summary *walkSummary, err error) error {
+	if !o.walk.recursive {
+		return err
+	}
+	if o.json {
+		json.NewEncoder(o.log).Encode(summary.record())
+	} else {
+		fmt.Fprintln(o.log, summary)
+	}
+	if err == nil && summary.failed > 0 {
+		return errWalkFailures
+	}
+	return err
+}
+
+// compressFile compresses one file. The record describes how far it got
+// when an error is returned.
+func compressFile(o *options, filename string, encryptor *compress.EncryptionCompressor) (fileRecord, error) {
+	started := time.Now()
+	rec := fileRecord{Input: filename}
+
+	data, err := readLimited(filename, o.maxStdin)
+	if err != nil {
+		return rec, err
+	}
+	rec.InputSize = len(data)
+	var info os.FileInfo
+	if filename != "-" {
+		if info, err = os.Stat(filename); err != nil {
+			return rec, err
+		}
+	}
+	meta, err := o.meta.collect(filename, info)
+	if err != nil {
+		return rec, withCode(codeIO, err)
+	}
+
+	if o.verbose {
+		fmt.Fprintf(o.log, "Original size: %d bytes\n", len(data))
+	}
+
+	codecStarted := time.Now()
+	spec := o.algorithms
+	if spec == "auto" {
+		sel, err := compress.SelectChain(data, compress.AutoOptions{Trial: o.autoTrial})
+		if err != nil {
+			return rec, fmt.Errorf("selecting algorithms: %w", err)
+		}
+		spec = sel.Chain
+		if o.verbose {
+			fmt.Fprintf(o.log, "Entropy: %.2f bits/byte, mean run: %.2f, repetition: %.2f%%\n",
+				sel.Analysis.Entropy, sel.Analysis.MeanRun, sel.Analysis.Repetition*100)
+			fmt.Fprintf(o.log, "Auto-selected chain: %s\n", spec)
+		}
+	}
+
+	requested := spec
+	ctx, clearProgress := o.startProgress(filename, len(data))
+	result, spec, err := compressPayload(ctx, data, spec, encryptor, meta)
+	clearProgress()
+	if err != nil {
+		return rec, fmt.Errorf("compression failed: %w", err)
+	}
+	rec.Chain, rec.OutputSize = spec, len(result)
+	rec.CodecNanos = time.Since(codecStarted).Nanoseconds()
+	if o.json {
+		rec.Checksum = checksum(data)
+	}
+
+	if o.verbose && spec != requested {
+		fmt.Fprintf(o.log, "Chain %s did not shrink the data, stored it uncompressed\n", requested)
+	}
+
+	if o.verbose {
+		fmt.Fprintf(o.log, "Compressed size: %d bytes\n", len(result))
+		fmt.Fprintf(o.log, "Compression ratio: %.2f%%\n", float64(len(result))/float64(len(data))*100)
+		fmt.Fprintf(o.log, "First 32 bytes: %s\n", hex.EncodeToString(result[:min(32, len(result))]))
+	}
+
+	if o.writesStdout(filename) {
+		if _, err := os.Stdout.Write(result); err != nil {
+			return rec, fmt.Errorf("writing to standard output: %w", err)
+		}
+		rec.Output = "-"
+		rec.TotalNanos = time.Since(started).Nanoseconds()
+		return rec, nil
+	}
+
+	outfile, err := o.outputPath(filename, false)
+	if err != nil {
+		return rec, err
+	}
+	if sameFile(outfile, filename) {
+		return rec, withCode(codeUsage, fmt.Errorf("the output %s would replace the input", outfile))
+	}
+	if err := writeFileAtomic(outfile, result, filePerm(meta.Mode), o.force); err != nil {
+		return rec, fmt.Errorf("writing compressed file: %w", err)
+	}
+	rec.Output = outfile
+	if err := o.removeInput(filename); err != nil {
+		return rec, err
+	}
+	if !o.json && !o.quiet {
+		fmt.Fprintf(o.log, "Successfully compressed to: %s using algorithms: %s\n", outfile, spec)
+	}
+	rec.TotalNanos = time.Since(started).Nanoseconds()
+	return rec, nil
+}
+
+func decompressFiles(o *options, files []string) error {
+	files, err := o.inputs(files)
+	if err != nil {
+		return err
+	}
+	encryptor, err := o.encryptor(true)
+	if err != nil {
+		return err
+	}
+	if err := o.dicts.load(); err != nil {
+		return err
+	}
+
+	// Only compressed files are picked up when walking directories.
+	files, walkFailures, err := o.walk.expand(files, func(path string) bool {
+		return strings.HasSuffix(path, o.suffix)
+	})
+	if err != nil {
+		return err
+	}
+	if err := o.checkOutputFlags(files); err != nil {
+		return err
+	}
+
+	summary := walkSummary{failed: walkFailures}
+	err = forEachFile(files, func(name string) error {
+		rec, err := decompressFile(o, name, encryptor)
+		summary.add(rec.InputSize, rec.OutputSize, err)
+		return o.report("decompress", rec, err)
+	})
+	return o.finishWalk(&summary, err)
+}
+
+// decompressFile decompresses one file. The record describes how far it
+// got when an error is returned.
+func decompressFile(o *options, filename string, encryptor *compress.EncryptionCompressor) (fileRecord, error) {
+	started := time.Now()
+	rec := fileRecord{Input: filename}
+
+	outputFilename := "-"
+	if !o.writesStdout(filename) {
+		var err error
+		if outputFilename, err = o.outputPath(filename, true); err != nil {
+			return rec, err
+		}
+	}
+
+	data, err := readLimited(filename, o.maxStdin)
+	if err != nil {
+		return rec, err
+	}
+	rec.InputSize = len(data)
+	codecStarted := time.Now()
+	ctx, clearProgress := o.startProgress(filename, len(data))
+	decompressedData, header, err := decompressData(ctx, data, o.algorithms, encryptor, o.limits)
+	clearProgress()
+	if err != nil {
+		return rec, fmt.Errorf("decompression failed: %w", err)
+	}
+	rec.CodecNanos = time.Since(codecStarted).Nanoseconds()
+	rec.OutputSize = len(decompressedData)
+	if o.json {
+		rec.Checksum = checksum(decompressedData)
+	}
+	// Legacy files have no header and so no metadata.
+	rec.Chain = header.Chain
+	switch {
+	case compress.IsXZ(data):
+		rec.Chain = "xz"
+	case !compress.IsContainer(data):
+		rec.Chain = o.algorithms
+	}
+
+	if o.writesStdout(filename) {
+		if _, err := os.Stdout.Write(decompressedData); err != nil {
+			return rec, fmt.Errorf("writing to standard output: %w", err)
+		}
+		rec.Output = "-"
+		rec.TotalNanos = time.Since(started).Nanoseconds()
+		return rec, nil
+	}
+
+	// Without a command outputs are overwritten by default, so the stored
+	// name, which anyone could have written, is not used there.
+	if o.output == "" && !o.legacy {
+		outputFilename = o.meta.outputName(outputFilename, header)
+	}
+	if sameFile(outputFilename, filename) {
+		return rec, withCode(codeUsage, fmt.Errorf("the output %s would replace the input (use -o)", outputFilename))
+	}
+	if err := writeFileAtomic(outputFilename, decompressedData, filePerm(header.Mode), o.force); err != nil {
+		return rec, fmt.Errorf("writing decompressed file: %w", err)
+	}
+	rec.Output = outputFilename
+	if err := o.meta.restore(outputFilename, header); err != nil {
+		return rec, withCode(codeIO, err)
+	}
+	if err := o.removeInput(filename); err != nil {
+		return rec, err
+	}
+	if o.verbose {
+		fmt.Fprintf(o.log, "Decompressed %s to %s (%d bytes)\n", filename, outputFilename, len(decompressedData))
+	}
+	rec.TotalNanos = time.Since(started).Nanoseconds()
+	return rec, nil
+}
@@ -0,0 +1,201 @@
+// cmd_inspect.go
+package main
+
+import (
+	"context"
+	"filecompressor/compress"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func runTest(args []string) error {
+	var o options
+	fs := newFlagSet("test", "[flags] <file>|-...", "Check that each file decompresses, without writing anything.")
+	fs.BoolVar(&o.verbose, "v", false, "Report every file, not only failures")
+	fs.BoolVar(&o.quiet, "q", false, "Do not show a progress bar")
+	o.legacyChainFlag(fs)
+	o.dicts.flags(fs)
+	o.keyFlags(fs, false)
+	o.limitFlags(fs)
+	o.jsonFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	return o.finishJSON(testFiles(&o, fs.Args()))
+}
+
+func testFiles(o *options, files []string) error {
+	files, err := o.inputs(files)
+	if err != nil {
+		return err
+	}
+	encryptor, err := o.encryptor(true)
+	if err != nil {
+		return err
+	}
+	if err := o.dicts.load(); err != nil {
+		return err
+	}
+
+	return forEachFile(files, func(name string) error {
+		rec, err := testFile(o, name, encryptor)
+		return o.report("test", rec, err)
+	})
+}
+
+func testFile(o *options, name string, encryptor *compress.EncryptionCompressor) (fileRecord, error) {
+	started := time.Now()
+	rec := fileRecord{Input: name}
+	data, err := readInput(name)
+	if err != nil {
+		return rec, err
+	}
+	rec.InputSize = len(data)
+	if header, _, err := compress.Unpack(data); err == nil {
+		rec.Chain = header.Chain
+	}
+	ctx, clearProgress := o.startProgress(name, len(data))
+	original, _, err := decompressData(ctx, data, o.algorithms, encryptor, o.limits)
+	clearProgress()
+	if err != nil {
+		return rec, fmt.Errorf("test failed: %w", err)
+	}
+	rec.OutputSize = len(original)
+	if o.json {
+		rec.Checksum = checksum(original)
+	}
+	rec.CodecNanos = time.Since(started).Nanoseconds()
+	rec.TotalNanos = rec.CodecNanos
+	if o.verbose {
+		fmt.Fprintf(o.log, "%s: OK\n", name)
+	}
+	return rec, nil
+}
+
+func runInfo(args []string) error {
+	var o options
+	fs := newFlagSet("info", "[flags] <file>|-...", "Show the header, chain, sizes and ratio of each compressed file.\nThe original size of an encrypted file is only shown when a key is given.")
+	o.legacyChainFlag(fs)
+	o.dicts.flags(fs)
+	o.keyFlags(fs, false)
+	o.limitFlags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	files, err := o.inputs(fs.Args())
+	if err != nil {
+		return err
+	}
+	encryptor, err := o.encryptor(true)
+	if err != nil {
+		return err
+	}
+	if err := o.dicts.load(); err != nil {
+		return err
+	}
+
+	return forEachFile(files, func(name string) error {
+		data, err := readInput(name)
+		if err != nil {
+			return err
+		}
+		return printInfo(name, data, &o, encryptor)
+	})
+}
+
+func printInfo(name string, data []byte, o *options, encryptor *compress.EncryptionCompressor) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "%s:\n", name)
+	if compress.IsContainer(data) {
+		header, payload, err := compress.Unpack(data)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "  format:\tcontainer\n")
+		fmt.Fprintf(w, "  chain:\t%s\n", header.Chain)
+		fmt.Fprintf(w, "  stages:\t%s\n", describeStages(header.Chain))
+		if header.Encrypted {
+			c, kdf, err := compress.EncryptionParams(payload)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "  encrypted:\t%s, key from %s\n", c, kdf)
+		} else {
+			fmt.Fprintf(w, "  encrypted:\tno\n")
+		}
+		if header.Name != "" {
+			fmt.Fprintf(w, "  name:\t%s\n", header.Name)
+		}
+		if header.Mode != 0 {
+			fmt.Fprintf(w, "  mode:\t%v\n", header.Mode)
+		}
+		if !header.ModTime.IsZero() {
+			fmt.Fprintf(w, "  modified:\t%s\n", header.ModTime.Format(time.RFC3339))
+		}
+		if header.HasOwner {
+			fmt.Fprintf(w, "  owner:\t%d:%d\n", header.UID, header.GID)
+		}
+		if len(header.Xattrs) > 0 {
+			fmt.Fprintf(w, "  xattrs:\t%d\n", len(header.Xattrs))
+		}
+		if header.HasChecksum {
+			fmt.Fprintf(w, "  checksum:\tcrc32 %08x\n", header.Checksum)
+		}
+		fmt.Fprintf(w, "  header size:\t%d bytes\n", len(data)-len(payload))
+	} else if compress.IsXZ(data) {
+		fmt.Fprintf(w, "  format:\txz\n")
+	} else {
+		fmt.Fprintf(w, "  format:\tlegacy (no header, assuming -algo=%s)\n", o.algorithms)
+	}
+	fmt.Fprintf(w, "  compressed size:\t%d bytes\n", len(data))
+
+	header, _, _ := compress.Unpack(data)
+	if header.Encrypted && encryptor == nil {
+		fmt.Fprintf(w, "  original size:\tunknown (encrypted; pass -passphrase-file or -key-file)\n")
+		return nil
+	}
+	original, _, err := decompressData(context.Background(), data, o.algorithms, encryptor, o.limits)
+	if err != nil {
+		return fmt.Errorf("decompression failed: %w", err)
+	}
+	fmt.Fprintf(w, "  original size:\t%d bytes\n", len(original))
+	if len(original) > 0 {
+		fmt.Fprintf(w, "  ratio:\t%.2f%%\n", float64(len(data))/float64(len(original))*100)
+	}
+	return nil
+}
+
+// describeStages annotates each stage of a chain spec with its registry id.
+func describeStages(spec string) string {
+	stages := strings.Split(spec, ",")
+	for i, stage := range stages {
+		name, _, _ := strings.Cut(stage, ":")
+		if algo, ok := compress.Lookup(name); ok {
+			stages[i] = fmt.Sprintf("%s (id %d)", stage, algo.ID)
+		} else {
+			stages[i] = stage + " (unknown)"
+		}
+	}
+	return strings.Join(stages, " -> ")
+}
+
+func runList(args []string) error {
+	fs := newFlagSet("list", "", "List the registered compression algorithms and their ids.")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintf(w, "NAME\tID\n")
+	for _, algo := range compress.Algorithms() {
+		fmt.Fprintf(w, "%s\t%d\n", algo.Name, algo.ID)
+	}
+	return nil
+}
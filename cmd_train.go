@@ -0,0 +1,105 @@
+// cmd_train.go
+package main
+
+import (
+	"bytes"
+	"errors"
+	"filecompressor/compress"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// dictList is the repeatable -dict flag: dictionary files to load before
+// any chain is parsed.
+type dictList []string
+
+func (d *dictList) String() string { return strings.Join(*d, ",") }
+
+func (d *dictList) Set(name string) error {
+	*d = append(*d, name)
+	return nil
+}
+
+func (d *dictList) flags(fs *flag.FlagSet) {
+	fs.Var(d, "dict", "Load a dictionary written by 'filecompressor train', for chains such as lzw:dict=<id> (repeatable)")
+}
+
+// load registers the dictionaries, so that chain specs and the headers of
+// compressed files can name them by ID.
+func (d dictList) load() error {
+	for _, name := range d {
+		data, err := readInput(name)
+		if err != nil {
+			return fmt.Errorf("loading dictionary: %w", err)
+		}
+		dict, err := compress.ParseDict(data)
+		if err != nil {
+			return fmt.Errorf("loading dictionary %s: %w", name, err)
+		}
+		compress.RegisterDict(dict)
+	}
+	return nil
+}
+
+func runTrain(args []string) error {
+	var output string
+	var lines, force bool
+	var walk walkOptions
+	size := sizeValue(compress.DefaultDictSize)
+	fs := newFlagSet("train", "[flags] <file>|-...", "Build a dictionary from sample files, for compressing many small inputs like\nthem, and print its ID. Load it with -dict and name it in -algo, e.g.\n-dict=dictionary -algo=lzw:dict=<id>.")
+	fs.StringVar(&output, "o", "dictionary", "Write the dictionary to this path")
+	fs.Var(&size, "size", "Size of the dictionary in `bytes` (suffixes k, m)")
+	fs.BoolVar(&lines, "lines", false, "Take each line of the files as a sample, e.g. for JSON lines")
+	fs.BoolVar(&force, "f", false, "Overwrite an existing output file")
+	walk.flags(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return withCode(codeUsage, errors.New("no sample files (use - for standard input)"))
+	}
+	if size < compress.MinDictSize || size > compress.MaxDictSize {
+		return withCode(codeUsage, fmt.Errorf("-size must be between %d and %d", compress.MinDictSize, compress.MaxDictSize))
+	}
+
+	files, walkFailures, err := walk.expand(fs.Args(), func(string) bool { return true })
+	if err != nil {
+		return err
+	}
+	var samples [][]byte
+	err = forEachFile(files, func(name string) error {
+		data, err := readInput(name)
+		if err != nil {
+			return err
+		}
+		if !lines {
+			samples = append(samples, data)
+			return nil
+		}
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			if len(line) > 0 {
+				samples = append(samples, line)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if walkFailures > 0 {
+		return errWalkFailures
+	}
+
+	dict, err := compress.TrainDict(samples, int(size))
+	if err != nil {
+		return withCode(codeUsage, err)
+	}
+	if err := writeFileAtomic(output, dict.Bytes(), 0644, force); err != nil {
+		return fmt.Errorf("writing dictionary: %w", err)
+	}
+	fmt.Fprintf(os.Stdout, "Trained dictionary %s (%d bytes) from %d samples, written to %s\n", dict, len(dict.Content), len(samples), output)
+	fmt.Fprintf(os.Stdout, "Use it with -dict=%s and -algo=lzw:dict=%s, huffman:dict=%s or lzma:preset=%s\n", output, dict, dict, dict)
+	return nil
+}
@@ -0,0 +1,204 @@
+// codec.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"filecompressor/compress"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// readInput reads a whole file, or standard input when name is "-".
+func readInput(name string) ([]byte, error) {
+	if name == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(name)
+}
+
+// readLimited is readInput for compress and decompress, which fail rather
+// than hold more than max bytes of standard input in memory (0 for no
+// limit). Files are not limited: their size is known before reading.
+func readLimited(name string, max int) ([]byte, error) {
+	if name != "-" || max <= 0 {
+		return readInput(name)
+	}
+	data, err := io.ReadAll(io.LimitReader(os.Stdin, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > max {
+		return nil, withCode(codeIO, fmt.Errorf("standard input is larger than -max-stdin=%d bytes", max))
+	}
+	return data, nil
+}
+
+// compressPayload runs the chain given by spec and the optional encryption
+// stage, and records both in a container header. When the chain would expand
+// the data it is stored instead, so the output is never more than the header
+// (plus the encryption overhead) larger than the input. The chain actually
+// used is returned. The file metadata in meta and a checksum of data are
+// recorded alongside, and authenticated along with the data when it is
+// encrypted. The chain reports its progress under ctx.
+func compressPayload(ctx context.Context, data []byte, spec string, encryptor *compress.EncryptionCompressor, meta compress.Header) ([]byte, string, error) {
+	chain, err := parseChain(spec)
+	if err != nil {
+		return nil, "", err
+	}
+	payload, err := chain.CompressContext(ctx, data)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(payload) >= len(data) && spec != "store" {
+		spec = "store"
+		payload = data
+	}
+	meta.Chain = spec
+	meta.SetChecksum(data)
+	if encryptor != nil {
+		out, err := compress.PackSealed(meta, payload, encryptor)
+		return out, spec, err
+	}
+	return compress.Pack(meta, payload), spec, nil
+}
+
+// decompressData reverses compressPayload, returning the header with the
+// metadata to restore. Files without a container header predate it and are
+// decoded with the -algo chain, apart from .xz files, which are recognised
+// by their magic bytes; both return an empty header. Every stage of the
+// chain is bounded by limits and reports its progress under ctx.
+func decompressData(ctx context.Context, data []byte, algorithms string, encryptor *compress.EncryptionCompressor, limits compress.Limits) ([]byte, compress.Header, error) {
+	var header compress.Header
+	if compress.IsXZ(data) {
+		out, err := compress.DecodeXZ(ctx, data, limits)
+		if err != nil {
+			return nil, header, withCode(codeCorrupt, err)
+		}
+		return out, header, nil
+	}
+	if !compress.IsContainer(data) {
+		compressor, err := newChain(algorithms, encryptor)
+		if err != nil {
+			return nil, header, err
+		}
+		compressor.SetLimits(limits)
+		out, err := decode(ctx, compressor, data)
+		return out, header, err
+	}
+
+	header, payload, err := compress.Unpack(data)
+	if err != nil {
+		return nil, header, withCode(codeCorrupt, err)
+	}
+	if header.Encrypted {
+		if encryptor == nil {
+			return nil, header, withCode(codeKeyRequired, errors.New("file is encrypted: use -passphrase-file or -key-file"))
+		}
+		header, payload, err = compress.OpenSealed(data, encryptor)
+		if err != nil {
+			return nil, header, withCode(codeCorrupt, err)
+		}
+	}
+	chain, err := parseChain(header.Chain)
+	if err != nil {
+		return nil, header, err
+	}
+	chain.SetLimits(limits)
+	out, err := decode(ctx, chain, payload)
+	if err != nil {
+		return nil, header, err
+	}
+	if err := header.Verify(out); err != nil {
+		return nil, header, err
+	}
+	return out, header, nil
+}
+
+// decode runs c.Decompress and marks its failures as corrupt input, unless
+// they carry a more specific cause such as compress.ErrOutputLimit.
+func decode(ctx context.Context, c compress.Compressor, data []byte) ([]byte, error) {
+	out, err := compress.DecompressContext(ctx, c, data)
+	if err != nil {
+		return nil, withCode(codeCorrupt, err)
+	}
+	return out, nil
+}
+
+// parseChain is compress.ParseChain with invalid specs marked as usage
+// errors, and dictionaries that were not loaded pointed out.
+func parseChain(spec string) (*compress.CompressionChain, error) {
+	chain, err := compress.ParseChain(spec)
+	if errors.Is(err, compress.ErrUnknownDictionary) {
+		err = fmt.Errorf("%w (load it with -dict)", err)
+	}
+	if err != nil {
+		return nil, withCode(codeUsage, err)
+	}
+	return chain, nil
+}
+
+// newChain resolves the -algo list for files without a header, whose
+// huffman stages wrote an older layout. The encryption stage, if any,
+// always runs after compression.
+func newChain(algorithms string, encryptor *compress.EncryptionCompressor) (*compress.CompressionChain, error) {
+	chain, err := compress.ParseLegacyChain(algorithms)
+	if err != nil {
+		return nil, withCode(codeUsage, err)
+	}
+	if encryptor != nil {
+		return compress.NewCompressionChain(chain, encryptor), nil
+	}
+	return chain, nil
+}
+
+// algorithmNames lists the registered algorithms for help output.
+func algorithmNames() string {
+	names := make([]string, 0)
+	for _, algo := range compress.Algorithms() {
+		names = append(names, algo.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// newEncryptor builds the encryption stage from either a passphrase file or a
+// key file. A key file holds 32 raw bytes or 64 hex characters.
+func newEncryptor(passphraseFile, keyFile, cipherName, kdfName string) (*compress.EncryptionCompressor, error) {
+	c, err := compress.ParseCipher(cipherName)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case passphraseFile != "" && keyFile != "":
+		return nil, errors.New("use either -passphrase-file or -key-file, not both")
+	case passphraseFile != "":
+		kdf, err := compress.ParseKDF(kdfName)
+		if err != nil {
+			return nil, err
+		}
+		passphrase, err := ioutil.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = bytes.TrimRight(passphrase, "\r\n")
+		return compress.NewPassphraseEncryptor(c, kdf, passphrase)
+	case keyFile != "":
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		if trimmed := bytes.TrimSpace(key); len(trimmed) == 64 {
+			if decoded, err := hex.DecodeString(string(trimmed)); err == nil {
+				key = decoded
+			}
+		}
+		return compress.NewKeyEncryptor(c, key)
+	}
+	return nil, errors.New("encryption requires -passphrase-file or -key-file")
+}
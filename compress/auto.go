@@ -0,0 +1,197 @@
+// compress/auto.go
+package compress
+
+import (
+	"bytes"
+	"math"
+)
+
+// Analysis summarises the statistics auto selection is based on.
+type Analysis struct {
+	// Entropy is the order-0 Shannon entropy in bits per byte.
+	Entropy float64
+	// MeanRun is the average length of runs of equal bytes.
+	MeanRun float64
+	// Repetition is the fraction of 4-byte sequences already seen earlier
+	// in the data, a cheap estimate of what a dictionary coder can find.
+	Repetition float64
+}
+
+// Analyze computes the statistics of data.
+func Analyze(data []byte) Analysis {
+	var a Analysis
+	if len(data) == 0 {
+		return a
+	}
+
+	var freqs [256]int
+	runs := 1
+	for i, b := range data {
+		freqs[b]++
+		if i > 0 && b != data[i-1] {
+			runs++
+		}
+	}
+	for _, f := range freqs {
+		if f > 0 {
+			p := float64(f) / float64(len(data))
+			a.Entropy -= p * math.Log2(p)
+		}
+	}
+	a.MeanRun = float64(len(data)) / float64(runs)
+
+	if len(data) >= 4 {
+		seen := make(map[uint32]struct{})
+		repeats := 0
+		for i := 0; i+4 <= len(data); i++ {
+			gram := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+			if _, ok := seen[gram]; ok {
+				repeats++
+			} else {
+				seen[gram] = struct{}{}
+			}
+		}
+		a.Repetition = float64(repeats) / float64(len(data)-3)
+	}
+
+	return a
+}
+
+// AutoOptions controls SelectChain.
+type AutoOptions struct {
+	// SampleSize is the number of bytes analysed; 0 means 64 KiB. Larger
+	// inputs are sampled in four evenly spaced slices.
+	SampleSize int
+	// Trial compresses the sample with every candidate and keeps the one
+	// that round-trips to the smallest output. Without it the choice is
+	// made from the Analysis alone.
+	Trial bool
+	// Candidates are the chain specs tried; nil means DefaultCandidates.
+	Candidates []string
+}
+
+// DefaultCandidates are the chains tried by auto selection.
+var DefaultCandidates = []string{
+	"lzw",
+	"rle",
+	"huffman",
+	"sf",
+	"lzw,huffman",
+	"bwt:block=64k,rle",
+	"bwt:block=64k,rle,huffman",
+}
+
+// Selection is the outcome of SelectChain.
+type Selection struct {
+	Chain    string
+	Analysis Analysis
+	// Ratios holds compressed/original sample size per candidate that
+	// round-tripped, when Trial was set.
+	Ratios map[string]float64
+}
+
+const (
+	defaultSampleSize = 64 << 10
+	// Above this entropy with almost no repeated sequences the data is
+	// most likely already compressed or encrypted.
+	incompressibleEntropy    = 7.9
+	incompressibleRepetition = 0.02
+)
+
+// SelectChain picks a chain spec for data, or "store" when nothing is
+// expected to make it smaller.
+func SelectChain(data []byte, opts AutoOptions) (Selection, error) {
+	sample := sampleOf(data, opts.SampleSize)
+	sel := Selection{Analysis: Analyze(sample)}
+
+	if len(sample) == 0 ||
+		(sel.Analysis.Entropy > incompressibleEntropy && sel.Analysis.Repetition < incompressibleRepetition) {
+		sel.Chain = "store"
+		return sel, nil
+	}
+
+	if !opts.Trial {
+		sel.Chain = chooseByAnalysis(sel.Analysis)
+		return sel, nil
+	}
+
+	candidates := opts.Candidates
+	if candidates == nil {
+		candidates = DefaultCandidates
+	}
+
+	sel.Chain = "store"
+	sel.Ratios = make(map[string]float64)
+	best := len(sample)
+	for _, spec := range candidates {
+		chain, err := ParseChain(spec)
+		if err != nil {
+			return sel, err
+		}
+		compressed, ok := trial(chain, sample)
+		if !ok {
+			continue
+		}
+
+		sel.Ratios[spec] = float64(len(compressed)) / float64(len(sample))
+		if len(compressed) < best {
+			best = len(compressed)
+			sel.Chain = spec
+		}
+	}
+
+	return sel, nil
+}
+
+// trial compresses sample with chain and reports whether it round-trips.
+// Any failure, including a panicking stage, rules the candidate out.
+func trial(chain *CompressionChain, sample []byte) (compressed []byte, ok bool) {
+	defer func() {
+		if recover() != nil {
+			compressed, ok = nil, false
+		}
+	}()
+
+	compressed, err := chain.Compress(sample)
+	if err != nil {
+		return nil, false
+	}
+	restored, err := chain.Decompress(compressed)
+	if err != nil || !bytes.Equal(restored, sample) {
+		return nil, false
+	}
+	return compressed, true
+}
+
+func chooseByAnalysis(a Analysis) string {
+	switch {
+	case a.MeanRun >= 4:
+		return "rle"
+	case a.Repetition > 0.5:
+		return "lzw"
+	case a.Repetition > 0.2:
+		return "bwt:block=64k,rle,huffman"
+	case a.Entropy < 7:
+		return "huffman"
+	}
+	return "store"
+}
+
+func sampleOf(data []byte, size int) []byte {
+	if size <= 0 {
+		size = defaultSampleSize
+	}
+	if len(data) <= size {
+		return data
+	}
+
+	const slices = 4
+	part := size / slices
+	stride := (len(data) - part) / (slices - 1)
+	sample := make([]byte, 0, part*slices)
+	for i := 0; i < slices; i++ {
+		start := i * stride
+		sample = append(sample, data[start:start+part]...)
+	}
+	return sample
+}
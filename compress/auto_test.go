@@ -0,0 +1,62 @@
+// compress/auto_test.go
+package compress
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestSelectChain(t *testing.T) {
+	random := make([]byte, 50000)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := bytes.Repeat([]byte("GET /index.html 200 OK\n"), 500)
+	runs := bytes.Repeat([]byte{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 1, 1, 1, 1}, 200)
+
+	for _, trial := range []bool{true, false} {
+		sel, err := SelectChain(random, AutoOptions{Trial: trial})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sel.Chain != "store" {
+			t.Errorf("trial=%v: random data: got %q, want store", trial, sel.Chain)
+		}
+
+		for _, input := range [][]byte{text, runs} {
+			sel, err := SelectChain(input, AutoOptions{Trial: trial})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sel.Chain == "store" {
+				t.Errorf("trial=%v: compressible data stored (analysis %+v)", trial, sel.Analysis)
+			}
+			if _, err := ParseChain(sel.Chain); err != nil {
+				t.Errorf("selected chain %q does not parse: %v", sel.Chain, err)
+			}
+		}
+	}
+}
+
+func TestSelectChainTrialRoundTrips(t *testing.T) {
+	input := bytes.Repeat([]byte("Repeated repeated repeated repeated data. "), 100)
+	sel, err := SelectChain(input, AutoOptions{Trial: true, SampleSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sel.Ratios) == 0 {
+		t.Fatal("no candidate round-tripped")
+	}
+	if ratio, ok := sel.Ratios[sel.Chain]; !ok || ratio >= 1 {
+		t.Errorf("selected %q with ratio %v", sel.Chain, ratio)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	a := Analyze([]byte("aaaabbbb"))
+	if a.Entropy != 1 {
+		t.Errorf("entropy = %v, want 1", a.Entropy)
+	}
+	if a.MeanRun != 4 {
+		t.Errorf("mean run = %v, want 4", a.MeanRun)
+	}
+}
@@ -0,0 +1,284 @@
+// compress/bcj.go
+package compress
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+func init() {
+	Register("bcj", 10, func(p Params) (Compressor, error) {
+		if err := p.Allow("arch"); err != nil {
+			return nil, err
+		}
+		arch := BCJX86
+		if name, ok := p["arch"]; ok {
+			var err error
+			if arch, err = ParseBCJArch(name); err != nil {
+				return nil, err
+			}
+		}
+		return NewBCJCompressor(arch), nil
+	})
+}
+
+// BCJArch is the instruction set whose branches the bcj stage converts.
+type BCJArch byte
+
+const (
+	// BCJX86 converts the relative CALL and JMP instructions (E8 and E9)
+	// of 32-bit and 64-bit x86 code.
+	BCJX86 BCJArch = iota + 1
+	// BCJARM64 converts the BL and ADRP instructions of ARM64 code.
+	BCJARM64
+)
+
+var bcjArchNames = []string{BCJX86: "x86", BCJARM64: "arm64"}
+
+func (a BCJArch) String() string {
+	if int(a) < len(bcjArchNames) && bcjArchNames[a] != "" {
+		return bcjArchNames[a]
+	}
+	return fmt.Sprintf("BCJArch(%d)", byte(a))
+}
+
+// ParseBCJArch parses "x86" or "arm64".
+func ParseBCJArch(name string) (BCJArch, error) {
+	for a, n := range bcjArchNames {
+		if n != "" && n == name {
+			return BCJArch(a), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown architecture %q (use x86 or arm64)", name)
+}
+
+// The filters are those of xz, so that they also decode .xz files. They
+// work in place on buf, whose first byte is at offset pos of the stream,
+// and return how many bytes they have converted; the rest, fewer than an
+// instruction, are left as they are.
+
+// bcjX86 carries the state of the x86 filter from one call to the next.
+type bcjX86 struct {
+	prevMask uint32
+	prevPos  uint32
+}
+
+func newBCJX86() bcjX86 { return bcjX86{prevPos: 0xFFFFFFFB} } // -5
+
+var (
+	bcjX86Allowed = [8]bool{true, true, true, false, true, false, false, false}
+	bcjX86Bit     = [8]uint32{0, 1, 2, 2, 3, 3, 3, 3}
+)
+
+// bcjX86MSByte reports whether b may be the top byte of a near
+// displacement: small forward or backward branches.
+func bcjX86MSByte(b byte) bool { return b == 0 || b == 0xFF }
+
+// code makes the 32-bit displacement after each E8 or E9 opcode absolute
+// when encoding, and relative again when decoding. The bytes before an
+// opcode decide whether it is likely one: an opcode byte inside the
+// displacement of an earlier branch is skipped.
+func (x *bcjX86) code(buf []byte, pos uint32, encode bool) int {
+	if len(buf) < 5 {
+		return 0
+	}
+	prevMask, prevPos := x.prevMask, x.prevPos
+	if pos-prevPos > 5 {
+		prevPos = pos - 5
+	}
+	i := 0
+	for i <= len(buf)-5 {
+		b := buf[i]
+		if b != 0xE8 && b != 0xE9 {
+			i++
+			continue
+		}
+		offset := pos + uint32(i) - prevPos
+		prevPos = pos + uint32(i)
+		if offset > 5 {
+			prevMask = 0
+		} else {
+			for j := uint32(0); j < offset; j++ {
+				prevMask &= 0x77
+				prevMask <<= 1
+			}
+		}
+
+		b = buf[i+4]
+		if !bcjX86MSByte(b) || !bcjX86Allowed[prevMask>>1&7] || prevMask>>1 >= 0x10 {
+			i++
+			prevMask |= 1
+			if bcjX86MSByte(b) {
+				prevMask |= 0x10
+			}
+			continue
+		}
+
+		src := binary.LittleEndian.Uint32(buf[i+1:])
+		var dest uint32
+		for {
+			if encode {
+				dest = src + (pos + uint32(i) + 5)
+			} else {
+				dest = src - (pos + uint32(i) + 5)
+			}
+			if prevMask == 0 {
+				break
+			}
+			n := bcjX86Bit[prevMask>>1]
+			if !bcjX86MSByte(byte(dest >> (24 - n*8))) {
+				break
+			}
+			src = dest ^ (1<<(32-n*8) - 1)
+		}
+		// The top byte becomes 00 or FF again, by bit 24.
+		dest = dest&0x00FFFFFF | (0-(dest>>24&1))<<24
+		binary.LittleEndian.PutUint32(buf[i+1:], dest)
+		i += 5
+		prevMask = 0
+	}
+	x.prevMask, x.prevPos = prevMask, prevPos
+	return i
+}
+
+// bcjARM64 makes the targets of BL instructions and the pages of ADRP
+// instructions absolute when encoding, and relative when decoding. ADRP
+// pages further than 512 MiB away are left alone.
+func bcjARM64(buf []byte, pos uint32, encode bool) int {
+	i := 0
+	for ; i+4 <= len(buf); i += 4 {
+		pc := pos + uint32(i)
+		instr := binary.LittleEndian.Uint32(buf[i:])
+		switch {
+		case instr>>26 == 0x25: // BL
+			pc >>= 2
+			if !encode {
+				pc = -pc
+			}
+			instr = 0x94000000 | (instr+pc)&0x03FFFFFF
+		case instr&0x9F000000 == 0x90000000: // ADRP
+			src := instr>>29&3 | instr>>3&0x001FFFFC
+			if (src+0x00020000)&0x001C0000 != 0 {
+				continue
+			}
+			pc >>= 12
+			if !encode {
+				pc = -pc
+			}
+			dest := src + pc
+			instr &= 0x9000001F
+			instr |= (dest & 3) << 29
+			instr |= (dest & 0x0003FFFC) << 3
+			instr |= (0 - (dest & 0x00020000)) & 0x00E00000
+		default:
+			continue
+		}
+		binary.LittleEndian.PutUint32(buf[i:], instr)
+	}
+	return i
+}
+
+// bcjCode runs the filter for arch over all of buf, whose first byte is at
+// offset start of the stream, checking t, if any, between chunks.
+func bcjCode(t *tracker, buf []byte, arch BCJArch, start uint32, encode bool) error {
+	x86 := newBCJX86()
+	for done := 0; done < len(buf); {
+		if t != nil {
+			if err := t.update(done); err != nil {
+				return err
+			}
+		}
+		end := min(done+progressInterval, len(buf))
+		var n int
+		if arch == BCJX86 {
+			n = x86.code(buf[done:end], start+uint32(done), encode)
+		} else {
+			n = bcjARM64(buf[done:end], start+uint32(done), encode)
+		}
+		if end == len(buf) {
+			break
+		}
+		done += n
+	}
+	return nil
+}
+
+// BCJCompressor is a filter for executables, such as Go binaries: it
+// rewrites the relative addresses of calls and jumps as absolute ones, so
+// that calls to the same function, wherever they are, become the same
+// bytes for a following LZ stage, e.g. "bcj,lzma" or "bcj:arch=arm64,lzw".
+// The output is as long as the input plus a byte recording the
+// architecture, so it decodes whatever the options of the decoding stage.
+type BCJCompressor struct {
+	limiter
+	arch BCJArch
+}
+
+func NewBCJCompressor(arch BCJArch) *BCJCompressor {
+	return &BCJCompressor{limiter: limiter{DefaultLimits}, arch: arch}
+}
+
+func (bc *BCJCompressor) Compress(data []byte) ([]byte, error) {
+	return bc.appendCompress(context.Background(), nil, data)
+}
+
+func (bc *BCJCompressor) Decompress(data []byte) ([]byte, error) {
+	return bc.appendDecompress(context.Background(), nil, data)
+}
+
+func (bc *BCJCompressor) CompressContext(ctx context.Context, data []byte) ([]byte, error) {
+	return bc.appendCompress(ctx, nil, data)
+}
+
+func (bc *BCJCompressor) DecompressContext(ctx context.Context, data []byte) ([]byte, error) {
+	return bc.appendDecompress(ctx, nil, data)
+}
+
+func (bc *BCJCompressor) AppendCompress(dst, src []byte) ([]byte, error) {
+	return bc.appendCompress(context.Background(), dst, src)
+}
+
+func (bc *BCJCompressor) AppendDecompress(dst, src []byte) ([]byte, error) {
+	return bc.appendDecompress(context.Background(), dst, src)
+}
+
+func (bc *BCJCompressor) appendCompress(ctx context.Context, dst, data []byte) ([]byte, error) {
+	t := newTracker(ctx, "bcj", len(data))
+	if len(data) == 0 {
+		return dst, nil
+	}
+
+	result := slices.Grow(dst, len(data)+1)
+	result = append(result, byte(bc.arch))
+	result = append(result, data...)
+	if err := bcjCode(&t, result[len(dst)+1:], bc.arch, 0, true); err != nil {
+		return nil, err
+	}
+
+	t.finish()
+	return result, nil
+}
+
+func (bc *BCJCompressor) appendDecompress(ctx context.Context, dst, data []byte) ([]byte, error) {
+	t := newTracker(ctx, "bcj", len(data))
+	if len(data) == 0 {
+		return dst, nil
+	}
+
+	arch := BCJArch(data[0])
+	if arch != BCJX86 && arch != BCJARM64 {
+		return nil, corrupt("bcj", 0)
+	}
+	if !bc.limits.allow(len(data), uint64(len(data)-1)) {
+		return nil, tooLarge("bcj", 0)
+	}
+	result := append(dst, data[1:]...)
+	if err := bcjCode(&t, result[len(dst):], arch, 0, false); err != nil {
+		return nil, err
+	}
+
+	t.finish()
+	return result, nil
+}
@@ -0,0 +1,100 @@
+// compress/bcj_test.go
+package compress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// x86Code is n bytes of made-up x86 code: a few common instructions and
+// calls to a few functions from all over.
+func x86Code(n int) []byte {
+	r := rand.New(rand.NewSource(5))
+	targets := make([]int, 16)
+	for i := range targets {
+		targets[i] = r.Intn(n)
+	}
+	filler := [][]byte{{0x48, 0x89, 0xE5}, {0x48, 0x83, 0xEC, 0x20}, {0xC3}, {0x90}, {0x48, 0x8B, 0x44, 0x24, 0x08}}
+	var code []byte
+	for len(code) < n {
+		if r.Intn(3) == 0 {
+			rel := targets[r.Intn(len(targets))] - (len(code) + 5)
+			code = binary.LittleEndian.AppendUint32(append(code, 0xE8), uint32(int32(rel)))
+		} else {
+			code = append(code, filler[r.Intn(len(filler))]...)
+		}
+	}
+	return code[:n]
+}
+
+// arm64Code is the same for ARM64, with BL calls and ADRP loads.
+func arm64Code(n int) []byte {
+	r := rand.New(rand.NewSource(6))
+	targets := make([]int, 16)
+	for i := range targets {
+		targets[i] = r.Intn(n) &^ 3
+	}
+	filler := []uint32{0xD503201F, 0xA9BF7BFD, 0x910003FD, 0xD65F03C0, 0xF9400000}
+	var code []byte
+	for len(code) < n {
+		pc := len(code)
+		var instr uint32
+		switch r.Intn(4) {
+		case 0:
+			instr = 0x94000000 | uint32((targets[r.Intn(len(targets))]-pc)/4)&0x03FFFFFF
+		case 1:
+			page := uint32(targets[r.Intn(len(targets))]>>12 - pc>>12)
+			instr = 0x90000000 | (page&3)<<29 | (page>>2&0x7FFFF)<<5 | uint32(r.Intn(31))
+		default:
+			instr = filler[r.Intn(len(filler))]
+		}
+		code = binary.LittleEndian.AppendUint32(code, instr)
+	}
+	return code[:n]
+}
+
+func TestBCJRoundTrip(t *testing.T) {
+	random := make([]byte, 200*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	inputs := map[string][]byte{
+		"random": random,
+		"x86":    x86Code(200 * 1024),
+		"arm64":  arm64Code(200 * 1024),
+		"calls":  bytes.Repeat([]byte{0xE8, 0, 0, 0, 0, 0xE9}, 1000),
+		"a":      []byte("a"),
+		"short":  {0xE8, 1, 2, 3, 0},
+	}
+	roundTrip(t, []string{"bcj", "bcj:arch=arm64", "bcj,lzma"}, inputs)
+}
+
+// Once the calls are absolute, lzma finds them repeated.
+func TestBCJRatio(t *testing.T) {
+	for _, tc := range []struct {
+		data []byte
+		spec string
+	}{
+		{x86Code(100 * 1024), "bcj,lzma"},
+		{arm64Code(100 * 1024), "bcj:arch=arm64,lzma"},
+	} {
+		chain, _ := ParseChain(tc.spec)
+		filtered, _ := chain.Compress(tc.data)
+		plain, _ := NewLZMACompressor(DefaultLZMAOptions).Compress(tc.data)
+		if len(filtered)*5 > len(plain)*4 {
+			t.Errorf("%s: %d bytes, lzma: %d", tc.spec, len(filtered), len(plain))
+		}
+	}
+}
+
+func TestBCJParams(t *testing.T) {
+	for _, spec := range []string{"bcj:arch=arm", "bcj:start=4"} {
+		if _, err := ParseChain(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+	if _, err := NewBCJCompressor(BCJX86).Decompress([]byte{9, 1, 2}); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("unknown architecture: %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+// compress/bits.go
+package compress
+
+// bitWriter appends bits to a byte slice, most significant bit first.
+type bitWriter struct {
+	buf   []byte
+	nbits int
+}
+
+func (w *bitWriter) writeBit(bit byte) {
+	if w.nbits%8 == 0 {
+		w.buf = append(w.buf, 0)
+	}
+	if bit != 0 {
+		w.buf[len(w.buf)-1] |= 1 << uint(7-w.nbits%8)
+	}
+	w.nbits++
+}
+
+// writeBits writes the low n bits of bits, most significant first.
+func (w *bitWriter) writeBits(bits uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBit(byte(bits>>uint(i)) & 1)
+	}
+}
+
+// writeCode writes a code given as a string of '0' and '1'.
+func (w *bitWriter) writeCode(code string) {
+	for i := 0; i < len(code); i++ {
+		w.writeBit(code[i] - '0')
+	}
+}
+
+// bitReader reads bits written by bitWriter.
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+}
+
+// readBit returns the next bit, or false once the data is exhausted.
+func (r *bitReader) readBit() (byte, bool) {
+	if r.pos >= len(r.data)*8 {
+		return 0, false
+	}
+	bit := r.data[r.pos/8] >> uint(7-r.pos%8) & 1
+	r.pos++
+	return bit, true
+}
@@ -2,84 +2,223 @@
 package compress
 
 import (
-	"bytes"
-	"errors"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"slices"
 	"sort"
+	"sync"
 )
 
+const (
+	defaultBWTBlockSize = 1024
+	maxBWTBlockSize     = 16 << 20
+)
+
+func init() {
+	Register("bwt", 5, func(p Params) (Compressor, error) {
+		if err := p.Allow("block"); err != nil {
+			return nil, err
+		}
+		blockSize, err := p.Size("block", defaultBWTBlockSize)
+		if err != nil {
+			return nil, err
+		}
+		if blockSize < 1 || blockSize > maxBWTBlockSize {
+			return nil, fmt.Errorf("block size must be between 1 and %d", maxBWTBlockSize)
+		}
+		return NewBWTCompressor(blockSize), nil
+	})
+}
+
 type BWTCompressor struct {
+	limiter
 	blockSize int
+	scratch   *bwtScratch
 }
 
 func NewBWTCompressor(blockSize int) *BWTCompressor {
-	return &BWTCompressor{blockSize: blockSize}
+	return &BWTCompressor{limiter: limiter{DefaultLimits}, blockSize: blockSize}
+}
+
+// bwtScratch is the working space of the transforms, reused across blocks
+// and calls.
+type bwtScratch struct {
+	order, rank, next []int
+	sorter            bwtSorter
+}
+
+var bwtPool = sync.Pool{New: func() any { return new(bwtScratch) }}
+
+func (bwt *BWTCompressor) scratchSpace() *bwtScratch {
+	if bwt.scratch == nil {
+		bwt.scratch = bwtPool.Get().(*bwtScratch)
+	}
+	return bwt.scratch
+}
+
+// Reset returns the scratch space to the pool and restores DefaultLimits.
+func (bwt *BWTCompressor) Reset() {
+	if bwt.scratch != nil {
+		bwtPool.Put(bwt.scratch)
+		bwt.scratch = nil
+	}
+	bwt.limiter.Reset()
+}
+
+// ints returns s resized to n, reallocating only when it is too small.
+func ints(s []int, n int) []int {
+	if cap(s) < n {
+		return make([]int, n)
+	}
+	return s[:n]
+}
+
+// bwtSorter orders rotation indices by their rank and the rank k
+// positions further on. It is a sort.Interface rather than a closure so
+// that sorting does not allocate.
+type bwtSorter struct {
+	order, rank []int
+	k           int
+}
+
+func (s *bwtSorter) Len() int      { return len(s.order) }
+func (s *bwtSorter) Swap(i, j int) { s.order[i], s.order[j] = s.order[j], s.order[i] }
+func (s *bwtSorter) Less(i, j int) bool {
+	return s.less(s.order[i], s.order[j])
+}
+
+func (s *bwtSorter) less(a, b int) bool {
+	if s.rank[a] != s.rank[b] {
+		return s.rank[a] < s.rank[b]
+	}
+	n := len(s.rank)
+	return s.rank[(a+s.k)%n] < s.rank[(b+s.k)%n]
 }
 
-func (bwt *BWTCompressor) transform(data []byte) ([]byte, int) {
+// transform sorts the cyclic rotations of data by prefix doubling, ranking
+// rotation indices instead of materialising every rotation. It appends the
+// last column to dst and returns it with the row of the original data.
+func (bwt *BWTCompressor) transform(dst, data []byte) ([]byte, int) {
 	n := len(data)
-	rotations := make([][]byte, n)
+	s := bwt.scratchSpace()
+	s.order, s.rank, s.next = ints(s.order, n), ints(s.rank, n), ints(s.next, n)
+	order, rank, next := s.order, s.rank, s.next
 
-	// Create all rotations
 	for i := 0; i < n; i++ {
-		rotation := make([]byte, n)
-		for j := 0; j < n; j++ {
-			rotation[j] = data[(i+j)%n]
-		}
-		rotations[i] = rotation
+		order[i] = i
+		rank[i] = int(data[i])
 	}
 
-	// Sort rotations
-	sort.Slice(rotations, func(i, j int) bool {
-		return bytes.Compare(rotations[i], rotations[j]) < 0
-	})
+	sorter := &s.sorter
+	for k := 1; ; k <<= 1 {
+		*sorter = bwtSorter{order: order, rank: rank, k: k}
+		sort.Sort(sorter)
+
+		next[order[0]] = 0
+		for i := 1; i < n; i++ {
+			next[order[i]] = next[order[i-1]]
+			if sorter.less(order[i-1], order[i]) {
+				next[order[i]]++
+			}
+		}
+		rank, next = next, rank
+
+		// Done once every rotation has a distinct rank, or once the
+		// compared prefixes cover the whole block (periodic input).
+		if rank[order[n-1]] == n-1 || k >= n {
+			break
+		}
+	}
+	*sorter = bwtSorter{}
 
 	// Find original string index and get last column
-	result := make([]byte, n)
 	originalIndex := 0
-	for i := 0; i < n; i++ {
-		result[i] = rotations[i][n-1]
-		if bytes.Equal(rotations[i], data) {
+	for i, start := range order {
+		dst = append(dst, data[(start+n-1)%n])
+		if start == 0 {
 			originalIndex = i
 		}
 	}
 
-	return result, originalIndex
+	return dst, originalIndex
 }
 
-func (bwt *BWTCompressor) inverseTransform(data []byte, originalIndex int) []byte {
+// inverseTransform appends the block whose transform is data to dst.
+func (bwt *BWTCompressor) inverseTransform(dst, data []byte, originalIndex int) []byte {
 	n := len(data)
-	table := make([][]byte, n)
 
-	// Initialize with single bytes
-	for i := 0; i < n; i++ {
-		table[i] = []byte{data[i]}
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	var starts [256]int
+	sum := 0
+	for c := 0; c < 256; c++ {
+		starts[c] = sum
+		sum += counts[c]
 	}
 
-	// Sort table repeatedly
-	for i := 0; i < n-1; i++ {
-		sort.Slice(table, func(i, j int) bool {
-			return bytes.Compare(table[i], table[j]) < 0
-		})
+	s := bwt.scratchSpace()
+	s.next = ints(s.next, n)
+	lf := s.next
+	var seen [256]int
+	for i, b := range data {
+		lf[i] = starts[b] + seen[b]
+		seen[b]++
+	}
 
-		// Prepend transformed data
-		for j := 0; j < n; j++ {
-			table[j] = append([]byte{data[j]}, table[j]...)
-		}
+	base := len(dst)
+	dst = slices.Grow(dst, n)[:base+n]
+	result := dst[base:]
+	row := originalIndex
+	for i := n - 1; i >= 0; i-- {
+		result[i] = data[row]
+		row = lf[row]
 	}
 
-	return table[originalIndex]
+	return dst
+}
+
+func (bwt *BWTCompressor) clearScratch() {
+	bwt.scratch = nil
 }
 
 func (bwt *BWTCompressor) Compress(data []byte) ([]byte, error) {
+	return compressOnce(context.Background(), bwt, data)
+}
+
+func (bwt *BWTCompressor) Decompress(compressed []byte) ([]byte, error) {
+	return decompressOnce(context.Background(), bwt, compressed)
+}
+
+func (bwt *BWTCompressor) CompressContext(ctx context.Context, data []byte) ([]byte, error) {
+	return compressOnce(ctx, bwt, data)
+}
+
+func (bwt *BWTCompressor) DecompressContext(ctx context.Context, compressed []byte) ([]byte, error) {
+	return decompressOnce(ctx, bwt, compressed)
+}
+
+func (bwt *BWTCompressor) AppendCompress(dst, src []byte) ([]byte, error) {
+	return bwt.appendCompress(context.Background(), dst, src)
+}
+
+func (bwt *BWTCompressor) AppendDecompress(dst, src []byte) ([]byte, error) {
+	return bwt.appendDecompress(context.Background(), dst, src)
+}
+
+func (bwt *BWTCompressor) appendCompress(ctx context.Context, dst, data []byte) ([]byte, error) {
+	t := newTracker(ctx, "bwt", len(data))
 	if len(data) == 0 {
-		return nil, nil
+		return dst, nil
 	}
 
-	var result []byte
+	result := dst
 	blockCount := (len(data) + bwt.blockSize - 1) / bwt.blockSize
 
 	// Write number of blocks
-	result = append(result, byte(blockCount))
+	result = binary.AppendUvarint(result, uint64(blockCount))
 
 	// Process each block
 	for i := 0; i < blockCount; i++ {
@@ -89,51 +228,93 @@ func (bwt *BWTCompressor) Compress(data []byte) ([]byte, error) {
 			end = len(data)
 		}
 
+		if err := t.update(start); err != nil {
+			return nil, err
+		}
 		block := data[start:end]
-		transformed, index := bwt.transform(block)
-
-		// Write block metadata
-		result = append(result, byte(len(block)))
-		result = append(result, byte(index))
 
-		// Write transformed block
-		result = append(result, transformed...)
+		// The row of the original data is only known after the
+		// transform, so the block is transformed first and the metadata
+		// moved in front of it.
+		mark := len(result)
+		var index int
+		result, index = bwt.transform(result, block)
+		var meta [2 * binary.MaxVarintLen64]byte
+		m := binary.AppendUvarint(meta[:0], uint64(len(block)))
+		m = binary.AppendUvarint(m, uint64(index))
+		result = append(result, m...)
+		copy(result[mark+len(m):], result[mark:len(result)-len(m)])
+		copy(result[mark:], m)
 	}
 
+	t.finish()
 	return result, nil
 }
 
-func (bwt *BWTCompressor) Decompress(compressed []byte) ([]byte, error) {
+func (bwt *BWTCompressor) appendDecompress(ctx context.Context, dst, compressed []byte) ([]byte, error) {
+	t := newTracker(ctx, "bwt", len(compressed))
 	if len(compressed) == 0 {
-		return nil, nil
+		return dst, nil
 	}
 
-	var result []byte
+	result := dst
 	pos := 0
 
+	readUvarint := func() (int, error) {
+		v, n := binary.Uvarint(compressed[pos:])
+		if n == 0 {
+			return 0, truncated("bwt", pos)
+		}
+		if n < 0 || v > uint64(len(compressed)) {
+			return 0, corrupt("bwt", pos)
+		}
+		pos += n
+		return int(v), nil
+	}
+
 	// Read number of blocks
-	blockCount := int(compressed[pos])
-	pos++
+	blockCount, err := readUvarint()
+	if err != nil {
+		return nil, err
+	}
 
 	// Process each block
-	for i := 0; i < blockCount && pos < len(compressed); i++ {
+	for i := 0; i < blockCount; i++ {
+		if err := t.update(pos); err != nil {
+			return nil, err
+		}
+
 		// Read block metadata
-		blockSize := int(compressed[pos])
-		pos++
-		originalIndex := int(compressed[pos])
-		pos++
+		blockSize, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		originalIndex, err := readUvarint()
+		if err != nil {
+			return nil, err
+		}
 
+		if blockSize == 0 || originalIndex >= blockSize {
+			return nil, corrupt("bwt", pos)
+		}
 		if pos+blockSize > len(compressed) {
-			return nil, errors.New("invalid compressed data")
+			return nil, truncated("bwt", pos)
+		}
+		if !bwt.limits.allow(len(compressed), uint64(len(result)-len(dst)+blockSize)) {
+			return nil, tooLarge("bwt", pos)
 		}
 
 		// Read and inverse transform block
 		block := compressed[pos : pos+blockSize]
-		decompressed := bwt.inverseTransform(block, originalIndex)
-		result = append(result, decompressed...)
+		result = bwt.inverseTransform(result, block, originalIndex)
 
 		pos += blockSize
 	}
 
+	if pos != len(compressed) {
+		return nil, corrupt("bwt", pos)
+	}
+
+	t.finish()
 	return result, nil
 }
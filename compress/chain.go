@@ -1,39 +1,145 @@
 // compress/chain.go
 package compress
 
+import "context"
+
 type CompressionChain struct {
 	compressors []Compressor
+	buffers     [2][]byte
 }
 
 func NewCompressionChain(compressors ...Compressor) *CompressionChain {
 	return &CompressionChain{compressors: compressors}
 }
 
+// SetLimits sets the limits of every stage that supports them.
+func (cc *CompressionChain) SetLimits(l Limits) {
+	for _, c := range cc.compressors {
+		if limiter, ok := c.(Limiter); ok {
+			limiter.SetLimits(l)
+		}
+	}
+}
+
 func (cc *CompressionChain) Compress(data []byte) ([]byte, error) {
-	result := data
-	var err error
+	return cc.CompressContext(context.Background(), data)
+}
+
+func (cc *CompressionChain) Decompress(data []byte) ([]byte, error) {
+	return cc.DecompressContext(context.Background(), data)
+}
 
+// CompressContext runs each stage in turn, stopping early if ctx is
+// cancelled. Progress reports carry the position of the stage. Neither the
+// chain nor its stages keep scratch space, so it may be called from several
+// goroutines at once.
+func (cc *CompressionChain) CompressContext(ctx context.Context, data []byte) ([]byte, error) {
+	return cc.compress(ctx, compressStage, nil, data, false)
+}
+
+// DecompressContext reverses CompressContext.
+func (cc *CompressionChain) DecompressContext(ctx context.Context, data []byte) ([]byte, error) {
+	return cc.decompress(ctx, decompressStage, nil, data, false)
+}
+
+// AppendCompress appends the output of the chain to dst. Intermediate
+// results are kept in buffers the chain reuses on the next call, and the
+// stages keep their scratch space, so unlike Compress it must not be called
+// from several goroutines at once.
+func (cc *CompressionChain) AppendCompress(dst, src []byte) ([]byte, error) {
+	return cc.appendCompress(context.Background(), dst, src)
+}
+
+// AppendDecompress reverses AppendCompress.
+func (cc *CompressionChain) AppendDecompress(dst, src []byte) ([]byte, error) {
+	return cc.appendDecompress(context.Background(), dst, src)
+}
+
+// Reset resets every stage that supports it and drops the intermediate
+// buffers, which are sized by the largest input seen and so are not pooled.
+func (cc *CompressionChain) Reset() {
 	for _, c := range cc.compressors {
-		result, err = c.Compress(result)
+		if r, ok := c.(Resetter); ok {
+			r.Reset()
+		}
+	}
+	cc.buffers = [2][]byte{}
+}
+
+func (cc *CompressionChain) appendCompress(ctx context.Context, dst, data []byte) ([]byte, error) {
+	return cc.compress(ctx, appendCompress, dst, data, true)
+}
+
+func (cc *CompressionChain) appendDecompress(ctx context.Context, dst, data []byte) ([]byte, error) {
+	return cc.decompress(ctx, appendDecompress, dst, data, true)
+}
+
+// stageFunc runs one stage, appending its output to dst.
+type stageFunc func(ctx context.Context, c Compressor, dst, src []byte) ([]byte, error)
+
+// compress runs the stages in turn with run. With keep, intermediate
+// results go to the chain's buffers, which are reused on the next call.
+func (cc *CompressionChain) compress(ctx context.Context, run stageFunc, dst, data []byte, keep bool) ([]byte, error) {
+	n := len(cc.compressors)
+	result := data
+	for i, c := range cc.compressors {
+		var err error
+		result, err = cc.appendStage(stageContext(ctx, i, n), run, c, i, dst, result, keep)
 		if err != nil {
 			return nil, err
 		}
 	}
-
+	if n == 0 {
+		return append(dst, data...), nil
+	}
 	return result, nil
 }
 
-func (cc *CompressionChain) Decompress(data []byte) ([]byte, error) {
+// decompress reverses compress.
+func (cc *CompressionChain) decompress(ctx context.Context, run stageFunc, dst, data []byte, keep bool) ([]byte, error) {
+	n := len(cc.compressors)
 	result := data
-	var err error
 
 	// Decompress in reverse order
-	for i := len(cc.compressors) - 1; i >= 0; i-- {
-		result, err = cc.compressors[i].Decompress(result)
+	for i := n - 1; i >= 0; i-- {
+		var err error
+		result, err = cc.appendStage(stageContext(ctx, i, n), run, cc.compressors[i], n-1-i, dst, result, keep)
 		if err != nil {
 			return nil, err
 		}
 	}
-
+	if n == 0 {
+		return append(dst, data...), nil
+	}
 	return result, nil
 }
+
+// appendStage runs the step'th stage to execute. The last one appends to
+// dst. With keep, the others alternate between the chain's two buffers so
+// that no stage writes to its own input; without, each gets a new one.
+func (cc *CompressionChain) appendStage(ctx context.Context, run stageFunc, c Compressor, step int, dst, src []byte, keep bool) ([]byte, error) {
+	if step == len(cc.compressors)-1 {
+		return run(ctx, c, dst, src)
+	}
+	if !keep {
+		return run(ctx, c, nil, src)
+	}
+	out, err := run(ctx, c, cc.buffers[step%2][:0], src)
+	if err != nil {
+		return nil, err
+	}
+	cc.buffers[step%2] = out
+	return out, nil
+}
+
+// stageContext labels the progress reports under ctx with stage i of n.
+func stageContext(ctx context.Context, i, n int) context.Context {
+	fn := progressFrom(ctx)
+	if fn == nil {
+		return ctx
+	}
+	return WithProgress(ctx, func(p Progress) {
+		p.Stage, p.Stages = i, n
+		fn(p)
+	})
+}
@@ -0,0 +1,576 @@
+// compress/cm.go
+package compress
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"slices"
+	"sync"
+)
+
+func init() {
+	Register("cm", 8, func(p Params) (Compressor, error) {
+		if err := p.Allow("mem"); err != nil {
+			return nil, err
+		}
+		mem, err := p.Size("mem", defaultCMMem)
+		if err != nil {
+			return nil, err
+		}
+		if mem < minCMMem || mem > maxCMMem {
+			return nil, fmt.Errorf("mem must be between %d and %d", minCMMem, maxCMMem)
+		}
+		return NewCMCompressor(mem), nil
+	})
+}
+
+// MaxChain is the chain of the "max" level: the best ratio the package
+// offers, at a few hundred KB/s.
+const MaxChain = "cm"
+
+const (
+	defaultCMMem = 64 << 20
+	minCMMem     = 1 << 20
+	maxCMMem     = 1 << 30
+)
+
+// Probabilities are 12-bit chances that the next bit is 1; stretch maps
+// them to the logistic domain, ln(p/(1-p)) in units of 1/256, and squash
+// maps back. Both are integer so that every platform codes alike.
+var (
+	squashPoints = [33]int32{
+		1, 2, 3, 6, 10, 16, 27, 45, 73, 120, 194, 310, 488, 747, 1101, 1546, 2047,
+		2549, 2994, 3348, 3607, 3785, 3901, 3975, 4022, 4050, 4068, 4079, 4085, 4089, 4092, 4093, 4094,
+	}
+	stretchTable [4096]int16
+)
+
+func squash(d int32) int32 {
+	if d > 2047 {
+		return 4095
+	}
+	if d < -2047 {
+		return 1
+	}
+	w := d & 127
+	i := d>>7 + 16
+	return (squashPoints[i]*(128-w) + squashPoints[i+1]*w + 64) >> 7
+}
+
+func stretch(p int32) int32 { return int32(stretchTable[p]) }
+
+func init() {
+	pi := int32(0)
+	for x := int32(-2047); x <= 2047; x++ {
+		for v := squash(x); pi <= v; pi++ {
+			stretchTable[pi] = int16(x)
+		}
+	}
+	for ; pi < 4096; pi++ {
+		stretchTable[pi] = 2047
+	}
+}
+
+// cmSlot holds an adaptive probability in its top 22 bits and the number
+// of times it was updated in the low 10. The rate of adaptation falls with
+// the count, so a new context learns fast and an old one is stable.
+type cmSlot uint32
+
+const (
+	cmSlotInit  = cmSlot(1 << 31)
+	cmSlotLimit = 255
+)
+
+var cmRates [cmSlotLimit + 1]int64
+
+func init() {
+	for n := range cmRates {
+		cmRates[n] = int64(65536*2) / int64(2*n+3)
+	}
+}
+
+func (s cmSlot) p() int32 { return int32(s >> 20) }
+
+func (s *cmSlot) update(bit uint32) {
+	p, n := int64(*s>>10), *s&1023
+	p += (int64(bit)<<22 - p) * cmRates[n] >> 16
+	if n < cmSlotLimit {
+		n++
+	}
+	*s = cmSlot(p)<<10 | n
+}
+
+// The models predict each bit from a hash of their context of previous
+// bytes and the bits of the current byte so far.
+const (
+	cmOrder0 = iota
+	cmOrder1
+	cmOrder2
+	cmOrder3
+	cmOrder4
+	cmOrder6
+	cmWord     // the current word, letters folded to lower case
+	cmWordPair // the current word and the one before
+	cmColumn   // the column in the line and the byte above it
+	cmModels
+)
+
+const (
+	cmInputs     = cmModels + 2 // and the match model and a bias
+	cmMatchMin   = 6            // bytes hashed to find a match
+	cmMatchLimit = 65535
+	cmLearnRate  = 6
+	cmAPMRate    = 7
+)
+
+// cmModel is the state shared in structure by the encoder and decoder.
+// Its tables are sized from the memory limit and the length of the data,
+// so both allocate the same.
+type cmModel struct {
+	tables   [cmModels][]cmSlot
+	tableBit uint
+	hashes   [cmModels]uint32
+	slots    [cmModels]*cmSlot
+
+	// The history, a ring that the match model searches.
+	buf     []byte
+	pos     int
+	matches []uint32 // position after the last occurrence of each hash
+	match   int      // position of the predicted byte, if length > 0
+	length  int
+	matchSM [64]cmSlot // by length bucket and predicted bit
+	matchSl *cmSlot
+
+	weights [4 * 256][cmInputs]int32 // by length bucket and partial byte
+	inputs  [cmInputs]int32
+	wset    *[cmInputs]int32
+	mixed   int32
+
+	apm    [256 * 33]uint16 // refines the mixer output by partial byte
+	apmIdx int
+
+	c0          uint32 // the bits of the current byte after a leading 1
+	c4, c8      uint32 // the last 8 bytes
+	word, prevW uint32
+	column      int
+	lineStart   int // positions where the current and previous lines start
+	prevLine    int
+	above       byte
+}
+
+// cmSizes gives the sizes of the history, the match index and each model
+// table (as a power of two) for n bytes under the memory limit mem. The
+// history gets a quarter of the memory, the match index an eighth and the
+// models the rest; none needs more than the data can fill.
+func cmSizes(mem, n int) (bufSize, matchSize int, tableBit uint) {
+	bufSize = 1 << min(bits.Len(uint(mem/4))-1, bits.Len(uint(n)))
+	matchSize = 1 << min(bits.Len(uint(mem/8/4))-1, bits.Len(uint(n)))
+	tableBit = uint(min(bits.Len(uint(mem/2/4/cmModels))-1, bits.Len(uint(n))+3))
+	return bufSize, matchSize, max(tableBit, 12)
+}
+
+// cmMemory is the memory cmModel.init allocates for n bytes under mem.
+func cmMemory(mem, n int) int {
+	bufSize, matchSize, tableBit := cmSizes(mem, n)
+	return bufSize + matchSize*4 + cmModels*(1<<tableBit)*4
+}
+
+// init prepares m for n bytes under the memory limit mem.
+func (m *cmModel) init(mem, n int) {
+	bufSize, matchSize, tableBit := cmSizes(mem, n)
+	m.tableBit = tableBit
+
+	for i := range m.tables {
+		m.tables[i] = resize(m.tables[i], 1<<m.tableBit)
+		for j := range m.tables[i] {
+			m.tables[i][j] = cmSlotInit
+		}
+	}
+	m.buf = resize(m.buf, bufSize)
+	clear(m.buf)
+	m.matches = resize(m.matches, matchSize)
+	clear(m.matches)
+	m.pos, m.match, m.length = 0, 0, 0
+	for i := range m.matchSM {
+		m.matchSM[i] = cmSlotInit
+	}
+	for i := range m.weights {
+		for j := range m.weights[i] {
+			m.weights[i][j] = 1 << 14
+		}
+	}
+	for i := range m.apm {
+		m.apm[i] = uint16(squash(int32(i%33-16)*128) * 16)
+	}
+	m.c0, m.c4, m.c8 = 1, 0, 0
+	m.word, m.prevW, m.column, m.lineStart, m.prevLine, m.above = 0, 0, 0, 0, 0, 0
+	m.hashes = [cmModels]uint32{}
+	m.contexts()
+}
+
+// resize returns s with length n, reusing its array when large enough.
+func resize[T any](s []T, n int) []T {
+	if cap(s) < n {
+		return make([]T, n)
+	}
+	return s[:n]
+}
+
+func cmHash(a, b uint32) uint32 {
+	h := a*0x9E3779B1 ^ (b+0x7F4A7C15)*0x85EBCA77
+	return h ^ h>>15
+}
+
+// contexts computes the model contexts for the next byte.
+func (m *cmModel) contexts() {
+	c4 := m.c4
+	m.hashes[cmOrder0] = 0
+	m.hashes[cmOrder1] = cmHash(1, c4&0xFF)
+	m.hashes[cmOrder2] = cmHash(2, c4&0xFFFF)
+	m.hashes[cmOrder3] = cmHash(3, c4&0xFFFFFF)
+	m.hashes[cmOrder4] = cmHash(4, c4)
+	m.hashes[cmOrder6] = cmHash(cmHash(6, c4), m.c8&0xFFFF)
+	m.hashes[cmWord] = cmHash(cmHash(7, m.word), c4&0xFF)
+	m.hashes[cmWordPair] = cmHash(cmHash(8, m.word), m.prevW)
+	m.hashes[cmColumn] = cmHash(9, uint32(min(m.column, 255))<<8|uint32(m.above))
+}
+
+// predict returns the chance that the next bit is 1.
+func (m *cmModel) predict() int32 {
+	shift := 32 - m.tableBit
+	c0 := m.c0 * 0x2F0B4C37
+	for i := range m.tables {
+		h := (m.hashes[i] ^ c0) * 0x6F4F2A45
+		m.slots[i] = &m.tables[i][h>>shift]
+		m.inputs[i] = stretch(m.slots[i].p())
+	}
+
+	// The match model bets on the byte after the last occurrence of the
+	// previous bytes, as long as the bits so far agree with it.
+	bucket := 0
+	m.inputs[cmModels] = 0
+	m.matchSl = nil
+	if m.length > 0 {
+		expected := uint32(m.buf[m.match]) | 0x100
+		n := bits.Len32(m.c0) - 1
+		if expected>>(8-n) == m.c0 {
+			bit := expected >> (7 - n) & 1
+			l := min(m.length, 31)
+			m.matchSl = &m.matchSM[l*2+int(bit)]
+			m.inputs[cmModels] = stretch(m.matchSl.p())
+			bucket = 1 + min(m.length/16, 2)
+		}
+	}
+	m.inputs[cmModels+1] = 256
+
+	m.wset = &m.weights[bucket*256+int(m.c0)]
+	var dot int64
+	for i, x := range m.inputs {
+		dot += int64(x) * int64(m.wset[i])
+	}
+	m.mixed = squash(int32(max(min(dot>>16, 2047), -2047)))
+
+	// An adaptive map from the mixer's output and the partial byte,
+	// interpolated between 33 points, corrects what the mixer
+	// systematically gets wrong.
+	s := stretch(m.mixed) + 2048
+	lo := s >> 7
+	w := s & 127
+	base := int(m.c0) * 33
+	p := (int32(m.apm[base+int(lo)])*(128-w) + int32(m.apm[base+int(lo)+1])*w) >> 11
+	m.apmIdx = base + int(lo) + int(w>>6)
+	p = (m.mixed + 3*p) / 4
+	return max(min(p, 4095), 1)
+}
+
+// update learns from bit and moves to the next bit.
+func (m *cmModel) update(bit uint32) {
+	for _, s := range m.slots {
+		s.update(bit)
+	}
+	if m.matchSl != nil {
+		m.matchSl.update(bit)
+	}
+	err := (int32(bit)<<12 - m.mixed) * cmLearnRate
+	for i, x := range m.inputs {
+		m.wset[i] += (x*err + 1<<13) >> 14
+	}
+	a := &m.apm[m.apmIdx]
+	*a = uint16(int32(*a) + (int32(bit)*0xFFFF-int32(*a))>>cmAPMRate)
+
+	m.c0 = m.c0<<1 | bit
+	if m.c0 >= 0x100 {
+		m.byteDone(byte(m.c0))
+		m.c0 = 1
+	}
+}
+
+// byteDone records the whole byte b in the history and contexts.
+func (m *cmModel) byteDone(b byte) {
+	mask := len(m.buf) - 1
+	m.buf[m.pos&mask] = b
+	m.pos++
+	m.c8 = m.c8<<8 | m.c4>>24
+	m.c4 = m.c4<<8 | uint32(b)
+
+	switch {
+	case b >= 'a' && b <= 'z', b >= 'A' && b <= 'Z':
+		m.word = (m.word + uint32(b|0x20)) * 0x3D4D51CB
+	case m.word != 0:
+		m.prevW, m.word = m.word, 0
+	}
+	if b == '\n' {
+		m.column, m.prevLine, m.lineStart = 0, m.lineStart, m.pos
+	} else {
+		m.column++
+	}
+	// The byte at this column of the previous line, if it reaches so far
+	// and is still in the history.
+	m.above = 0
+	if m.prevLine+m.column < m.lineStart-1 && m.pos-m.prevLine < len(m.buf) {
+		m.above = m.buf[(m.prevLine+m.column)&mask]
+	}
+
+	if m.length > 0 && m.buf[m.match] == b {
+		m.length = min(m.length+1, cmMatchLimit)
+		m.match = (m.match + 1) & mask
+	} else {
+		m.length = 0
+	}
+	if m.pos >= cmMatchMin {
+		h := cmHash(m.c4, m.c8&0xFFFF) >> (32 - bits.Len(uint(len(m.matches)-1)))
+		if m.length == 0 {
+			if p := int(m.matches[h]); p > 0 && m.pos-p < len(m.buf) {
+				n := 0
+				for n < 32 && n < p && m.buf[(p-1-n)&mask] == m.buf[(m.pos-1-n)&mask] {
+					n++
+				}
+				if n >= cmMatchMin {
+					m.length, m.match = n, p&mask
+				}
+			}
+		}
+		m.matches[h] = uint32(m.pos)
+	}
+	m.contexts()
+}
+
+// cmEncoder is a binary arithmetic coder: the interval [x1, x2] is split
+// in proportion to the chance of a 1, and bytes are emitted as soon as
+// both ends agree on them.
+type cmEncoder struct {
+	out    []byte
+	x1, x2 uint32
+}
+
+func (e *cmEncoder) encode(bit uint32, p int32) {
+	mid := e.x1 + uint32(uint64(e.x2-e.x1)*uint64(p)>>12)
+	if bit != 0 {
+		e.x2 = mid
+	} else {
+		e.x1 = mid + 1
+	}
+	for (e.x1^e.x2)&0xFF000000 == 0 {
+		e.out = append(e.out, byte(e.x2>>24))
+		e.x1 <<= 8
+		e.x2 = e.x2<<8 | 0xFF
+	}
+}
+
+// flush writes all of x1, so the decoder needs no bytes past the end.
+func (e *cmEncoder) flush() []byte {
+	return binary.BigEndian.AppendUint32(e.out, e.x1)
+}
+
+// cmDecoder reverses cmEncoder. Reading past the end of data yields zeros
+// and moves pos beyond len(data), as for rangeDecoder.
+type cmDecoder struct {
+	data      []byte
+	pos       int
+	x1, x2, x uint32
+}
+
+func (d *cmDecoder) init(data []byte) {
+	*d = cmDecoder{data: data, x2: 0xFFFFFFFF}
+	for i := 0; i < 4; i++ {
+		d.shift()
+	}
+}
+
+func (d *cmDecoder) shift() {
+	d.x <<= 8
+	if d.pos < len(d.data) {
+		d.x |= uint32(d.data[d.pos])
+	}
+	d.pos++
+}
+
+func (d *cmDecoder) decode(p int32) uint32 {
+	mid := d.x1 + uint32(uint64(d.x2-d.x1)*uint64(p)>>12)
+	var bit uint32
+	if d.x <= mid {
+		bit = 1
+		d.x2 = mid
+	} else {
+		d.x1 = mid + 1
+	}
+	for (d.x1^d.x2)&0xFF000000 == 0 {
+		d.x1 <<= 8
+		d.x2 = d.x2<<8 | 0xFF
+		d.shift()
+	}
+	return bit
+}
+
+var cmPool = sync.Pool{New: func() any { return new(cmModel) }}
+
+// CMCompressor mixes the predictions of several context models, orders 0
+// to 6, words, columns of lines and long matches, with a small neural
+// network that learns which to trust, and codes each bit with the mixed
+// probability. It is the slowest stage and compresses text best. Memory
+// use is bounded by the limit recorded in the output, and by the length of
+// the data.
+type CMCompressor struct {
+	limiter
+	mem   int
+	model *cmModel
+}
+
+func NewCMCompressor(memLimit int) *CMCompressor {
+	return &CMCompressor{limiter: limiter{DefaultLimits}, mem: memLimit}
+}
+
+// Reset returns the model tables to the pool and restores DefaultLimits.
+func (cm *CMCompressor) Reset() {
+	if cm.model != nil {
+		cmPool.Put(cm.model)
+		cm.model = nil
+	}
+	cm.limiter.Reset()
+}
+
+func (cm *CMCompressor) scratchSpace() *cmModel {
+	if cm.model == nil {
+		cm.model = cmPool.Get().(*cmModel)
+	}
+	return cm.model
+}
+
+func (cm *CMCompressor) clearScratch() {
+	cm.model = nil
+}
+
+func (cm *CMCompressor) Compress(data []byte) ([]byte, error) {
+	return compressOnce(context.Background(), cm, data)
+}
+
+func (cm *CMCompressor) Decompress(compressed []byte) ([]byte, error) {
+	return decompressOnce(context.Background(), cm, compressed)
+}
+
+func (cm *CMCompressor) CompressContext(ctx context.Context, data []byte) ([]byte, error) {
+	return compressOnce(ctx, cm, data)
+}
+
+func (cm *CMCompressor) DecompressContext(ctx context.Context, compressed []byte) ([]byte, error) {
+	return decompressOnce(ctx, cm, compressed)
+}
+
+func (cm *CMCompressor) AppendCompress(dst, src []byte) ([]byte, error) {
+	return cm.appendCompress(context.Background(), dst, src)
+}
+
+func (cm *CMCompressor) AppendDecompress(dst, src []byte) ([]byte, error) {
+	return cm.appendDecompress(context.Background(), dst, src)
+}
+
+// The output is the memory limit and the length as uvarints, then the
+// coded bits.
+func (cm *CMCompressor) appendCompress(ctx context.Context, dst, data []byte) ([]byte, error) {
+	t := newTracker(ctx, "cm", len(data))
+	if len(data) == 0 {
+		return dst, nil
+	}
+
+	result := binary.AppendUvarint(dst, uint64(cm.mem))
+	result = binary.AppendUvarint(result, uint64(len(data)))
+
+	m := cm.scratchSpace()
+	m.init(cm.mem, len(data))
+	e := cmEncoder{out: result, x2: 0xFFFFFFFF}
+	for i, b := range data {
+		if err := t.update(i); err != nil {
+			return nil, err
+		}
+		for j := 7; j >= 0; j-- {
+			bit := uint32(b) >> j & 1
+			e.encode(bit, m.predict())
+			m.update(bit)
+		}
+	}
+	result = e.flush()
+
+	t.finish()
+	return result, nil
+}
+
+func (cm *CMCompressor) appendDecompress(ctx context.Context, dst, compressed []byte) ([]byte, error) {
+	t := newTracker(ctx, "cm", len(compressed))
+	if len(compressed) == 0 {
+		return dst, nil
+	}
+
+	mem, n := binary.Uvarint(compressed)
+	if n <= 0 {
+		return nil, truncated("cm", len(compressed))
+	}
+	pos := n
+	size, n := binary.Uvarint(compressed[pos:])
+	if n <= 0 {
+		return nil, truncated("cm", len(compressed))
+	}
+	if mem < minCMMem || mem > maxCMMem {
+		return nil, corrupt("cm", 0)
+	}
+	if !cm.limits.allow(len(compressed), size) || size > maxDecodedSize {
+		return nil, tooLarge("cm", pos)
+	}
+	if !cm.limits.allowMemory(cmMemory(int(mem), int(size))) {
+		return nil, tooLarge("cm", 0)
+	}
+	pos += n
+
+	var d cmDecoder
+	d.init(compressed[pos:])
+	m := cm.scratchSpace()
+	m.init(int(mem), int(size))
+	// The size comes from the input, so only part of it is allocated up
+	// front.
+	result := slices.Grow(dst, min(int(size), maxPrealloc))
+	for i := 0; i < int(size); i++ {
+		if err := t.update(pos + d.pos); err != nil {
+			return nil, err
+		}
+		if d.pos > len(d.data) {
+			return nil, truncated("cm", len(compressed))
+		}
+		c := uint32(1)
+		for c < 0x100 {
+			bit := d.decode(m.predict())
+			m.update(bit)
+			c = c<<1 | bit
+		}
+		result = append(result, byte(c))
+	}
+	switch {
+	case d.pos > len(d.data):
+		return nil, truncated("cm", len(compressed))
+	case d.pos < len(d.data):
+		return nil, corrupt("cm", pos+d.pos)
+	}
+
+	t.finish()
+	return result, nil
+}
@@ -0,0 +1,65 @@
+// compress/cm_test.go
+package compress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestCMRoundTrip(t *testing.T) {
+	random := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	logs := logCorpus(128 * 1024)
+
+	// cm is slow, so the inputs are smaller than for the other stages.
+	roundTrip(t, []string{"cm", "cm:mem=1m", "bwt,cm"},
+		map[string][]byte{"random": random, "logs": logs, "a": []byte("a")})
+}
+
+// cm is meant to beat every other stage on text, and to code the same
+// way every time.
+func TestCMRatio(t *testing.T) {
+	logs := logCorpus(128 * 1024)
+	c := NewCMCompressor(defaultCMMem)
+	cm, _ := c.Compress(logs)
+	again, _ := c.Compress(logs)
+	if !bytes.Equal(cm, again) {
+		t.Error("output differs between runs")
+	}
+	ppm, _ := NewPPMCompressor(DefaultPPMOptions).Compress(logs)
+	if len(cm)*10 > len(ppm)*9 {
+		t.Errorf("cm output %d bytes, ppm %d", len(cm), len(ppm))
+	}
+}
+
+func TestCMErrors(t *testing.T) {
+	compressed, _ := NewCMCompressor(minCMMem).Compress(logCorpus(1000))
+	c := NewCMCompressor(defaultCMMem)
+	if _, err := c.Decompress(compressed[:len(compressed)-2]); !errors.Is(err, ErrTruncated) {
+		t.Errorf("truncated: %v", err)
+	}
+	if _, err := c.Decompress(append(compressed, 0)); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("trailing: %v", err)
+	}
+
+	// A few bytes may claim the largest model; MaxMemory refuses it before
+	// it is allocated, and still allows what the data needs.
+	hostile := binary.AppendUvarint(binary.AppendUvarint(nil, maxCMMem), 1<<40)
+	hostile = append(hostile, make([]byte, 20)...)
+	c.SetLimits(Limits{MaxMemory: 1 << 20})
+	if _, err := c.Decompress(hostile); !errors.Is(err, ErrOutputLimit) {
+		t.Errorf("MaxMemory: got %v, want ErrOutputLimit", err)
+	}
+	if _, err := c.Decompress(compressed); err != nil {
+		t.Errorf("within MaxMemory: %v", err)
+	}
+
+	for _, spec := range []string{"cm:mem=1k", "cm:mem=2g", "cm:order=3"} {
+		if _, err := ParseChain(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+// compress/container.go
+package compress
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"math"
+	"sort"
+	"time"
+)
+
+// Files written by the CLI start with a small header that records how the
+// payload was produced, so it can be decompressed without repeating -algo:
+//
+//	"FCMP" | version | fields... | 0 | payload
+//
+// Each field is a tag byte, a uvarint length and the value. Readers skip
+// tags they do not know.
+var containerMagic = []byte("FCMP")
+
+const containerVersion = 1
+
+const (
+	tagEnd       = 0
+	tagChain     = 1
+	tagEncrypted = 2
+	tagName      = 3
+	tagMode      = 4
+	tagModTime   = 5
+	tagOwner     = 6
+	tagXattr     = 7
+	tagChecksum  = 8
+)
+
+// Values of the tagEncrypted field. Files written before PackSealed have
+// encryptedPayload: only their payload is authenticated.
+const (
+	encryptedPayload = 1
+	encryptedSealed  = 2
+)
+
+// Header describes a container payload.
+type Header struct {
+	// Chain is the stage list as accepted by ParseChain.
+	Chain string
+	// Encrypted is set when an EncryptionCompressor ran after the chain.
+	Encrypted bool
+	// sealed is set for payloads written by PackSealed, which authenticate
+	// the header.
+	sealed bool
+
+	// Metadata of the original file. Zero values are not recorded. The
+	// header itself is never encrypted, but PackSealed authenticates it.
+	Name     string
+	Mode     fs.FileMode
+	ModTime  time.Time
+	HasOwner bool
+	UID      int
+	GID      int
+	Xattrs   map[string][]byte
+
+	// Checksum is the CRC-32 (IEEE) of the original data, recorded when
+	// HasChecksum is set.
+	Checksum    uint32
+	HasChecksum bool
+}
+
+// SetChecksum records the checksum of the original data.
+func (h *Header) SetChecksum(data []byte) {
+	h.Checksum, h.HasChecksum = crc32.ChecksumIEEE(data), true
+}
+
+// Verify checks decoded data against the recorded checksum, if any.
+func (h Header) Verify(data []byte) error {
+	if h.HasChecksum && crc32.ChecksumIEEE(data) != h.Checksum {
+		return &DataError{Stage: "container", Offset: -1, Err: ErrChecksum}
+	}
+	return nil
+}
+
+// IsContainer reports whether data starts with a container header.
+func IsContainer(data []byte) bool {
+	return bytes.HasPrefix(data, containerMagic)
+}
+
+// Pack prepends the encoded header to payload.
+func Pack(h Header, payload []byte) []byte {
+	out := make([]byte, 0, len(containerMagic)+len(h.Chain)+16+len(payload))
+	out = append(out, containerMagic...)
+	out = append(out, containerVersion)
+
+	out = appendField(out, tagChain, []byte(h.Chain))
+	switch {
+	case h.sealed:
+		out = appendField(out, tagEncrypted, []byte{encryptedSealed})
+	case h.Encrypted:
+		out = appendField(out, tagEncrypted, []byte{encryptedPayload})
+	}
+	if h.Name != "" {
+		out = appendField(out, tagName, []byte(h.Name))
+	}
+	if h.Mode != 0 {
+		out = appendField(out, tagMode, binary.AppendUvarint(nil, uint64(h.Mode)))
+	}
+	if !h.ModTime.IsZero() {
+		out = appendField(out, tagModTime, binary.AppendVarint(nil, h.ModTime.UnixNano()))
+	}
+	if h.HasOwner {
+		owner := binary.AppendUvarint(nil, uint64(h.UID))
+		owner = binary.AppendUvarint(owner, uint64(h.GID))
+		out = appendField(out, tagOwner, owner)
+	}
+	names := make([]string, 0, len(h.Xattrs))
+	for name := range h.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// name NUL value
+		attr := append([]byte(name), 0)
+		out = appendField(out, tagXattr, append(attr, h.Xattrs[name]...))
+	}
+	if h.HasChecksum {
+		out = appendField(out, tagChecksum, binary.BigEndian.AppendUint32(nil, h.Checksum))
+	}
+	out = append(out, tagEnd)
+
+	return append(out, payload...)
+}
+
+func appendField(dst []byte, tag byte, value []byte) []byte {
+	dst = append(dst, tag)
+	dst = binary.AppendUvarint(dst, uint64(len(value)))
+	return append(dst, value...)
+}
+
+// Unpack parses the header at the start of data and returns it along with
+// the payload that follows.
+func Unpack(data []byte) (Header, []byte, error) {
+	var h Header
+	if !IsContainer(data) {
+		return h, nil, corrupt("container", 0)
+	}
+	pos := len(containerMagic)
+	if pos >= len(data) {
+		return h, nil, truncated("container", pos)
+	}
+	if data[pos] != containerVersion {
+		return h, nil, fmt.Errorf("unsupported container version %d: %w", data[pos], ErrCorrupt)
+	}
+	pos++
+
+	for {
+		if pos >= len(data) {
+			return h, nil, truncated("container", pos)
+		}
+		tag := data[pos]
+		pos++
+		if tag == tagEnd {
+			break
+		}
+
+		fieldStart := pos - 1
+		length, n := binary.Uvarint(data[pos:])
+		if n <= 0 || length > uint64(len(data)-pos-n) {
+			return h, nil, truncated("container", pos)
+		}
+		pos += n
+		value := data[pos : pos+int(length)]
+		pos += int(length)
+
+		switch tag {
+		case tagChain:
+			h.Chain = string(value)
+		case tagEncrypted:
+			h.Encrypted = len(value) == 1 && (value[0] == encryptedPayload || value[0] == encryptedSealed)
+			h.sealed = h.Encrypted && value[0] == encryptedSealed
+		case tagName:
+			h.Name = string(value)
+		case tagMode:
+			mode, n := binary.Uvarint(value)
+			if n <= 0 || mode > math.MaxUint32 {
+				return h, nil, corrupt("container", fieldStart)
+			}
+			h.Mode = fs.FileMode(mode)
+		case tagModTime:
+			nanos, n := binary.Varint(value)
+			if n <= 0 {
+				return h, nil, corrupt("container", fieldStart)
+			}
+			h.ModTime = time.Unix(0, nanos)
+		case tagOwner:
+			uid, n := binary.Uvarint(value)
+			gid, m := uint64(0), 0
+			if n > 0 {
+				gid, m = binary.Uvarint(value[n:])
+			}
+			if n <= 0 || m <= 0 || uid > math.MaxInt32 || gid > math.MaxInt32 {
+				return h, nil, corrupt("container", fieldStart)
+			}
+			h.HasOwner, h.UID, h.GID = true, int(uid), int(gid)
+		case tagXattr:
+			name, attr, ok := bytes.Cut(value, []byte{0})
+			if !ok || len(name) == 0 {
+				return h, nil, corrupt("container", fieldStart)
+			}
+			if h.Xattrs == nil {
+				h.Xattrs = make(map[string][]byte)
+			}
+			h.Xattrs[string(name)] = bytes.Clone(attr)
+		case tagChecksum:
+			if len(value) != 4 {
+				return h, nil, corrupt("container", fieldStart)
+			}
+			h.Checksum, h.HasChecksum = binary.BigEndian.Uint32(value), true
+		}
+	}
+
+	return h, data[pos:], nil
+}
+
+// PackSealed encrypts payload with enc and packs it under h, like Pack
+// with h.Encrypted set. The encoded header is authenticated along with the
+// payload, so that changing any of its fields makes OpenSealed fail with
+// ErrDecrypt.
+func PackSealed(h Header, payload []byte, enc *EncryptionCompressor) ([]byte, error) {
+	h.Encrypted, h.sealed = true, true
+	header := Pack(h, nil)
+	sealed, err := enc.Seal(payload, header)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, sealed...), nil
+}
+
+// OpenSealed unpacks an encrypted container and decrypts its payload with
+// enc. The header of a file written before PackSealed is not authenticated,
+// so only the fields needed to decode the payload are returned for it: the
+// chain and the checksum, which the decoded data is checked against.
+func OpenSealed(data []byte, enc *EncryptionCompressor) (Header, []byte, error) {
+	h, payload, err := Unpack(data)
+	if err != nil {
+		return h, nil, err
+	}
+	if !h.Encrypted {
+		return h, nil, fmt.Errorf("container is not encrypted: %w", ErrCorrupt)
+	}
+	if !h.sealed {
+		plain, err := enc.Open(payload, nil)
+		if err != nil {
+			return Header{}, nil, err
+		}
+		return Header{Chain: h.Chain, Encrypted: true, Checksum: h.Checksum, HasChecksum: h.HasChecksum}, plain, nil
+	}
+	plain, err := enc.Open(payload, data[:len(data)-len(payload)])
+	if err != nil {
+		return Header{}, nil, err
+	}
+	return h, plain, nil
+}
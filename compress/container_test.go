@@ -0,0 +1,123 @@
+// compress/container_test.go
+package compress
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestContainerRoundTrip(t *testing.T) {
+	h := Header{
+		Chain:     "bwt:block=900k,rle,huffman",
+		Encrypted: true,
+		Name:      "report.csv",
+		Mode:      0640,
+		ModTime:   time.Unix(1700000000, 123456789),
+		HasOwner:  true,
+		UID:       1000,
+		GID:       100,
+		Xattrs:    map[string][]byte{"user.origin": []byte("export"), "user.empty": {}},
+	}
+	h.SetChecksum([]byte("payload"))
+	payload := []byte("payload")
+
+	packed := Pack(h, payload)
+	if !IsContainer(packed) {
+		t.Fatal("packed data not recognised as a container")
+	}
+	got, rest, err := Unpack(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, h) {
+		t.Errorf("header = %+v, want %+v", got, h)
+	}
+	if !bytes.Equal(rest, payload) {
+		t.Errorf("payload = %q, want %q", rest, payload)
+	}
+}
+
+func TestContainerTruncated(t *testing.T) {
+	packed := Pack(Header{Chain: "lzw"}, nil)
+	for i := 0; i < len(packed); i++ {
+		_, _, err := Unpack(packed[:i])
+		if err == nil {
+			t.Errorf("Unpack of %d bytes: expected an error", i)
+		} else if i >= len(containerMagic) && !errors.Is(err, ErrTruncated) {
+			t.Errorf("Unpack of %d bytes: got %v, want ErrTruncated", i, err)
+		}
+	}
+}
+
+func TestContainerChecksum(t *testing.T) {
+	var h Header
+	h.SetChecksum([]byte("original"))
+	if err := h.Verify([]byte("original")); err != nil {
+		t.Errorf("Verify of the original data: %v", err)
+	}
+	err := h.Verify([]byte("modified"))
+	var dataErr *DataError
+	if !errors.Is(err, ErrChecksum) || !errors.As(err, &dataErr) || dataErr.Stage != "container" {
+		t.Errorf("Verify of modified data: got %v, want a container ErrChecksum", err)
+	}
+	// Headers without a checksum accept anything.
+	if err := (Header{}).Verify([]byte("anything")); err != nil {
+		t.Errorf("Verify without checksum: %v", err)
+	}
+}
+
+func TestContainerSealed(t *testing.T) {
+	enc, err := NewKeyEncryptor(AESGCM, make([]byte, keySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Header{Chain: "rle", Name: "secret.txt", Mode: 0600, ModTime: time.Unix(1700000000, 0)}
+	h.SetChecksum([]byte("payload"))
+	packed, err := PackSealed(h, []byte("payload"), enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, plain, err := OpenSealed(packed, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != h.Name || got.Mode != h.Mode || !got.ModTime.Equal(h.ModTime) || !got.Encrypted || string(plain) != "payload" {
+		t.Errorf("OpenSealed = %+v, %q", got, plain)
+	}
+
+	// Changing the header, including marking it as not authenticated, fails
+	// like changing the payload.
+	_, payload, _ := Unpack(packed)
+	header := len(packed) - len(payload)
+	for _, edit := range []func([]byte) []byte{
+		func(b []byte) []byte { return bytes.Replace(b, []byte("secret.txt"), []byte("public.txt"), 1) },
+		func(b []byte) []byte {
+			i := bytes.Index(b[:header], []byte{tagEncrypted, 1, encryptedSealed})
+			b[i+2] = encryptedPayload
+			return b
+		},
+		func(b []byte) []byte { b[len(b)-1] ^= 1; return b },
+	} {
+		tampered := edit(bytes.Clone(packed))
+		if _, _, err := OpenSealed(tampered, enc); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("tampered container: got %v, want ErrDecrypt", err)
+		}
+	}
+
+	// Files from before PackSealed decrypt, without their metadata.
+	sealed, err := enc.Compress([]byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Encrypted = true
+	got, plain, err = OpenSealed(Pack(h, sealed), enc)
+	if err != nil || string(plain) != "payload" {
+		t.Fatalf("unauthenticated header: %q, %v", plain, err)
+	}
+	if got.Name != "" || got.Mode != 0 || !got.ModTime.IsZero() || got.Chain != "rle" || !got.HasChecksum {
+		t.Errorf("unauthenticated header restored as %+v", got)
+	}
+}
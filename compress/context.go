@@ -0,0 +1,125 @@
+// compress/context.go
+package compress
+
+import "context"
+
+// ContextCompressor is implemented by stages that can be cancelled and
+// report progress while they run. Use CompressContext and
+// DecompressContext to run any Compressor this way.
+type ContextCompressor interface {
+	Compressor
+	CompressContext(ctx context.Context, data []byte) ([]byte, error)
+	DecompressContext(ctx context.Context, data []byte) ([]byte, error)
+}
+
+// Progress reports how far a stage has got through its input.
+type Progress struct {
+	// Stage is the position of the stage in its chain, counting from 0 in
+	// the order the chain compresses.
+	Stage int
+	// Stages is the length of the chain, or 0 for a stage run on its own.
+	Stages int
+	// Name is the algorithm of the stage, e.g. "bwt".
+	Name string
+	// Done and Total are the bytes of input consumed and to consume.
+	Done, Total int64
+}
+
+// ProgressFunc receives progress reports. It is called from the goroutine
+// running the stage, so it should return quickly; to feed a channel, send
+// without blocking.
+type ProgressFunc func(Progress)
+
+type progressKey struct{}
+
+// WithProgress returns a context under which stages report their progress
+// to fn, at least at the start and end of each stage and every
+// progressInterval bytes in between.
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+func progressFrom(ctx context.Context) ProgressFunc {
+	fn, _ := ctx.Value(progressKey{}).(ProgressFunc)
+	return fn
+}
+
+// progressInterval is how many bytes of input a stage consumes between
+// checks of its context.
+const progressInterval = 64 << 10
+
+// tracker checks for cancellation and reports progress from inside a
+// stage's loop.
+type tracker struct {
+	ctx   context.Context
+	fn    ProgressFunc
+	name  string
+	total int64
+	next  int64
+}
+
+func newTracker(ctx context.Context, name string, total int) tracker {
+	t := tracker{ctx: ctx, fn: progressFrom(ctx), name: name, total: int64(total)}
+	t.report(0)
+	return t
+}
+
+// update records that done bytes of input have been consumed. It returns
+// the context's error once it is cancelled.
+func (t *tracker) update(done int) error {
+	if int64(done) < t.next {
+		return nil
+	}
+	return t.check(done)
+}
+
+// check is the slow path of update, kept apart so update is inlined.
+func (t *tracker) check(done int) error {
+	t.next = int64(done) + progressInterval
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	t.report(int64(done))
+	return nil
+}
+
+// finish reports the whole input as consumed.
+func (t *tracker) finish() {
+	t.report(t.total)
+}
+
+func (t *tracker) report(done int64) {
+	if t.fn != nil {
+		t.fn(Progress{Name: t.name, Done: done, Total: t.total})
+	}
+}
+
+// CompressContext runs c.Compress, stopping early if ctx is cancelled.
+// Stages that do not implement ContextCompressor are only checked before
+// they start.
+func CompressContext(ctx context.Context, c Compressor, data []byte) ([]byte, error) {
+	if cc, ok := c.(ContextCompressor); ok {
+		return cc.CompressContext(ctx, data)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	t := newTracker(ctx, "", len(data))
+	out, err := c.Compress(data)
+	t.finish()
+	return out, err
+}
+
+// DecompressContext runs c.Decompress, stopping early if ctx is cancelled.
+func DecompressContext(ctx context.Context, c Compressor, data []byte) ([]byte, error) {
+	if cc, ok := c.(ContextCompressor); ok {
+		return cc.DecompressContext(ctx, data)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	t := newTracker(ctx, "", len(data))
+	out, err := c.Decompress(data)
+	t.finish()
+	return out, err
+}
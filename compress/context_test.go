@@ -0,0 +1,83 @@
+// compress/context_test.go
+package compress
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCompressContext(t *testing.T) {
+	data := bytes.Repeat([]byte("context and progress "), 20000)
+	chain, err := ParseChain("bwt:block=64k,rle,huffman,store")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := chain.CompressContext(ctx, data); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled compress: got %v, want context.Canceled", err)
+	}
+
+	compressed, err := chain.Compress(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, spec := range []string{"lzw", "sf"} {
+		c, err := New(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := CompressContext(ctx, c, data); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: got %v, want context.Canceled", spec, err)
+		}
+	}
+	if _, err := chain.DecompressContext(ctx, compressed); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled decompress: got %v, want context.Canceled", err)
+	}
+
+	var reports []Progress
+	ctx = WithProgress(context.Background(), func(p Progress) {
+		reports = append(reports, p)
+	})
+	restored, err := chain.DecompressContext(ctx, compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored, data) {
+		t.Fatal("round trip with progress failed")
+	}
+
+	// Stages report in decompression order, each from 0 to its total.
+	last := map[int]Progress{}
+	order := []int{}
+	for _, p := range reports {
+		prev, seen := last[p.Stage]
+		if !seen {
+			order = append(order, p.Stage)
+			if p.Done != 0 {
+				t.Errorf("stage %d starts at %d", p.Stage, p.Done)
+			}
+		} else if p.Done < prev.Done {
+			t.Errorf("stage %d went back from %d to %d", p.Stage, prev.Done, p.Done)
+		}
+		last[p.Stage] = p
+	}
+	if got := fmt.Sprint(order); got != "[3 2 1 0]" {
+		t.Errorf("stages reported in order %s, want [3 2 1 0]", got)
+	}
+	for stage, p := range last {
+		if p.Done != p.Total {
+			t.Errorf("stage %d ended at %d of %d", stage, p.Done, p.Total)
+		}
+	}
+	if last[0].Name != "bwt" || last[2].Name != "huffman" {
+		t.Errorf("stage names %q and %q, want bwt and huffman", last[0].Name, last[2].Name)
+	}
+	if last[3].Total != int64(len(compressed)) {
+		t.Errorf("first stage to decompress has %d bytes to consume, want %d", last[3].Total, len(compressed))
+	}
+}
@@ -0,0 +1,187 @@
+// compress/delta.go
+package compress
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+func init() {
+	Register("delta", 9, func(p Params) (Compressor, error) {
+		if err := p.Allow("stride", "op"); err != nil {
+			return nil, err
+		}
+		stride, err := p.Int("stride", 1)
+		if err != nil {
+			return nil, err
+		}
+		if stride < 1 || stride > maxDeltaStride {
+			return nil, fmt.Errorf("stride must be between 1 and %d", maxDeltaStride)
+		}
+		op := DeltaSub
+		if name, ok := p["op"]; ok {
+			if op, err = ParseDeltaOp(name); err != nil {
+				return nil, err
+			}
+		}
+		return NewDeltaCompressor(stride, op), nil
+	})
+}
+
+// DeltaOp is how the delta stage relates a byte to the one a stride
+// before it.
+type DeltaOp byte
+
+const (
+	// DeltaSub stores the difference, for integers that change slowly.
+	DeltaSub DeltaOp = iota + 1
+	// DeltaXOR stores the bits that changed, for floating point values,
+	// whose sign, exponent and leading mantissa bits change rarely.
+	DeltaXOR
+)
+
+var deltaOpNames = []string{DeltaSub: "sub", DeltaXOR: "xor"}
+
+func (op DeltaOp) String() string {
+	if int(op) < len(deltaOpNames) && deltaOpNames[op] != "" {
+		return deltaOpNames[op]
+	}
+	return fmt.Sprintf("DeltaOp(%d)", byte(op))
+}
+
+// ParseDeltaOp parses "sub" or "xor".
+func ParseDeltaOp(name string) (DeltaOp, error) {
+	for op, n := range deltaOpNames {
+		if n != "" && n == name {
+			return DeltaOp(op), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown delta op %q (use sub or xor)", name)
+}
+
+const maxDeltaStride = 1 << 16
+
+// deltaEncode appends src[start:] with each byte replaced by its
+// difference from, or XOR with, the byte stride before it. The first
+// stride bytes of src are kept as they are.
+func deltaEncode(dst, src []byte, start, stride int, op DeltaOp) []byte {
+	for i := start; i < len(src); i++ {
+		b := src[i]
+		if i >= stride {
+			if op == DeltaXOR {
+				b ^= src[i-stride]
+			} else {
+				b -= src[i-stride]
+			}
+		}
+		dst = append(dst, b)
+	}
+	return dst
+}
+
+// deltaDecode reverses deltaEncode in place for buf[start:], after
+// buf[:start] has been decoded.
+func deltaDecode(buf []byte, start, stride int, op DeltaOp) {
+	for i := max(start, stride); i < len(buf); i++ {
+		if op == DeltaXOR {
+			buf[i] ^= buf[i-stride]
+		} else {
+			buf[i] += buf[i-stride]
+		}
+	}
+}
+
+// DeltaCompressor is a filter rather than a compressor: its output is as
+// long as its input, but for records of numbers that change gradually
+// (time series, columns of fixed-width fields) it is mostly small values
+// that rle, huffman or an LZ stage then compress well, e.g.
+// "delta:stride=4,rle,huffman" for 32-bit samples. The output starts with
+// the op and stride, so it decodes whatever the options of the decoding
+// stage.
+type DeltaCompressor struct {
+	limiter
+	stride int
+	op     DeltaOp
+}
+
+func NewDeltaCompressor(stride int, op DeltaOp) *DeltaCompressor {
+	return &DeltaCompressor{limiter: limiter{DefaultLimits}, stride: stride, op: op}
+}
+
+func (dc *DeltaCompressor) Compress(data []byte) ([]byte, error) {
+	return dc.appendCompress(context.Background(), nil, data)
+}
+
+func (dc *DeltaCompressor) Decompress(data []byte) ([]byte, error) {
+	return dc.appendDecompress(context.Background(), nil, data)
+}
+
+func (dc *DeltaCompressor) CompressContext(ctx context.Context, data []byte) ([]byte, error) {
+	return dc.appendCompress(ctx, nil, data)
+}
+
+func (dc *DeltaCompressor) DecompressContext(ctx context.Context, data []byte) ([]byte, error) {
+	return dc.appendDecompress(ctx, nil, data)
+}
+
+func (dc *DeltaCompressor) AppendCompress(dst, src []byte) ([]byte, error) {
+	return dc.appendCompress(context.Background(), dst, src)
+}
+
+func (dc *DeltaCompressor) AppendDecompress(dst, src []byte) ([]byte, error) {
+	return dc.appendDecompress(context.Background(), dst, src)
+}
+
+func (dc *DeltaCompressor) appendCompress(ctx context.Context, dst, data []byte) ([]byte, error) {
+	t := newTracker(ctx, "delta", len(data))
+	if len(data) == 0 {
+		return dst, nil
+	}
+
+	result := slices.Grow(dst, len(data)+4)
+	result = append(result, byte(dc.op))
+	result = binary.AppendUvarint(result, uint64(dc.stride))
+	for i := 0; i < len(data); i += progressInterval {
+		if err := t.update(i); err != nil {
+			return nil, err
+		}
+		result = deltaEncode(result, data[:min(i+progressInterval, len(data))], i, dc.stride, dc.op)
+	}
+
+	t.finish()
+	return result, nil
+}
+
+func (dc *DeltaCompressor) appendDecompress(ctx context.Context, dst, data []byte) ([]byte, error) {
+	t := newTracker(ctx, "delta", len(data))
+	if len(data) == 0 {
+		return dst, nil
+	}
+
+	op := DeltaOp(data[0])
+	stride, n := binary.Uvarint(data[1:])
+	if n <= 0 {
+		return nil, truncated("delta", len(data))
+	}
+	if op != DeltaSub && op != DeltaXOR || stride < 1 || stride > maxDeltaStride {
+		return nil, corrupt("delta", 0)
+	}
+	body := data[1+n:]
+	if !dc.limits.allow(len(data), uint64(len(body))) {
+		return nil, tooLarge("delta", 0)
+	}
+
+	result := append(dst, body...)
+	decoded := result[len(dst):]
+	for i := 0; i < len(decoded); i += progressInterval {
+		if err := t.update(1 + n + i); err != nil {
+			return nil, err
+		}
+		deltaDecode(decoded[:min(i+progressInterval, len(decoded))], i, int(stride), op)
+	}
+
+	t.finish()
+	return result, nil
+}
@@ -0,0 +1,60 @@
+// compress/delta_test.go
+package compress
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// sensorSeries is n readings of a slowly drifting sensor, as little-endian
+// int32 counts or float64 values.
+func sensorSeries(n int, float bool) []byte {
+	r := rand.New(rand.NewSource(4))
+	var out []byte
+	v := 20.0
+	for i := 0; i < n; i++ {
+		v += r.NormFloat64() * 0.01
+		if float {
+			out = binary.LittleEndian.AppendUint64(out, math.Float64bits(math.Round(v*100)/100))
+		} else {
+			out = binary.LittleEndian.AppendUint32(out, uint32(int32(v*1000)))
+		}
+	}
+	return out
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	random := make([]byte, 200*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	roundTrip(t, []string{"delta", "delta:stride=4", "delta:stride=8:op=xor", "delta:stride=65536", "delta:stride=4,rle,huffman"},
+		map[string][]byte{"random": random, "ints": sensorSeries(50000, false), "a": []byte("a")})
+}
+
+// The filters must save a fifth on the data they are meant for.
+func TestDeltaRatio(t *testing.T) {
+	for _, tc := range []struct {
+		data          []byte
+		with, without string
+	}{
+		{sensorSeries(50000, false), "delta:stride=4,huffman", "huffman"},
+		{sensorSeries(50000, true), "delta:stride=8:op=xor,huffman", "huffman"},
+	} {
+		with, _ := ParseChain(tc.with)
+		without, _ := ParseChain(tc.without)
+		a, _ := with.Compress(tc.data)
+		b, _ := without.Compress(tc.data)
+		if len(a)*5 > len(b)*4 {
+			t.Errorf("%s: %d bytes, %s: %d", tc.with, len(a), tc.without, len(b))
+		}
+	}
+}
+
+func TestDeltaParams(t *testing.T) {
+	for _, spec := range []string{"delta:stride=0", "delta:stride=65537", "delta:op=add", "delta:dist=4"} {
+		if _, err := ParseChain(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+// compress/dict.go
+package compress
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// SharedDict is what many small inputs of one kind have in common, such as
+// JSON messages with the same keys, learnt once from samples of them. Both
+// sides load it, so each input no longer has to teach a stage everything
+// from scratch:
+//
+//   - lzw:dict=<id> starts with codes for the strings of Content
+//   - lzma:preset=<id> starts with Content in its window
+//   - huffman:dict=<id> codes with the byte frequencies of Freqs instead
+//     of a table of its own
+//
+// The stages record the ID in their output and reject output made with
+// another dictionary. Create a SharedDict with TrainDict, NewSharedDict or
+// ParseDict, and make it known to chain specs with RegisterDict.
+type SharedDict struct {
+	// ID identifies the dictionary. It is derived from Content and Freqs,
+	// so two dictionaries with the same ID are the same.
+	ID uint32
+	// Content is the text inputs are expected to repeat, the most common
+	// parts last, where LZ matches are cheapest.
+	Content []byte
+	// Freqs counts each byte value in the samples. No count is zero, so
+	// every byte value has a code.
+	Freqs [256]uint32
+
+	lzwOnce     sync.Once
+	lzw         *lzwPreset
+	huffmanOnce sync.Once
+	huffman     *huffmanStatic
+	lzmaMu      sync.Mutex
+	lzma        map[lzmaPresetKey]*lzmaPreset
+}
+
+const (
+	// MinDictSize and MaxDictSize bound the Content of a dictionary.
+	MinDictSize = 256
+	MaxDictSize = 1 << 20
+	// DefaultDictSize is the Content size TrainDict is usually asked for.
+	DefaultDictSize = 16 << 10
+)
+
+// NewSharedDict returns the dictionary of content and freqs, raising counts
+// of zero to one.
+func NewSharedDict(content []byte, freqs [256]uint32) *SharedDict {
+	for i, f := range freqs {
+		freqs[i] = max(f, 1)
+	}
+	d := &SharedDict{Content: content, Freqs: freqs}
+	sum := sha256.Sum256(d.appendBody(nil))
+	d.ID = binary.BigEndian.Uint32(sum[:])
+	return d
+}
+
+// String returns the ID as chain specs write it, eight hex digits.
+func (d *SharedDict) String() string { return fmt.Sprintf("%08x", d.ID) }
+
+// ParseDictID parses an ID as String writes it.
+func ParseDictID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid dictionary id %q", s)
+	}
+	return uint32(id), nil
+}
+
+var dictMagic = []byte("FCDICT")
+
+const dictVersion = 1
+
+// Bytes serializes the dictionary for ParseDict:
+//
+//	"FCDICT" | version | uint32 ID | 256 uvarint counts | uvarint length | content
+func (d *SharedDict) Bytes() []byte {
+	out := make([]byte, 0, len(dictMagic)+5+2*256+binary.MaxVarintLen64+len(d.Content))
+	out = append(out, dictMagic...)
+	out = append(out, dictVersion)
+	out = binary.BigEndian.AppendUint32(out, d.ID)
+	return d.appendBody(out)
+}
+
+// appendBody appends what the ID is computed from: the counts and the
+// content.
+func (d *SharedDict) appendBody(dst []byte) []byte {
+	for _, f := range d.Freqs {
+		dst = binary.AppendUvarint(dst, uint64(f))
+	}
+	dst = binary.AppendUvarint(dst, uint64(len(d.Content)))
+	return append(dst, d.Content...)
+}
+
+// IsDict reports whether data starts like a serialized dictionary.
+func IsDict(data []byte) bool {
+	return bytes.HasPrefix(data, dictMagic)
+}
+
+// ParseDict reads a dictionary written by Bytes. A dictionary whose ID
+// does not match its contents fails with ErrChecksum.
+func ParseDict(data []byte) (*SharedDict, error) {
+	if !IsDict(data) {
+		return nil, corrupt("dict", 0)
+	}
+	pos := len(dictMagic)
+	if len(data) < pos+5 {
+		return nil, truncated("dict", len(data))
+	}
+	if data[pos] != dictVersion {
+		return nil, corrupt("dict", pos)
+	}
+	id := binary.BigEndian.Uint32(data[pos+1:])
+	pos += 5
+
+	var freqs [256]uint32
+	for i := range freqs {
+		f, n := binary.Uvarint(data[pos:])
+		if n == 0 {
+			return nil, truncated("dict", len(data))
+		}
+		if n < 0 || f == 0 || f > math.MaxUint32 {
+			return nil, corrupt("dict", pos)
+		}
+		freqs[i] = uint32(f)
+		pos += n
+	}
+	size, n := binary.Uvarint(data[pos:])
+	if n == 0 {
+		return nil, truncated("dict", len(data))
+	}
+	if n < 0 || size > MaxDictSize {
+		return nil, corrupt("dict", pos)
+	}
+	pos += n
+	if uint64(len(data)-pos) < size {
+		return nil, truncated("dict", len(data))
+	}
+	if uint64(len(data)-pos) > size {
+		return nil, corrupt("dict", pos+int(size))
+	}
+
+	d := NewSharedDict(slices.Clone(data[pos:]), freqs)
+	if d.ID != id {
+		return nil, &DataError{Stage: "dict", Offset: int64(len(dictMagic) + 1), Err: ErrChecksum}
+	}
+	return d, nil
+}
+
+var (
+	dictsMu sync.RWMutex
+	dicts   = make(map[uint32]*SharedDict)
+)
+
+// RegisterDict makes d available to chain specs under its ID, e.g.
+// "lzw:dict=" + d.String(). Registering a dictionary again has no effect.
+func RegisterDict(d *SharedDict) {
+	dictsMu.Lock()
+	defer dictsMu.Unlock()
+	if _, ok := dicts[d.ID]; !ok {
+		dicts[d.ID] = d
+	}
+}
+
+// LookupDict returns the dictionary registered under id.
+func LookupDict(id uint32) (*SharedDict, bool) {
+	dictsMu.RLock()
+	defer dictsMu.RUnlock()
+	d, ok := dicts[id]
+	return d, ok
+}
+
+const (
+	// dictKmer is the length of the substrings training scores: eight
+	// bytes, read as one uint64.
+	dictKmer = 8
+	// dictSegment is the length of the pieces Content is made of.
+	dictSegment = 64
+)
+
+// dictSegmentScore is a piece of the samples chosen for Content.
+type dictSegmentScore struct {
+	pos, score int
+}
+
+// TrainDict builds a dictionary of up to size bytes of Content from
+// samples, each an input of the kind the dictionary is for. Training
+// follows the COVER algorithm of zstd: the samples are cut into as many
+// stretches as Content has segments, and from each stretch the segment is
+// taken whose 8-byte substrings occur in the most samples, not counting
+// substrings already covered by an earlier segment. Samples that together
+// fit in size are taken whole.
+func TrainDict(samples [][]byte, size int) (*SharedDict, error) {
+	if size < MinDictSize || size > MaxDictSize {
+		return nil, fmt.Errorf("dictionary size must be between %d and %d", MinDictSize, MaxDictSize)
+	}
+	var freqs [256]uint32
+	total := 0
+	for _, sample := range samples {
+		for _, b := range sample {
+			if freqs[b] < math.MaxUint32 {
+				freqs[b]++
+			}
+		}
+		total += len(sample)
+	}
+	if total == 0 {
+		return nil, errors.New("no sample data to train on")
+	}
+
+	all := make([]byte, 0, total)
+	for _, sample := range samples {
+		all = append(all, sample...)
+	}
+	if total <= size {
+		return NewSharedDict(all, freqs), nil
+	}
+	return NewSharedDict(trainContent(samples, all, size), freqs), nil
+}
+
+// trainContent picks the segments of all, the concatenated samples, that
+// make up the Content of a dictionary of size bytes.
+func trainContent(samples [][]byte, all []byte, size int) []byte {
+	// keys holds the substring starting at each position of all, or 0 if
+	// it would run past the end of its sample; freq counts the samples
+	// each substring occurs in.
+	keys := make([]uint64, len(all))
+	freq := make(map[uint64]int)
+	seen := make(map[uint64]bool)
+	pos := 0
+	for _, sample := range samples {
+		clear(seen)
+		for i := 0; i+dictKmer <= len(sample); i++ {
+			key := binary.LittleEndian.Uint64(sample[i:])
+			keys[pos+i] = key
+			if !seen[key] {
+				seen[key] = true
+				freq[key]++
+			}
+		}
+		pos += len(sample)
+	}
+	delete(freq, 0)
+
+	segments := (size + dictSegment - 1) / dictSegment
+	stretch := max(len(all)/segments, dictSegment)
+	var chosen []dictSegmentScore
+	active := make(map[uint64]int)
+	for start := 0; start+dictSegment <= len(all); start += stretch {
+		end := min(start+stretch, len(all))
+		best := bestSegment(keys[:end], start, freq, active)
+		if best.score == 0 {
+			continue
+		}
+		chosen = append(chosen, best)
+		for _, key := range keys[best.pos : best.pos+dictSegment-dictKmer+1] {
+			delete(freq, key)
+		}
+	}
+
+	// The best segments go last, where matches are closest, and are the
+	// last to be cut when there are too many.
+	sort.SliceStable(chosen, func(i, j int) bool { return chosen[i].score < chosen[j].score })
+	content := make([]byte, 0, len(chosen)*dictSegment)
+	for _, s := range chosen {
+		content = append(content, all[s.pos:s.pos+dictSegment]...)
+	}
+	if len(content) > size {
+		content = content[len(content)-size:]
+	}
+	return content
+}
+
+// bestSegment slides a segment over keys[start:] and returns the position
+// where the substrings it covers have the highest total of freq, each
+// distinct substring counted once. active is scratch space.
+func bestSegment(keys []uint64, start int, freq map[uint64]int, active map[uint64]int) dictSegmentScore {
+	clear(active)
+	const span = dictSegment - dictKmer + 1 // substrings within a segment
+	best, score := dictSegmentScore{}, 0
+	for i := start; i < len(keys); i++ {
+		if key := keys[i]; active[key] == 0 {
+			score += freq[key]
+			active[key] = 1
+		} else {
+			active[key]++
+		}
+		if i-start >= span {
+			old := keys[i-span]
+			if active[old]--; active[old] == 0 {
+				score -= freq[old]
+			}
+		}
+		if first := i - span + 1; first >= start && first+dictSegment <= len(keys) && score > best.score {
+			best = dictSegmentScore{pos: first, score: score}
+		}
+	}
+	return best
+}
@@ -0,0 +1,226 @@
+// compress/dict_test.go
+package compress
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// jsonMessages returns n small JSON messages of the same shape, the kind
+// of input dictionaries are meant for.
+func jsonMessages(n int, seed int64) [][]byte {
+	r := rand.New(rand.NewSource(seed))
+	events := []string{"order.created", "order.paid", "order.shipped", "user.login", "cart.updated"}
+	currencies := []string{"EUR", "USD", "GBP"}
+	messages := make([][]byte, n)
+	for i := range messages {
+		messages[i] = []byte(fmt.Sprintf(`{"event":%q,"id":"%08x-%04x","timestamp":"2024-05-%02dT%02d:%02d:%02dZ","user":{"id":%d,"country":%q},"amount":{"value":%d.%02d,"currency":%q},"items":%d,"source":"mobile-app"}`,
+			events[r.Intn(len(events))], r.Uint32(), r.Intn(1<<16), 1+r.Intn(28), r.Intn(24), r.Intn(60), r.Intn(60),
+			r.Intn(1000000), []string{"DE", "FR", "US", "GB"}[r.Intn(4)], r.Intn(500), r.Intn(100), currencies[r.Intn(len(currencies))], 1+r.Intn(9)))
+	}
+	return messages
+}
+
+// trainedDict trains a dictionary on messages and registers it.
+func trainedDict(t testing.TB) *SharedDict {
+	t.Helper()
+	d, err := TrainDict(jsonMessages(2000, 1), DefaultDictSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterDict(d)
+	return d
+}
+
+func TestTrainDict(t *testing.T) {
+	samples := jsonMessages(2000, 1)
+	d := trainedDict(t)
+	if len(d.Content) == 0 || len(d.Content) > DefaultDictSize {
+		t.Errorf("content is %d bytes, want up to %d", len(d.Content), DefaultDictSize)
+	}
+	if !bytes.Contains(d.Content, []byte(`"currency":"`)) {
+		t.Errorf("content lacks the common keys: %q", d.Content[:min(200, len(d.Content))])
+	}
+	for b, f := range d.Freqs {
+		if f == 0 {
+			t.Fatalf("byte %d has no count", b)
+		}
+	}
+	again, _ := TrainDict(samples, DefaultDictSize)
+	if again.ID != d.ID {
+		t.Error("training is not deterministic")
+	}
+
+	// Samples that fit are taken whole.
+	small, err := TrainDict(samples[:3], DefaultDictSize)
+	if err != nil || !bytes.Equal(small.Content, bytes.Join(samples[:3], nil)) {
+		t.Errorf("small sample set: %v", err)
+	}
+
+	for _, size := range []int{MinDictSize - 1, MaxDictSize + 1} {
+		if _, err := TrainDict(samples, size); err == nil {
+			t.Errorf("size %d: expected an error", size)
+		}
+	}
+	if _, err := TrainDict([][]byte{nil, {}}, DefaultDictSize); err == nil {
+		t.Error("empty samples: expected an error")
+	}
+}
+
+func TestParseDict(t *testing.T) {
+	d := trainedDict(t)
+	data := d.Bytes()
+	parsed, err := ParseDict(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.ID != d.ID || !bytes.Equal(parsed.Content, d.Content) || parsed.Freqs != d.Freqs {
+		t.Error("parsed dictionary differs")
+	}
+	if id, err := ParseDictID(d.String()); err != nil || id != d.ID {
+		t.Errorf("ParseDictID(%q) = %x, %v", d, id, err)
+	}
+
+	damaged := bytes.Clone(data)
+	damaged[len(damaged)-1] ^= 1
+	if _, err := ParseDict(damaged); !errors.Is(err, ErrChecksum) {
+		t.Errorf("damaged content: got %v, want ErrChecksum", err)
+	}
+	if _, err := ParseDict(data[:len(data)-1]); !errors.Is(err, ErrTruncated) {
+		t.Errorf("truncated: got %v, want ErrTruncated", err)
+	}
+	if _, err := ParseDict(append(bytes.Clone(data), 0)); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("trailing data: got %v, want ErrCorrupt", err)
+	}
+	if _, err := ParseDict([]byte("FCMP\x01")); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("not a dictionary: got %v, want ErrCorrupt", err)
+	}
+}
+
+func TestDictRoundTrip(t *testing.T) {
+	d := trainedDict(t)
+	random := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	inputs := map[string][]byte{
+		"message": jsonMessages(1, 99)[0],
+		"all":     bytes.Join(jsonMessages(300, 7), []byte("\n")),
+		"random":  random,
+		"1MB":     largeInput(),
+		"a":       []byte("a"),
+	}
+
+	for _, spec := range []string{"lzw:dict=" + d.String(), "huffman:dict=" + d.String(), "lzma:preset=" + d.String(),
+		"lzma:preset=" + d.String() + ":dict=4k", "lzw:dict=" + d.String() + ",huffman:dict=" + d.String()} {
+		chain, err := ParseChain(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, data := range inputs {
+			compressed, err := chain.Compress(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			restored, err := chain.Decompress(compressed)
+			if err != nil {
+				t.Fatalf("%s %s: %v", spec, name, err)
+			}
+			if !bytes.Equal(restored, data) {
+				t.Errorf("%s %s: round trip failed", spec, name)
+			}
+		}
+	}
+
+	// Output made with a dictionary does not decode with another.
+	other, _ := TrainDict(jsonMessages(500, 2), 4096)
+	message := inputs["message"]
+	for _, pair := range [][2]Compressor{
+		{NewLZWDictCompressor(d), NewLZWDictCompressor(other)},
+		{NewHuffmanDictCompressor(d), NewHuffmanDictCompressor(other)},
+		{NewLZMACompressor(LZMAOptions{DictSize: 1 << 20, LC: 3, PB: 2, NiceLen: 64, Preset: d}),
+			NewLZMACompressor(LZMAOptions{DictSize: 1 << 20, LC: 3, PB: 2, NiceLen: 64, Preset: other})},
+	} {
+		compressed, _ := pair[0].Compress(message)
+		if _, err := pair[1].Decompress(compressed); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%T with another dictionary: got %v, want ErrCorrupt", pair[0], err)
+		}
+	}
+}
+
+// dictSizes returns the total size of the messages compressed one by one
+// with each spec.
+func dictSizes(t testing.TB, messages [][]byte, specs ...string) []int {
+	sizes := make([]int, len(specs))
+	for i, spec := range specs {
+		chain, err := ParseChain(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range messages {
+			compressed, err := chain.Compress(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes[i] += len(compressed)
+		}
+	}
+	return sizes
+}
+
+// With a dictionary trained on other messages, each small message takes a
+// fraction of what it does alone.
+func TestDictRatio(t *testing.T) {
+	d := trainedDict(t)
+	messages := jsonMessages(200, 42)
+	raw := len(bytes.Join(messages, nil))
+	for _, stage := range []struct{ plain, dict string }{
+		{"lzw", "lzw:dict=" + d.String()},
+		{"huffman", "huffman:dict=" + d.String()},
+		{"lzma", "lzma:preset=" + d.String()},
+	} {
+		sizes := dictSizes(t, messages, stage.plain, stage.dict)
+		t.Logf("%s: %d%%, %s: %d%% of %d bytes", stage.plain, 100*sizes[0]/raw, stage.dict, 100*sizes[1]/raw, raw)
+		if sizes[1]*3 > sizes[0]*2 {
+			t.Errorf("%s: %d bytes, without the dictionary %d", stage.dict, sizes[1], sizes[0])
+		}
+	}
+}
+
+func TestDictParams(t *testing.T) {
+	d := trainedDict(t)
+	if _, err := ParseChain("lzw:dict=0badd1c7"); !errors.Is(err, ErrUnknownDictionary) {
+		t.Errorf("unregistered dictionary: got %v, want ErrUnknownDictionary", err)
+	}
+	for _, spec := range []string{"lzw:dict=xyz", "huffman:dict=", "lzma:preset=123456789", "rle:dict=" + d.String()} {
+		if _, err := ParseChain(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+// BenchmarkDictMessage compresses one small message at a time with and
+// without a dictionary, reporting the compressed size in percent.
+func BenchmarkDictMessage(b *testing.B) {
+	d := trainedDict(b)
+	messages := jsonMessages(256, 42)
+	for _, spec := range []string{"lzw", "lzw:dict=" + d.String(), "huffman", "huffman:dict=" + d.String(),
+		"lzma", "lzma:preset=" + d.String()} {
+		chain, err := ParseChain(spec)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(spec, func(b *testing.B) {
+			var compressed []byte
+			in, out := 0, 0
+			for i := 0; i < b.N; i++ {
+				m := messages[i%len(messages)]
+				compressed, _ = chain.AppendCompress(compressed[:0], m)
+				in, out = in+len(m), out+len(compressed)
+			}
+			b.SetBytes(int64(in / b.N))
+			b.ReportMetric(100*float64(out)/float64(in), "%size")
+		})
+	}
+}
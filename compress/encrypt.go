@@ -0,0 +1,333 @@
+// compress/encrypt.go
+package compress
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Cipher selects the AEAD used by EncryptionCompressor.
+type Cipher byte
+
+const (
+	AESGCM           Cipher = 1
+	ChaCha20Poly1305 Cipher = 2
+)
+
+// KDF selects how the encryption key is derived.
+type KDF byte
+
+const (
+	KDFNone     KDF = 0 // raw key, e.g. from a key file
+	KDFScrypt   KDF = 1
+	KDFArgon2id KDF = 2
+)
+
+const (
+	encryptVersion = 1
+	keySize        = 32
+	saltSize       = 16
+	nonceSize      = 12
+
+	scryptLogN = 15
+	scryptR    = 8
+	scryptP    = 1
+
+	argon2Time    = 1
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+
+	// scryptMaxMemory caps the memory scrypt takes, 128·r·N·p bytes, for
+	// parameters read from a header, which are not authenticated until the
+	// key has been derived.
+	scryptMaxMemory = 256 << 20
+)
+
+// ErrDecrypt is returned when the data cannot be authenticated, either
+// because the passphrase or key is wrong or because the data was modified.
+var ErrDecrypt = errors.New("decryption failed: wrong passphrase/key or tampered data")
+
+// EncryptionCompressor is an authenticated encryption stage. It does not
+// reduce the size of its input and is meant to be the last stage of a chain,
+// after all compression has been applied.
+//
+// Output layout:
+//
+//	version | cipher | kdf | kdf params | salt | nonce | ciphertext+tag
+//
+// Everything before the ciphertext is authenticated as additional data.
+type EncryptionCompressor struct {
+	cipher     Cipher
+	kdf        KDF
+	passphrase []byte
+	key        []byte
+}
+
+func NewPassphraseEncryptor(c Cipher, kdf KDF, passphrase []byte) (*EncryptionCompressor, error) {
+	if kdf != KDFScrypt && kdf != KDFArgon2id {
+		return nil, fmt.Errorf("unsupported key derivation function: %d", kdf)
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty passphrase")
+	}
+	if err := checkCipher(c); err != nil {
+		return nil, err
+	}
+	return &EncryptionCompressor{cipher: c, kdf: kdf, passphrase: passphrase}, nil
+}
+
+func NewKeyEncryptor(c Cipher, key []byte) (*EncryptionCompressor, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", keySize, len(key))
+	}
+	if err := checkCipher(c); err != nil {
+		return nil, err
+	}
+	return &EncryptionCompressor{cipher: c, kdf: KDFNone, key: key}, nil
+}
+
+// ParseCipher maps a CLI cipher name to a Cipher.
+func ParseCipher(name string) (Cipher, error) {
+	switch name {
+	case "aes-gcm", "aes":
+		return AESGCM, nil
+	case "chacha20", "chacha20-poly1305":
+		return ChaCha20Poly1305, nil
+	}
+	return 0, fmt.Errorf("unknown cipher: %s", name)
+}
+
+// ParseKDF maps a CLI key derivation name to a KDF.
+func ParseKDF(name string) (KDF, error) {
+	switch name {
+	case "scrypt":
+		return KDFScrypt, nil
+	case "argon2", "argon2id":
+		return KDFArgon2id, nil
+	}
+	return 0, fmt.Errorf("unknown key derivation function: %s", name)
+}
+
+func (c Cipher) String() string {
+	switch c {
+	case AESGCM:
+		return "aes-gcm"
+	case ChaCha20Poly1305:
+		return "chacha20-poly1305"
+	}
+	return fmt.Sprintf("cipher(%d)", byte(c))
+}
+
+func (k KDF) String() string {
+	switch k {
+	case KDFNone:
+		return "key file"
+	case KDFScrypt:
+		return "scrypt"
+	case KDFArgon2id:
+		return "argon2id"
+	}
+	return fmt.Sprintf("kdf(%d)", byte(k))
+}
+
+// EncryptionParams reports the cipher and key derivation recorded in data
+// produced by EncryptionCompressor, without decrypting it.
+func EncryptionParams(data []byte) (Cipher, KDF, error) {
+	if len(data) < 3 {
+		return 0, 0, truncated("encrypt", 0)
+	}
+	if data[0] != encryptVersion {
+		return 0, 0, fmt.Errorf("unsupported encryption version %d: %w", data[0], ErrCorrupt)
+	}
+	return Cipher(data[1]), KDF(data[2]), nil
+}
+
+func checkCipher(c Cipher) error {
+	if c != AESGCM && c != ChaCha20Poly1305 {
+		return fmt.Errorf("unsupported cipher: %d", c)
+	}
+	return nil
+}
+
+func newAEAD(c Cipher, key []byte) (cipher.AEAD, error) {
+	switch c {
+	case AESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case ChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	}
+	return nil, fmt.Errorf("unsupported cipher: %d", c)
+}
+
+func (ec *EncryptionCompressor) deriveKey(kdf KDF, params, salt []byte) ([]byte, error) {
+	switch kdf {
+	case KDFNone:
+		if ec.key == nil {
+			return nil, errors.New("data was encrypted with a key file, not a passphrase")
+		}
+		return ec.key, nil
+	case KDFScrypt:
+		if ec.passphrase == nil {
+			return nil, errors.New("data was encrypted with a passphrase, not a key file")
+		}
+		return scrypt.Key(ec.passphrase, salt, 1<<params[0], int(params[1]), int(params[2]), keySize)
+	case KDFArgon2id:
+		if ec.passphrase == nil {
+			return nil, errors.New("data was encrypted with a passphrase, not a key file")
+		}
+		memory := binary.LittleEndian.Uint32(params[1:5])
+		return argon2.IDKey(ec.passphrase, salt, uint32(params[0]), memory, params[5], keySize), nil
+	}
+	return nil, fmt.Errorf("unsupported key derivation function: %d", kdf)
+}
+
+func kdfParamsSize(kdf KDF) int {
+	switch kdf {
+	case KDFScrypt:
+		return 3 // log2(N), r, p
+	case KDFArgon2id:
+		return 6 // time, memory (uint32 LE), threads
+	}
+	return 0
+}
+
+// additionalData is what the AEAD authenticates besides the ciphertext:
+// the header of the output, then ad.
+func additionalData(header, ad []byte) []byte {
+	if len(ad) == 0 {
+		return header
+	}
+	return append(slices.Clip(header), ad...)
+}
+
+// kdfParamsAllowed reports whether params, read from a header, are within
+// what Compress writes, so that a crafted header cannot make the key
+// derivation take gigabytes of memory or minutes of time before the data
+// is authenticated. scrypt may be stronger than the default, up to
+// scryptMaxMemory, but only with the r and p Compress uses.
+func kdfParamsAllowed(kdf KDF, params []byte) bool {
+	switch kdf {
+	case KDFScrypt:
+		logN, r, p := params[0], params[1], params[2]
+		return logN > 0 && logN < 32 && r == scryptR && p == scryptP &&
+			128*uint64(r)*uint64(p)<<logN <= scryptMaxMemory
+	case KDFArgon2id:
+		time, memory, threads := params[0], binary.LittleEndian.Uint32(params[1:5]), params[5]
+		return time > 0 && time <= argon2Time && memory <= argon2Memory && threads > 0 && threads <= argon2Threads
+	}
+	return true
+}
+
+func (ec *EncryptionCompressor) Compress(data []byte) ([]byte, error) {
+	return ec.Seal(data, nil)
+}
+
+func (ec *EncryptionCompressor) Decompress(data []byte) ([]byte, error) {
+	return ec.Open(data, nil)
+}
+
+// Seal encrypts data like Compress and also authenticates ad, which is not
+// part of the output: Open fails unless it is given the same ad.
+func (ec *EncryptionCompressor) Seal(data, ad []byte) ([]byte, error) {
+	header := []byte{encryptVersion, byte(ec.cipher), byte(ec.kdf)}
+	switch ec.kdf {
+	case KDFScrypt:
+		header = append(header, scryptLogN, scryptR, scryptP)
+	case KDFArgon2id:
+		header = append(header, argon2Time)
+		header = binary.LittleEndian.AppendUint32(header, argon2Memory)
+		header = append(header, argon2Threads)
+	}
+	params := header[3:]
+
+	var salt []byte
+	if ec.kdf != KDFNone {
+		salt = make([]byte, saltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		header = append(header, salt...)
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+
+	key, err := ec.deriveKey(ec.kdf, params, salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(ec.cipher, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(header, nonce, data, additionalData(header, ad)), nil
+}
+
+// Open reverses Seal.
+func (ec *EncryptionCompressor) Open(data, ad []byte) ([]byte, error) {
+	if len(data) < 3 {
+		return nil, truncated("encrypt", 0)
+	}
+	if data[0] != encryptVersion {
+		return nil, fmt.Errorf("unsupported encryption version %d: %w", data[0], ErrCorrupt)
+	}
+	c, kdf := Cipher(data[1]), KDF(data[2])
+	if err := checkCipher(c); err != nil {
+		return nil, err
+	}
+	if kdf != KDFNone && kdf != KDFScrypt && kdf != KDFArgon2id {
+		return nil, fmt.Errorf("unsupported key derivation function: %d", kdf)
+	}
+
+	pos := 3
+	paramsSize := kdfParamsSize(kdf)
+	saltLen := 0
+	if kdf != KDFNone {
+		saltLen = saltSize
+	}
+	if len(data) < pos+paramsSize+saltLen+nonceSize {
+		return nil, truncated("encrypt", 0)
+	}
+	params := data[pos : pos+paramsSize]
+	pos += paramsSize
+	salt := data[pos : pos+saltLen]
+	pos += saltLen
+	nonce := data[pos : pos+nonceSize]
+	pos += nonceSize
+
+	if !kdfParamsAllowed(kdf, params) {
+		return nil, corrupt("encrypt", 3)
+	}
+
+	key, err := ec.deriveKey(kdf, params, salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(c, key)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := aead.Open(nil, nonce, data[pos:], additionalData(data[:pos], ad))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
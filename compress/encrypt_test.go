@@ -0,0 +1,101 @@
+// compress/encrypt_test.go
+package compress
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	input := []byte("Repeated repeated repeated repeated data")
+	key := bytes.Repeat([]byte{0x42}, 32)
+
+	for _, c := range []Cipher{AESGCM, ChaCha20Poly1305} {
+		keyEnc, err := NewKeyEncryptor(c, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		passEnc, err := NewPassphraseEncryptor(c, KDFScrypt, []byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		argonEnc, err := NewPassphraseEncryptor(c, KDFArgon2id, []byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, enc := range []*EncryptionCompressor{keyEnc, passEnc, argonEnc} {
+			chain := NewCompressionChain(NewLZWCompressor(), enc)
+			sealed, err := chain.Compress(input)
+			if err != nil {
+				t.Fatalf("Compression failed: %v", err)
+			}
+			out, err := chain.Decompress(sealed)
+			if err != nil {
+				t.Fatalf("Decompression failed: %v", err)
+			}
+			if !bytes.Equal(input, out) {
+				t.Errorf("Data mismatch: %q", out)
+			}
+		}
+	}
+}
+
+func TestEncryptionWrongPassphrase(t *testing.T) {
+	enc, _ := NewPassphraseEncryptor(AESGCM, KDFScrypt, []byte("right"))
+	sealed, err := enc.Compress([]byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrong, _ := NewPassphraseEncryptor(AESGCM, KDFScrypt, []byte("wrong"))
+	if _, err := wrong.Decompress(sealed); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("expected ErrDecrypt, got %v", err)
+	}
+}
+
+func TestEncryptionTampering(t *testing.T) {
+	enc, _ := NewKeyEncryptor(ChaCha20Poly1305, make([]byte, 32))
+	sealed, err := enc.Compress([]byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a bit in the nonce (header) and in the ciphertext.
+	for _, pos := range []int{4, len(sealed) - 1} {
+		tampered := append([]byte(nil), sealed...)
+		tampered[pos] ^= 1
+		if _, err := enc.Decompress(tampered); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("byte %d: expected ErrDecrypt, got %v", pos, err)
+		}
+	}
+}
+
+// A header asking for more memory or time than Compress ever writes is
+// rejected before the key is derived.
+func TestEncryptionKDFLimits(t *testing.T) {
+	scrypt, _ := NewPassphraseEncryptor(AESGCM, KDFScrypt, []byte("secret"))
+	argon, _ := NewPassphraseEncryptor(AESGCM, KDFArgon2id, []byte("secret"))
+	for _, tc := range []struct {
+		enc    *EncryptionCompressor
+		params []byte
+	}{
+		{scrypt, []byte{20, scryptR, scryptP}}, // 1 GiB
+		{scrypt, []byte{10, 255, scryptP}},     // r not written by Compress
+		{scrypt, []byte{10, scryptR, 255}},     // p not written by Compress
+		{scrypt, []byte{0, scryptR, scryptP}},  // N of 1
+		{argon, []byte{16, 0, 0, 1, 0, 4}},     // 16 passes
+		{argon, []byte{1, 0, 0, 0x10, 0, 4}},   // 1 GiB
+		{argon, []byte{1, 0, 0, 1, 0, 255}},    // 255 threads
+	} {
+		sealed, err := tc.enc.Compress([]byte("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		copy(sealed[3:], tc.params)
+		if _, err := tc.enc.Decompress(sealed); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s %v: got %v, want ErrCorrupt", tc.enc.kdf, tc.params, err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// compress/errors.go
+package compress
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors. Decoders wrap them in a *DataError, so test with
+// errors.Is.
+var (
+	// ErrCorrupt means the input is not valid compressed data.
+	ErrCorrupt = errors.New("corrupt data")
+	// ErrTruncated means the input ends in the middle of a structure.
+	ErrTruncated = errors.New("truncated data")
+	// ErrUnknownAlgorithm means a chain names an algorithm that is not
+	// registered.
+	ErrUnknownAlgorithm = errors.New("unknown algorithm")
+	// ErrUnknownDictionary means a chain names a dictionary that is not
+	// registered.
+	ErrUnknownDictionary = errors.New("unknown dictionary")
+	// ErrChecksum means the data decoded but does not match the checksum
+	// recorded when it was compressed.
+	ErrChecksum = errors.New("checksum mismatch")
+	// ErrOutputLimit means decoding would produce more than the Limits
+	// of the stage allow.
+	ErrOutputLimit = errors.New("output exceeds limit")
+)
+
+// DataError describes invalid input found while decoding.
+type DataError struct {
+	// Stage is the algorithm that found the problem, or "container".
+	Stage string
+	// Offset is the position in the input of that stage where decoding
+	// failed, or -1 if it does not apply.
+	Offset int64
+	// Err is ErrCorrupt, ErrTruncated, ErrChecksum or ErrOutputLimit.
+	Err error
+}
+
+func (e *DataError) Error() string {
+	if e.Offset < 0 {
+		return fmt.Sprintf("%s: %v", e.Stage, e.Err)
+	}
+	return fmt.Sprintf("%s: %v at offset %d", e.Stage, e.Err, e.Offset)
+}
+
+func (e *DataError) Unwrap() error { return e.Err }
+
+func corrupt(stage string, offset int) error {
+	return &DataError{Stage: stage, Offset: int64(offset), Err: ErrCorrupt}
+}
+
+func truncated(stage string, offset int) error {
+	return &DataError{Stage: stage, Offset: int64(offset), Err: ErrTruncated}
+}
+
+func tooLarge(stage string, offset int) error {
+	return &DataError{Stage: stage, Offset: int64(offset), Err: ErrOutputLimit}
+}
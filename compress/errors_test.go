@@ -0,0 +1,29 @@
+// compress/errors_test.go
+package compress
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDataError(t *testing.T) {
+	bwt := NewBWTCompressor(16)
+	compressed, err := bwt.Compress([]byte("banana bandana banana"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = bwt.Decompress(compressed[:len(compressed)-3])
+	var dataErr *DataError
+	if !errors.Is(err, ErrTruncated) || !errors.As(err, &dataErr) {
+		t.Fatalf("truncated input: got %v, want a *DataError with ErrTruncated", err)
+	}
+	if dataErr.Stage != "bwt" || dataErr.Offset <= 0 {
+		t.Errorf("error = %+v, want stage bwt and the offset of the last block", dataErr)
+	}
+
+	_, err = bwt.Decompress(append(compressed, 0))
+	if !errors.Is(err, ErrCorrupt) {
+		t.Errorf("trailing data: got %v, want ErrCorrupt", err)
+	}
+}
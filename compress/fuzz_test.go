@@ -0,0 +1,134 @@
+// compress/fuzz_test.go
+package compress
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+var fuzzSeeds = [][]byte{
+	nil,
+	[]byte("a"),
+	[]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"),
+	[]byte("banana bandana banana"),
+	[]byte("TOBEORNOTTOBEORTOBEORNOT"),
+	{0, 1, 2, 3, 255, 254, 0, 0, 0, 128},
+}
+
+// fuzzDecompress checks that Decompress rejects arbitrary input with an
+// error rather than a panic, and that Compress output round-trips.
+func fuzzDecompress(f *testing.F, spec string) {
+	c, err := ParseChain(spec)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+		if compressed, err := c.Compress(seed); err == nil {
+			f.Add(compressed)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c.Decompress(data)
+
+		compressed, err := c.Compress(data)
+		if err != nil {
+			t.Fatalf("Compress: %v", err)
+		}
+		decompressed, err := c.Decompress(compressed)
+		if err != nil {
+			t.Fatalf("Decompress: %v", err)
+		}
+		if !bytes.Equal(decompressed, data) {
+			t.Fatalf("round trip of %q gave %q", data, decompressed)
+		}
+	})
+}
+
+func FuzzDecompressStore(f *testing.F)   { fuzzDecompress(f, "store") }
+func FuzzDecompressHuffman(f *testing.F) { fuzzDecompress(f, "huffman") }
+func FuzzDecompressRLE(f *testing.F)     { fuzzDecompress(f, "rle") }
+func FuzzDecompressSF(f *testing.F)      { fuzzDecompress(f, "sf") }
+func FuzzDecompressBWT(f *testing.F)     { fuzzDecompress(f, "bwt") }
+func FuzzDecompressLZW(f *testing.F)     { fuzzDecompress(f, "lzw") }
+func FuzzDecompressLZMA(f *testing.F)    { fuzzDecompress(f, "lzma") }
+func FuzzDecompressPPM(f *testing.F)     { fuzzDecompress(f, "ppm") }
+func FuzzDecompressCM(f *testing.F)      { fuzzDecompress(f, "cm:mem=1m") }
+func FuzzDecompressDelta(f *testing.F)   { fuzzDecompress(f, "delta:stride=4") }
+func FuzzDecompressBCJ(f *testing.F)     { fuzzDecompress(f, "bcj") }
+
+func FuzzDecompressPPMEscapeC(f *testing.F) { fuzzDecompress(f, "ppm:order=2:escape=c") }
+func FuzzDecompressPPMEscapeD(f *testing.F) { fuzzDecompress(f, "ppm:order=8:escape=d:mem=1m") }
+func FuzzDecompressDeltaXOR(f *testing.F)   { fuzzDecompress(f, "delta:stride=2:op=xor") }
+func FuzzDecompressBCJARM64(f *testing.F)   { fuzzDecompress(f, "bcj:arch=arm64") }
+
+func FuzzDecompressChain(f *testing.F) { fuzzDecompress(f, "bwt,rle,huffman") }
+
+func FuzzDecompressLZWDict(f *testing.F) { fuzzDecompress(f, "lzw:dict="+trainedDict(f).String()) }
+func FuzzDecompressHuffmanDict(f *testing.F) {
+	fuzzDecompress(f, "huffman:dict="+trainedDict(f).String())
+}
+func FuzzDecompressLZMAPreset(f *testing.F) {
+	fuzzDecompress(f, "lzma:preset="+trainedDict(f).String())
+}
+
+// FuzzDecompressEncrypt seeds with the output of each key derivation, so
+// that the fuzzer mutates their parameters: the encryptors derive a key
+// from whatever they find there before authenticating anything. The seeds
+// ask for little memory, so that most runs are quick.
+func FuzzDecompressEncrypt(f *testing.F) {
+	scrypt, _ := NewPassphraseEncryptor(AESGCM, KDFScrypt, []byte("secret"))
+	argon, _ := NewPassphraseEncryptor(ChaCha20Poly1305, KDFArgon2id, []byte("secret"))
+	key, _ := NewKeyEncryptor(AESGCM, make([]byte, keySize))
+	for _, enc := range []*EncryptionCompressor{scrypt, argon, key} {
+		sealed, err := enc.Compress([]byte("payload"))
+		if err != nil {
+			f.Fatal(err)
+		}
+		switch enc.kdf {
+		case KDFScrypt:
+			sealed[3] = 1 // log2(N)
+		case KDFArgon2id:
+			binary.LittleEndian.PutUint32(sealed[4:], 8) // KiB
+		}
+		f.Add(sealed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		scrypt.Decompress(data)
+		key.Decompress(data)
+
+		sealed, err := key.Compress(data)
+		if err != nil {
+			t.Fatalf("Compress: %v", err)
+		}
+		plain, err := key.Decompress(sealed)
+		if err != nil || !bytes.Equal(plain, data) {
+			t.Fatalf("round trip of %q gave %q, %v", data, plain, err)
+		}
+	})
+}
+
+func FuzzDecodeXZ(f *testing.F) {
+	for _, file := range []string{xzTextCRC64, xzTextBlocks, xzRandomSHA256} {
+		data, _ := hex.DecodeString(file)
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		DecodeXZ(context.Background(), data, DefaultLimits)
+	})
+}
+
+func FuzzUnpack(f *testing.F) {
+	f.Add(Pack(Header{Chain: "rle", Name: "a.txt"}, []byte("payload")))
+	f.Add([]byte("FCMP\x01"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		Unpack(data)
+	})
+}
@@ -3,10 +3,26 @@ package compress
 
 import (
 	"container/heap"
+	"context"
+	"encoding/binary"
 	"errors"
-	// "encoding/binary"
+	"slices"
+	"sync"
 )
 
+func init() {
+	Register("huffman", 2, func(p Params) (Compressor, error) {
+		if err := p.Allow("dict"); err != nil {
+			return nil, err
+		}
+		dict, err := p.Dict("dict")
+		if err != nil {
+			return nil, err
+		}
+		return NewHuffmanDictCompressor(dict), nil
+	})
+}
+
 type HuffmanNode struct {
 	Char  byte
 	Freq  int
@@ -28,160 +44,493 @@ func (h *HuffmanHeap) Pop() interface{} {
 	return x
 }
 
-type HuffmanCompressor struct{}
+type HuffmanCompressor struct {
+	limiter
+	scratch *huffmanScratch
+	static  *SharedDict
+}
 
 func NewHuffmanCompressor() *HuffmanCompressor {
-	return &HuffmanCompressor{}
+	return &HuffmanCompressor{limiter: limiter{DefaultLimits}}
+}
+
+// NewHuffmanDictCompressor returns a huffman stage that codes with the
+// byte frequencies of static instead of those of each input, so that no
+// tree is stored: for small inputs the tree is most of the output. Its
+// output starts with the ID of static. A nil static gives the plain stage.
+func NewHuffmanDictCompressor(static *SharedDict) *HuffmanCompressor {
+	return &HuffmanCompressor{limiter: limiter{DefaultLimits}, static: static}
+}
+
+// huffmanCode is a code of n bits, stored in the low bits of bits.
+type huffmanCode struct {
+	bits uint64
+	n    uint8
+}
+
+// huffmanTreeNode is a node of the decoding tree. Leaves have no children.
+type huffmanTreeNode struct {
+	child [2]int16
+	char  byte
+}
+
+// maxHuffmanNodes is the size of a tree of all 256 byte values.
+const maxHuffmanNodes = 2*256 - 1
+
+// huffmanScratch holds the trees and code table, reused across calls.
+type huffmanScratch struct {
+	nodes []HuffmanNode
+	heap  HuffmanHeap
+	codes [256]huffmanCode
+	tree  []huffmanTreeNode
 }
 
-func (hc *HuffmanCompressor) buildTree(data []byte) *HuffmanNode {
-	freqs := make(map[byte]int)
-	for _, b := range data {
-		freqs[b]++
+var huffmanPool = sync.Pool{New: func() any {
+	return &huffmanScratch{
+		nodes: make([]HuffmanNode, 0, maxHuffmanNodes),
+		heap:  make(HuffmanHeap, 0, 256),
+		tree:  make([]huffmanTreeNode, 0, maxHuffmanNodes),
 	}
+}}
 
-	h := &HuffmanHeap{}
-	heap.Init(h)
+func (hc *HuffmanCompressor) scratchSpace() *huffmanScratch {
+	if hc.scratch == nil {
+		hc.scratch = huffmanPool.Get().(*huffmanScratch)
+	}
+	return hc.scratch
+}
+
+// Reset returns the scratch space to the pool and restores DefaultLimits.
+func (hc *HuffmanCompressor) Reset() {
+	if hc.scratch != nil {
+		huffmanPool.Put(hc.scratch)
+		hc.scratch = nil
+	}
+	hc.limiter.Reset()
+}
+
+// buildTree builds the Huffman tree of the byte frequencies in freqs. Its
+// nodes live in the scratch space and are overwritten by the next call.
+func (hc *HuffmanCompressor) buildTree(freqs *[256]int) *HuffmanNode {
+	s := hc.scratchSpace()
+	s.nodes = s.nodes[:0]
+	newNode := func(n HuffmanNode) *HuffmanNode {
+		// nodes never grows past maxHuffmanNodes, so earlier pointers
+		// stay valid.
+		s.nodes = append(s.nodes, n)
+		return &s.nodes[len(s.nodes)-1]
+	}
+
+	s.heap = s.heap[:0]
+	h := &s.heap
 
 	for char, freq := range freqs {
-		heap.Push(h, &HuffmanNode{Char: char, Freq: freq})
+		if freq > 0 {
+			heap.Push(h, newNode(HuffmanNode{Char: byte(char), Freq: freq}))
+		}
+	}
+	if h.Len() == 0 {
+		return nil
 	}
 
 	for h.Len() > 1 {
 		left := heap.Pop(h).(*HuffmanNode)
 		right := heap.Pop(h).(*HuffmanNode)
-		heap.Push(h, &HuffmanNode{
+		heap.Push(h, newNode(HuffmanNode{
 			Freq:  left.Freq + right.Freq,
 			Left:  left,
 			Right: right,
-		})
+		}))
 	}
 
 	return heap.Pop(h).(*HuffmanNode)
 }
 
-func (hc *HuffmanCompressor) buildCodes(node *HuffmanNode, code string, codes map[byte]string) {
-	if node == nil {
-		return
+// buildCodes fills the code table of the scratch space from the tree and
+// returns it. It reports false if a code is longer than 64 bits, which
+// needs more input than fits in memory: depth d takes at least the
+// (d+2)th Fibonacci number of symbols.
+func (hc *HuffmanCompressor) buildCodes(root *HuffmanNode) (*[256]huffmanCode, bool) {
+	codes := &hc.scratchSpace().codes
+	*codes = [256]huffmanCode{}
+	if root == nil {
+		return codes, true
 	}
-	if node.Left == nil && node.Right == nil {
-		codes[node.Char] = code
-		return
+	if root.Left == nil && root.Right == nil {
+		// A tree of a single symbol still spends one bit per symbol, so
+		// the length of the output bounds the symbol count.
+		codes[root.Char] = huffmanCode{n: 1}
+		return codes, true
 	}
-	hc.buildCodes(node.Left, code+"0", codes)
-	hc.buildCodes(node.Right, code+"1", codes)
-}
 
-func (hc *HuffmanCompressor) serializeTree(node *HuffmanNode) []byte {
-	if node == nil {
-		return []byte{}
+	ok := true
+	var walk func(node *HuffmanNode, bits uint64, depth int)
+	walk = func(node *HuffmanNode, bits uint64, depth int) {
+		if node.Left == nil && node.Right == nil {
+			codes[node.Char] = huffmanCode{bits: bits, n: uint8(depth)}
+			ok = ok && depth <= 64
+			return
+		}
+		walk(node.Left, bits<<1, depth+1)
+		walk(node.Right, bits<<1|1, depth+1)
 	}
+	walk(root, 0, 0)
+	return codes, ok
+}
 
+// appendTree appends the tree in preorder: 0 for an internal node followed
+// by its subtrees, 1 and the character for a leaf.
+func appendTree(dst []byte, node *HuffmanNode) []byte {
 	if node.Left == nil && node.Right == nil {
-		return []byte{1, node.Char} // Leaf node: 1 + character
+		return append(dst, 1, node.Char)
 	}
-
-	// Internal node: 0 + left subtree + right subtree
-	left := hc.serializeTree(node.Left)
-	right := hc.serializeTree(node.Right)
-	result := append([]byte{0}, left...)
-	return append(result, right...)
+	dst = append(dst, 0)
+	dst = appendTree(dst, node.Left)
+	return appendTree(dst, node.Right)
 }
 
-func (hc *HuffmanCompressor) deserializeTree(data []byte) (*HuffmanNode, int) {
-	if len(data) == 0 {
-		return nil, 0
+// maxHuffmanTreeSize is the size of a serialized tree of all 256 byte
+// values: 256 leaves of two bytes and 255 internal nodes of one.
+const maxHuffmanTreeSize = 256*2 + 255
+
+// readTree reads the subtree starting at tree[pos] into the scratch space
+// and returns its index with the position after it. Errors carry offsets
+// relative to base.
+func (hc *HuffmanCompressor) readTree(tree []byte, pos, base, depth int) (int, int, error) {
+	if pos >= len(tree) {
+		return 0, 0, truncated("huffman", base+pos)
+	}
+	if depth > 256 {
+		return 0, 0, corrupt("huffman", base+pos)
 	}
 
-	if data[0] == 1 {
-		return &HuffmanNode{Char: data[1]}, 2
+	s := hc.scratchSpace()
+	switch tree[pos] {
+	case 1:
+		if pos+1 >= len(tree) {
+			return 0, 0, truncated("huffman", base+pos)
+		}
+		s.tree = append(s.tree, huffmanTreeNode{child: [2]int16{-1, -1}, char: tree[pos+1]})
+		return len(s.tree) - 1, pos + 2, nil
+	case 0:
+		// The tree size is bounded by maxHuffmanTreeSize, so indices fit
+		// in an int16.
+		index := len(s.tree)
+		s.tree = append(s.tree, huffmanTreeNode{})
+		left, next, err := hc.readTree(tree, pos+1, base, depth+1)
+		if err != nil {
+			return 0, 0, err
+		}
+		right, next, err := hc.readTree(tree, next, base, depth+1)
+		if err != nil {
+			return 0, 0, err
+		}
+		s.tree[index].child = [2]int16{int16(left), int16(right)}
+		return index, next, nil
 	}
+	return 0, 0, corrupt("huffman", base+pos)
+}
 
-	left, leftSize := hc.deserializeTree(data[1:])
-	right, rightSize := hc.deserializeTree(data[1+leftSize:])
+// huffmanStatic is the code of a SharedDict, with its tree serialized as
+// appendTree writes it for the decoder to read.
+type huffmanStatic struct {
+	codes [256]huffmanCode
+	tree  []byte
+}
 
-	return &HuffmanNode{Left: left, Right: right}, 1 + leftSize + rightSize
+// huffmanStatic returns the code of d's frequencies, built on first use.
+// The frequencies total less than 2^40, so no code is longer than 57 bits.
+func (d *SharedDict) huffmanStatic() *huffmanStatic {
+	d.huffmanOnce.Do(func() {
+		var freqs [256]int
+		for i, f := range d.Freqs {
+			freqs[i] = int(f)
+		}
+		hc := NewHuffmanCompressor()
+		root := hc.buildTree(&freqs)
+		codes, _ := hc.buildCodes(root)
+		d.huffman = &huffmanStatic{codes: *codes, tree: appendTree(nil, root)}
+		hc.Reset()
+	})
+	return d.huffman
+}
+
+func (hc *HuffmanCompressor) clearScratch() {
+	hc.scratch = nil
 }
 
 func (hc *HuffmanCompressor) Compress(data []byte) ([]byte, error) {
+	return compressOnce(context.Background(), hc, data)
+}
+
+func (hc *HuffmanCompressor) Decompress(compressed []byte) ([]byte, error) {
+	return decompressOnce(context.Background(), hc, compressed)
+}
+
+func (hc *HuffmanCompressor) CompressContext(ctx context.Context, data []byte) ([]byte, error) {
+	return compressOnce(ctx, hc, data)
+}
+
+func (hc *HuffmanCompressor) DecompressContext(ctx context.Context, compressed []byte) ([]byte, error) {
+	return decompressOnce(ctx, hc, compressed)
+}
+
+func (hc *HuffmanCompressor) AppendCompress(dst, src []byte) ([]byte, error) {
+	return hc.appendCompress(context.Background(), dst, src)
+}
+
+func (hc *HuffmanCompressor) AppendDecompress(dst, src []byte) ([]byte, error) {
+	return hc.appendDecompress(context.Background(), dst, src)
+}
+
+// appendCompress writes the symbol count, the serialized tree and the
+// codes:
+//
+//	uvarint count | uvarint tree size | tree | code bits, MSB first
+//
+// or with a SharedDict its ID in place of the tree:
+//
+//	uint32 ID | uvarint count | code bits, MSB first
+func (hc *HuffmanCompressor) appendCompress(ctx context.Context, dst, data []byte) ([]byte, error) {
+	t := newTracker(ctx, "huffman", len(data))
 	if len(data) == 0 {
-		return nil, nil
+		return dst, nil
+	}
+
+	var codes *[256]huffmanCode
+	var compressed []byte
+	if hc.static != nil {
+		codes = &hc.static.huffmanStatic().codes
+		compressed = binary.LittleEndian.AppendUint32(dst, hc.static.ID)
+		compressed = binary.AppendUvarint(compressed, uint64(len(data)))
+	} else {
+		var freqs [256]int
+		for _, b := range data {
+			freqs[b]++
+		}
+		tree := hc.buildTree(&freqs)
+		var ok bool
+		if codes, ok = hc.buildCodes(tree); !ok {
+			return nil, errors.New("huffman: code longer than 64 bits")
+		}
+
+		leaves := 0
+		for _, freq := range freqs {
+			if freq > 0 {
+				leaves++
+			}
+		}
+		compressed = binary.AppendUvarint(dst, uint64(len(data)))
+		compressed = binary.AppendUvarint(compressed, uint64(3*leaves-1))
+		compressed = appendTree(compressed, tree)
 	}
 
-	tree := hc.buildTree(data)
-	codes := make(map[byte]string)
-	hc.buildCodes(tree, "", codes)
+	w := bitWriter{buf: compressed, nbits: len(compressed) * 8}
+	for i, b := range data {
+		if err := t.update(i); err != nil {
+			return nil, err
+		}
+		code := codes[b]
+		w.writeBits(code.bits, int(code.n))
+	}
+	t.finish()
+	return w.buf, nil
+}
 
-	// Serialize tree structure
-	treeBytes := hc.serializeTree(tree)
+func (hc *HuffmanCompressor) appendDecompress(ctx context.Context, dst, compressed []byte) ([]byte, error) {
+	t := newTracker(ctx, "huffman", len(compressed))
+	if len(compressed) == 0 {
+		return dst, nil
+	}
 
-	// Build compressed data
-	var bits string
-	for _, b := range data {
-		bits += codes[b]
+	pos := 0
+	if hc.static != nil {
+		if len(compressed) < 4 {
+			return nil, truncated("huffman", len(compressed))
+		}
+		if binary.LittleEndian.Uint32(compressed) != hc.static.ID {
+			return nil, corrupt("huffman", 0)
+		}
+		pos = 4
+	}
+	count, n := binary.Uvarint(compressed[pos:])
+	if n == 0 {
+		return nil, truncated("huffman", pos)
+	}
+	if n < 0 || count == 0 {
+		return nil, corrupt("huffman", pos)
+	}
+	if !hc.limits.allow(len(compressed), count) {
+		return nil, tooLarge("huffman", pos)
+	}
+	pos += n
+
+	s := hc.scratchSpace()
+	s.tree = s.tree[:0]
+	var root int
+	if hc.static != nil {
+		// The tree was built by appendTree, so it reads without error.
+		root, _, _ = hc.readTree(hc.static.huffmanStatic().tree, 0, 0, 0)
+	} else {
+		// Read tree size and deserialize tree
+		treeSize, n := binary.Uvarint(compressed[pos:])
+		if n == 0 {
+			return nil, truncated("huffman", pos)
+		}
+		if n < 0 || treeSize < 2 || treeSize > maxHuffmanTreeSize {
+			return nil, corrupt("huffman", pos)
+		}
+		pos += n
+		if uint64(len(compressed)-pos) < treeSize {
+			return nil, truncated("huffman", pos)
+		}
+		treeBytes := compressed[pos : pos+int(treeSize)]
+		var end int
+		var err error
+		if root, end, err = hc.readTree(treeBytes, 0, pos, 0); err != nil {
+			return nil, err
+		}
+		if end != len(treeBytes) {
+			return nil, corrupt("huffman", pos+end)
+		}
+		pos += len(treeBytes)
 	}
 
-	// Convert bits to bytes
-	compressed := make([]byte, len(treeBytes)+1+(len(bits)+7)/8)
-	compressed[0] = byte(len(treeBytes))
-	copy(compressed[1:], treeBytes)
+	// Every symbol takes at least one bit.
+	bits := compressed[pos:]
+	if count > uint64(len(bits))*8 {
+		return nil, truncated("huffman", len(compressed))
+	}
 
-	offset := len(treeBytes) + 1
-	for i := 0; i < len(bits); i += 8 {
-		end := i + 8
-		if end > len(bits) {
-			end = len(bits)
+	tree := s.tree
+	result := slices.Grow(dst, int(count))
+	r := bitReader{data: bits}
+	for uint64(len(result)-len(dst)) < count {
+		if err := t.update(pos + r.pos/8); err != nil {
+			return nil, err
+		}
+		node := &tree[root]
+		if node.child[0] < 0 {
+			// A single symbol is coded with one bit.
+			if _, ok := r.readBit(); !ok {
+				return nil, truncated("huffman", len(compressed))
+			}
 		}
-		byteStr := bits[i:end]
-		val := 0
-		for j := 0; j < len(byteStr); j++ {
-			if byteStr[j] == '1' {
-				val |= 1 << uint(7-j)
+		for node.child[0] >= 0 {
+			bit, ok := r.readBit()
+			if !ok {
+				return nil, truncated("huffman", len(compressed))
 			}
+			node = &tree[node.child[bit]]
 		}
-		compressed[offset+i/8] = byte(val)
+		result = append(result, node.char)
 	}
 
-	return compressed, nil
+	// Only padding may follow the last code.
+	if (r.pos+7)/8 != len(bits) {
+		return nil, corrupt("huffman", pos+(r.pos+7)/8)
+	}
+	t.finish()
+	return result, nil
 }
 
-func (hc *HuffmanCompressor) Decompress(compressed []byte) ([]byte, error) {
-	if len(compressed) == 0 {
+// legacyHuffmanCompressor decodes the layout the huffman stage wrote before
+// the container header existed: a byte holding the size of the serialized
+// tree, the tree (0 for a node, then its children; 1 and the byte for a
+// leaf), and the code bits, with no count of symbols. Like the decoder of
+// that time it also decodes the padding bits of the last byte, so it gives
+// back exactly what that decoder did.
+type legacyHuffmanCompressor struct {
+	limiter
+}
+
+// legacyHuffmanNode is a node of a legacy tree; a child of -1 is missing.
+type legacyHuffmanNode struct {
+	left, right int
+	char        byte
+	leaf        bool
+}
+
+func (lh *legacyHuffmanCompressor) Compress(data []byte) ([]byte, error) {
+	return nil, errors.New("huffman: the layout of files without a header is only decoded")
+}
+
+func (lh *legacyHuffmanCompressor) Decompress(data []byte) ([]byte, error) {
+	if len(data) == 0 {
 		return nil, nil
 	}
+	treeSize := int(data[0])
+	if 1+treeSize > len(data) {
+		return nil, truncated("huffman", len(data))
+	}
+	var nodes []legacyHuffmanNode
+	root, _, err := readLegacyHuffmanTree(data[1:1+treeSize], 0, &nodes)
+	if err != nil {
+		return nil, err
+	}
+	if root < 0 {
+		return nil, corrupt("huffman", 1)
+	}
 
-	// Read tree size and deserialize tree
-	treeSize := int(compressed[0])
-	tree, _ := hc.deserializeTree(compressed[1 : treeSize+1])
-
-	// Read compressed data
 	var result []byte
-	node := tree
-
-	for i := treeSize + 1; i < len(compressed); i++ {
-		byte := compressed[i]
+	emit := func(pos int, char byte) error {
+		if !lh.limits.allow(len(data), uint64(len(result)+1)) {
+			return tooLarge("huffman", pos)
+		}
+		result = append(result, char)
+		return nil
+	}
+	node := root
+	for i := 1 + treeSize; i < len(data); i++ {
 		for bit := 7; bit >= 0; bit-- {
-			if node.Left == nil && node.Right == nil {
-				result = append(result, node.Char)
-				node = tree
+			if n := nodes[node]; n.leaf {
+				if err := emit(i, n.char); err != nil {
+					return nil, err
+				}
+				node = root
 			}
-
-			if (byte & (1 << uint(bit))) != 0 {
-				node = node.Right
+			if data[i]&(1<<bit) != 0 {
+				node = nodes[node].right
 			} else {
-				node = node.Left
+				node = nodes[node].left
 			}
-
-			if node == nil {
-				return nil, errors.New("invalid compressed data")
+			if node < 0 {
+				return nil, corrupt("huffman", i)
 			}
 		}
 	}
-
-	// Handle last character
-	if node != nil && node.Left == nil && node.Right == nil {
-		result = append(result, node.Char)
+	if nodes[node].leaf {
+		if err := emit(len(data), nodes[node].char); err != nil {
+			return nil, err
+		}
 	}
-
 	return result, nil
 }
+
+// readLegacyHuffmanTree reads the subtree serialized at tree[pos:] into
+// nodes and returns its index, or -1 where the tree ends early, as the old
+// decoder allowed, and the position after it.
+func readLegacyHuffmanTree(tree []byte, pos int, nodes *[]legacyHuffmanNode) (int, int, error) {
+	if pos >= len(tree) {
+		return -1, pos, nil
+	}
+	index := len(*nodes)
+	*nodes = append(*nodes, legacyHuffmanNode{left: -1, right: -1})
+	if tree[pos] == 1 {
+		if pos+1 >= len(tree) {
+			return 0, 0, corrupt("huffman", 1+pos)
+		}
+		(*nodes)[index].char, (*nodes)[index].leaf = tree[pos+1], true
+		return index, pos + 2, nil
+	}
+	left, pos, err := readLegacyHuffmanTree(tree, pos+1, nodes)
+	if err != nil {
+		return 0, 0, err
+	}
+	right, pos, err := readLegacyHuffmanTree(tree, pos, nodes)
+	if err != nil {
+		return 0, 0, err
+	}
+	(*nodes)[index].left, (*nodes)[index].right = left, right
+	return index, pos, nil
+}
@@ -0,0 +1,68 @@
+// compress/limits.go
+package compress
+
+// Limits bounds what Decompress may produce, so that a small hostile input
+// cannot exhaust memory. Each stage checks its own output against them,
+// before allocating it where the size is known up front. A zero field
+// means no limit.
+type Limits struct {
+	// MaxOutput is the largest output of a stage, in bytes.
+	MaxOutput int
+	// MaxRatio is the largest output of a stage as a multiple of its
+	// input. Outputs up to ratioFloor bytes are not checked against it,
+	// since a few bytes of RLE or LZW legitimately expand a lot.
+	MaxRatio int
+	// MaxMemory is the largest model a stage may allocate up front to
+	// decode, in bytes, for stages such as cm whose input says how large
+	// a model its encoder used.
+	MaxMemory int
+}
+
+// DefaultLimits is what stages built by New and the New*Compressor
+// functions start with: none, since a stage may legitimately expand its
+// input by any ratio to any size. Callers decoding untrusted data set their
+// own.
+var DefaultLimits = Limits{}
+
+const ratioFloor = 1 << 20
+
+const (
+	// maxDecodedSize is the largest size a stage accepts from a header,
+	// to keep offsets within an int.
+	maxDecodedSize = 1 << 48
+	// maxPrealloc is how much of a size read from a header a stage
+	// allocates up front; a hostile header may claim any size, which is
+	// only allocated as the output grows when Limits allow it.
+	maxPrealloc = 64 << 20
+)
+
+// Limiter is implemented by stages whose output can be bounded.
+type Limiter interface {
+	SetLimits(l Limits)
+}
+
+// allow reports whether a stage that read in bytes may produce size bytes.
+func (l Limits) allow(in int, size uint64) bool {
+	if l.MaxOutput > 0 && size > uint64(l.MaxOutput) {
+		return false
+	}
+	if l.MaxRatio > 0 && size > ratioFloor && size/uint64(l.MaxRatio) > uint64(in) {
+		return false
+	}
+	return true
+}
+
+// allowMemory reports whether a stage may allocate a model of size bytes.
+func (l Limits) allowMemory(size int) bool {
+	return l.MaxMemory <= 0 || size <= l.MaxMemory
+}
+
+// limiter is embedded by stages to implement Limiter.
+type limiter struct {
+	limits Limits
+}
+
+func (l *limiter) SetLimits(limits Limits) { l.limits = limits }
+
+// Reset restores DefaultLimits. Stages with scratch space extend it.
+func (l *limiter) Reset() { l.limits = DefaultLimits }
@@ -0,0 +1,55 @@
+// compress/limits_test.go
+package compress
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	// 4096 pairs of (255, 'a') expand to about 1 MiB.
+	bomb := bytes.Repeat([]byte{255, 'a'}, 4096)
+
+	rle := NewRLECompressor()
+	if _, err := rle.Decompress(bomb); err != nil {
+		t.Fatalf("default limits: %v", err)
+	}
+
+	rle.SetLimits(Limits{MaxOutput: 64 << 10})
+	_, err := rle.Decompress(bomb)
+	var dataErr *DataError
+	if !errors.Is(err, ErrOutputLimit) || !errors.As(err, &dataErr) || dataErr.Stage != "rle" {
+		t.Fatalf("MaxOutput: got %v, want an rle error with ErrOutputLimit", err)
+	}
+
+	rle.SetLimits(Limits{MaxRatio: 100})
+	if _, err := rle.Decompress(bytes.Repeat(bomb, 2)); !errors.Is(err, ErrOutputLimit) {
+		t.Errorf("MaxRatio: got %v, want ErrOutputLimit", err)
+	}
+	if _, err := rle.Decompress(bomb[:64]); err != nil {
+		t.Errorf("MaxRatio below the floor: %v", err)
+	}
+
+	// The chain passes its limits to every stage.
+	data := bytes.Repeat([]byte("limits "), 1000)
+	for _, spec := range []string{"rle", "huffman", "sf", "bwt", "lzw", "bwt,rle,huffman"} {
+		chain, err := ParseChain(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed, err := chain.Compress(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain.SetLimits(Limits{MaxOutput: len(data) - 1})
+		if _, err := chain.Decompress(compressed); !errors.Is(err, ErrOutputLimit) {
+			t.Errorf("%s: got %v, want ErrOutputLimit", spec, err)
+		}
+		// Intermediate stages may be a little larger than the data.
+		chain.SetLimits(Limits{MaxOutput: 2 * len(data)})
+		if _, err := chain.Decompress(compressed); err != nil {
+			t.Errorf("%s within the limit: %v", spec, err)
+		}
+	}
+}
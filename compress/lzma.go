@@ -0,0 +1,1211 @@
+// compress/lzma.go
+package compress
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"slices"
+	"sync"
+)
+
+func init() {
+	Register("lzma", 6, func(p Params) (Compressor, error) {
+		if err := p.Allow("dict", "lc", "lp", "pb", "nice", "preset"); err != nil {
+			return nil, err
+		}
+		opts := DefaultLZMAOptions
+		var err error
+		if opts.DictSize, err = p.Size("dict", opts.DictSize); err != nil {
+			return nil, err
+		}
+		if opts.LC, err = p.Int("lc", opts.LC); err != nil {
+			return nil, err
+		}
+		if opts.LP, err = p.Int("lp", opts.LP); err != nil {
+			return nil, err
+		}
+		if opts.PB, err = p.Int("pb", opts.PB); err != nil {
+			return nil, err
+		}
+		if opts.NiceLen, err = p.Int("nice", opts.NiceLen); err != nil {
+			return nil, err
+		}
+		if opts.Preset, err = p.Dict("preset"); err != nil {
+			return nil, err
+		}
+		if err := opts.validate(); err != nil {
+			return nil, err
+		}
+		return NewLZMACompressor(opts), nil
+	})
+}
+
+// LZMAOptions configures the lzma stage.
+type LZMAOptions struct {
+	// DictSize is the window: how far back a match may reach.
+	DictSize int
+	// LC is the number of high bits of the previous byte, and LP the
+	// number of low bits of the position, that select the model a
+	// literal is coded with.
+	LC, LP int
+	// PB is the number of low bits of the position that select the models
+	// of match flags and lengths; 2 suits data with 4-byte structure.
+	PB int
+	// NiceLen is the match length that is taken without searching for a
+	// cheaper way to code the bytes it covers.
+	NiceLen int
+	// Preset, if set, is a dictionary whose Content the window starts
+	// with, so that even the first bytes of an input find matches. The
+	// output then starts with its ID and is no longer an .lzma file.
+	Preset *SharedDict
+}
+
+// DefaultLZMAOptions are the settings of a plain "lzma" stage, those of
+// xz -6 apart from the parser.
+var DefaultLZMAOptions = LZMAOptions{DictSize: 8 << 20, LC: 3, LP: 0, PB: 2, NiceLen: 64}
+
+const (
+	minLZMADict = 4 << 10
+	maxLZMADict = 1 << 30
+)
+
+func (o LZMAOptions) validate() error {
+	switch {
+	case o.DictSize < minLZMADict || o.DictSize > maxLZMADict:
+		return fmt.Errorf("dict size must be between %d and %d", minLZMADict, maxLZMADict)
+	case o.LC < 0 || o.LC > 8:
+		return fmt.Errorf("lc must be between 0 and 8")
+	case o.LP < 0 || o.LP > lzmaPosBitsMax:
+		return fmt.Errorf("lp must be between 0 and %d", lzmaPosBitsMax)
+	case o.PB < 0 || o.PB > lzmaPosBitsMax:
+		return fmt.Errorf("pb must be between 0 and %d", lzmaPosBitsMax)
+	case o.NiceLen < 8 || o.NiceLen > lzmaMaxMatch:
+		return fmt.Errorf("nice must be between 8 and %d", lzmaMaxMatch)
+	}
+	return nil
+}
+
+const (
+	lzmaStates        = 12
+	lzmaPosBitsMax    = 4
+	lzmaMinMatch      = 2
+	lzmaMaxMatch      = 273
+	lzmaLenStates     = 4 // distances are modelled by length 2, 3, 4 and longer
+	lzmaDistSlots     = 64
+	lzmaEndDistModel  = 14 // slots below this code their low bits with probs
+	lzmaFullDistances = 128
+	lzmaAlignBits     = 4
+	lzmaHeaderSize    = 13
+	lzmaUnknownSize   = 1<<64 - 1
+	lzmaEndMarker     = 0xFFFFFFFF // the distance that ends a stream of unknown size
+)
+
+// The state remembers the kinds of the last few packets: below 7 the last
+// was a literal, which decides how the next literal is coded.
+func literalState(s uint32) uint32 {
+	switch {
+	case s < 4:
+		return 0
+	case s < 10:
+		return s - 3
+	}
+	return s - 6
+}
+
+func matchState(s uint32) uint32    { return 7 + 3*min32(s/7, 1) }
+func repState(s uint32) uint32      { return 8 + 3*min32(s/7, 1) }
+func shortRepState(s uint32) uint32 { return 9 + 2*min32(s/7, 1) }
+
+func min32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// distSlot is the slot of a distance: its bit length and the bit below
+// the top one.
+func distSlot(dist uint32) uint32 {
+	if dist < 4 {
+		return dist
+	}
+	n := uint32(bits.Len32(dist)) - 1
+	return 2*n + dist>>(n-1)&1
+}
+
+func lenState(length int) int {
+	if length-lzmaMinMatch < lzmaLenStates {
+		return length - lzmaMinMatch
+	}
+	return lzmaLenStates - 1
+}
+
+type lzmaLenModel struct {
+	choice, choice2 prob
+	low, mid        [1 << lzmaPosBitsMax][1 << 3]prob
+	high            [1 << 8]prob
+}
+
+func (lm *lzmaLenModel) reset() {
+	lm.choice, lm.choice2 = probInit, probInit
+	for i := range lm.low {
+		initProbs(lm.low[i][:])
+		initProbs(lm.mid[i][:])
+	}
+	initProbs(lm.high[:])
+}
+
+// lzmaModel is the state shared by the encoder and the decoder: the probs
+// of every context and the distances of the last four matches.
+type lzmaModel struct {
+	lc, lp, pb  uint
+	literal     []prob
+	isMatch     [lzmaStates << lzmaPosBitsMax]prob
+	isRep0Long  [lzmaStates << lzmaPosBitsMax]prob
+	isRep       [lzmaStates]prob
+	isRepG0     [lzmaStates]prob
+	isRepG1     [lzmaStates]prob
+	isRepG2     [lzmaStates]prob
+	distSlot    [lzmaLenStates][lzmaDistSlots]prob
+	distSpecial [1 + lzmaFullDistances - lzmaEndDistModel]prob
+	align       [1 << lzmaAlignBits]prob
+	matchLen    lzmaLenModel
+	repLen      lzmaLenModel
+	state       uint32
+	reps        [4]uint32
+}
+
+func (m *lzmaModel) reset(lc, lp, pb uint) {
+	m.lc, m.lp, m.pb = lc, lp, pb
+	n := 0x300 << (lc + lp)
+	if cap(m.literal) < n {
+		m.literal = make([]prob, n)
+	}
+	m.literal = m.literal[:n]
+	initProbs(m.literal)
+	initProbs(m.isMatch[:])
+	initProbs(m.isRep0Long[:])
+	initProbs(m.isRep[:])
+	initProbs(m.isRepG0[:])
+	initProbs(m.isRepG1[:])
+	initProbs(m.isRepG2[:])
+	for i := range m.distSlot {
+		initProbs(m.distSlot[i][:])
+	}
+	initProbs(m.distSpecial[:])
+	initProbs(m.align[:])
+	m.matchLen.reset()
+	m.repLen.reset()
+	m.state = 0
+	m.reps = [4]uint32{}
+}
+
+// literalProbs returns the 0x300 probs of a literal at pos after prev.
+func (m *lzmaModel) literalProbs(pos int, prev byte) []prob {
+	i := (uint(pos)&(1<<m.lp-1))<<m.lc + uint(prev)>>(8-m.lc)
+	return m.literal[0x300*i : 0x300*i+0x300]
+}
+
+// useRep moves reps[r] to the front.
+func (m *lzmaModel) useRep(r int) {
+	dist := m.reps[r]
+	copy(m.reps[1:r+1], m.reps[:r])
+	m.reps[0] = dist
+}
+
+// lzmaProps packs lc, lp and pb into the properties byte of the header.
+func lzmaProps(lc, lp, pb int) byte { return byte((pb*5+lp)*9 + lc) }
+
+// parseLZMAProps reverses lzmaProps.
+func parseLZMAProps(b byte) (lc, lp, pb uint, ok bool) {
+	if b >= 9*5*5 {
+		return 0, 0, 0, false
+	}
+	return uint(b % 9), uint(b / 9 % 5), uint(b / 45), true
+}
+
+// lzmaDecoder decodes LZMA packets, for the lzma stage and for the chunks
+// of LZMA2 in .xz files.
+type lzmaDecoder struct {
+	lzmaModel
+	rc rangeDecoder
+	// offset is where the range-coded data starts in the stage's input,
+	// for progress reports and errors.
+	offset int
+	// in and base are the length of the stage's input and where its output
+	// starts, for checking Limits.
+	in, base int
+	limits   Limits
+}
+
+// decode appends packets to out until it holds end bytes, or with end < 0
+// until the end marker. Matches may not reach before out[start], where
+// the dictionary begins. It returns ErrCorrupt, ErrTruncated or
+// ErrOutputLimit for the caller to wrap.
+func (d *lzmaDecoder) decode(t *tracker, out []byte, start, end int) ([]byte, error) {
+	if end >= 0 {
+		if !d.limits.allow(d.in, uint64(end-d.base)) {
+			return out, ErrOutputLimit
+		}
+		// A hostile header may claim any size, so only part of it is
+		// allocated up front when Limits allow more.
+		out = slices.Grow(out, min(end-len(out), maxPrealloc))
+	}
+	pbMask := uint32(1)<<d.pb - 1
+	for end < 0 || len(out) < end {
+		if err := t.update(d.offset + d.rc.pos); err != nil {
+			return out, err
+		}
+		if d.rc.overrun() {
+			return out, ErrTruncated
+		}
+		pos := len(out) - start
+		ps := uint32(pos) & pbMask
+		s := d.state
+
+		if d.rc.decodeBit(&d.isMatch[s<<lzmaPosBitsMax+ps]) == 0 {
+			var prev byte
+			if pos > 0 {
+				prev = out[len(out)-1]
+			}
+			probs := d.literalProbs(pos, prev)
+			sym := uint32(1)
+			if s < 7 {
+				sym = d.rc.decodeTree(probs, 8) | 0x100
+			} else {
+				// After a match the byte at rep0 predicts the literal
+				// until the first bit that differs from it.
+				match := uint32(out[len(out)-int(d.reps[0])-1])
+				for sym < 0x100 {
+					matchBit := match >> 7 & 1
+					match <<= 1
+					bit := d.rc.decodeBit(&probs[(1+matchBit)<<8+sym])
+					sym = sym<<1 | bit
+					if bit != matchBit {
+						break
+					}
+				}
+				for sym < 0x100 {
+					sym = sym<<1 | d.rc.decodeBit(&probs[sym])
+				}
+			}
+			out = append(out, byte(sym))
+			d.state = literalState(s)
+			continue
+		}
+
+		var length int
+		if d.rc.decodeBit(&d.isRep[s]) == 0 {
+			length = d.decodeLen(&d.matchLen, ps)
+			dist := d.decodeDist(length)
+			if dist == lzmaEndMarker {
+				if end >= 0 && len(out) != end {
+					return out, ErrCorrupt
+				}
+				return out, nil
+			}
+			d.reps = [4]uint32{dist, d.reps[0], d.reps[1], d.reps[2]}
+			d.state = matchState(s)
+		} else {
+			switch {
+			case d.rc.decodeBit(&d.isRepG0[s]) == 0:
+				if d.rc.decodeBit(&d.isRep0Long[s<<lzmaPosBitsMax+ps]) == 0 {
+					if int(d.reps[0]) >= pos {
+						return out, ErrCorrupt
+					}
+					out = append(out, out[len(out)-int(d.reps[0])-1])
+					d.state = shortRepState(s)
+					continue
+				}
+			case d.rc.decodeBit(&d.isRepG1[s]) == 0:
+				d.useRep(1)
+			case d.rc.decodeBit(&d.isRepG2[s]) == 0:
+				d.useRep(2)
+			default:
+				d.useRep(3)
+			}
+			length = d.decodeLen(&d.repLen, ps)
+			d.state = repState(s)
+		}
+
+		dist := int(d.reps[0]) + 1
+		if dist > pos || end >= 0 && len(out)+length > end {
+			return out, ErrCorrupt
+		}
+		if end < 0 && !d.limits.allow(d.in, uint64(len(out)+length-d.base)) {
+			return out, ErrOutputLimit
+		}
+		n := len(out)
+		out = slices.Grow(out, length)[:n+length]
+		for i := n; i < n+length; i++ {
+			out[i] = out[i-dist]
+		}
+	}
+	return out, nil
+}
+
+func (d *lzmaDecoder) decodeLen(lm *lzmaLenModel, ps uint32) int {
+	switch {
+	case d.rc.decodeBit(&lm.choice) == 0:
+		return lzmaMinMatch + int(d.rc.decodeTree(lm.low[ps][:], 3))
+	case d.rc.decodeBit(&lm.choice2) == 0:
+		return lzmaMinMatch + 8 + int(d.rc.decodeTree(lm.mid[ps][:], 3))
+	}
+	return lzmaMinMatch + 16 + int(d.rc.decodeTree(lm.high[:], 8))
+}
+
+func (d *lzmaDecoder) decodeDist(length int) uint32 {
+	slot := d.rc.decodeTree(d.distSlot[lenState(length)][:], 6)
+	if slot < 4 {
+		return slot
+	}
+	footer := uint(slot>>1 - 1)
+	dist := (2 | slot&1) << footer
+	if slot < lzmaEndDistModel {
+		return dist + d.rc.decodeReverse(d.distSpecial[dist-slot:], footer)
+	}
+	dist += d.rc.decodeDirect(footer-lzmaAlignBits) << lzmaAlignBits
+	return dist + d.rc.decodeReverse(d.align[:], lzmaAlignBits)
+}
+
+// LZMACompressor writes .lzma files: a 13-byte header with the properties,
+// dictionary size and uncompressed size, followed by LZMA packets. Matches
+// are found with hash chains over the whole window and chosen by an
+// optimal parse that compares the price of each way of coding the next
+// few kilobytes under the current probabilities.
+type LZMACompressor struct {
+	limiter
+	opts LZMAOptions
+	enc  *lzmaEncoder
+	dec  *lzmaDecoder
+}
+
+func NewLZMACompressor(opts LZMAOptions) *LZMACompressor {
+	return &LZMACompressor{limiter: limiter{DefaultLimits}, opts: opts}
+}
+
+var (
+	lzmaEncoderPool = sync.Pool{New: func() any { return new(lzmaEncoder) }}
+	lzmaDecoderPool = sync.Pool{New: func() any { return new(lzmaDecoder) }}
+)
+
+// Reset returns the encoder and decoder state to the pool and restores
+// DefaultLimits.
+func (lz *LZMACompressor) Reset() {
+	if lz.enc != nil {
+		lz.enc.data = nil
+		lzmaEncoderPool.Put(lz.enc)
+		lz.enc = nil
+	}
+	if lz.dec != nil {
+		lzmaDecoderPool.Put(lz.dec)
+		lz.dec = nil
+	}
+	lz.limiter.Reset()
+}
+
+func (lz *LZMACompressor) clearScratch() {
+	lz.enc = nil
+	lz.dec = nil
+}
+
+func (lz *LZMACompressor) Compress(data []byte) ([]byte, error) {
+	return compressOnce(context.Background(), lz, data)
+}
+
+func (lz *LZMACompressor) Decompress(compressed []byte) ([]byte, error) {
+	return decompressOnce(context.Background(), lz, compressed)
+}
+
+func (lz *LZMACompressor) CompressContext(ctx context.Context, data []byte) ([]byte, error) {
+	return compressOnce(ctx, lz, data)
+}
+
+func (lz *LZMACompressor) DecompressContext(ctx context.Context, compressed []byte) ([]byte, error) {
+	return decompressOnce(ctx, lz, compressed)
+}
+
+func (lz *LZMACompressor) AppendCompress(dst, src []byte) ([]byte, error) {
+	return lz.appendCompress(context.Background(), dst, src)
+}
+
+func (lz *LZMACompressor) AppendDecompress(dst, src []byte) ([]byte, error) {
+	return lz.appendDecompress(context.Background(), dst, src)
+}
+
+func (lz *LZMACompressor) appendCompress(ctx context.Context, dst, data []byte) ([]byte, error) {
+	t := newTracker(ctx, "lzma", len(data))
+	if len(data) == 0 {
+		return dst, nil
+	}
+
+	if lz.enc == nil {
+		lz.enc = lzmaEncoderPool.Get().(*lzmaEncoder)
+	}
+	e := lz.enc
+	result := dst
+	var preset []byte
+	if p := lz.opts.Preset; p != nil {
+		// The preset is coded as if it came before the data, but only
+		// its positions in the match finder are.
+		preset = p.Content
+		e.joined = append(append(e.joined[:0], preset...), data...)
+		e.init(e.joined, lz.opts)
+		e.usePreset(p, len(preset))
+		result = binary.LittleEndian.AppendUint32(result, p.ID)
+	} else {
+		e.init(data, lz.opts)
+	}
+
+	// The header's dictionary size tells decoders how much to allocate,
+	// so it is no larger than the data needs.
+	dict := max(min(lz.opts.DictSize, len(preset)+len(data)), minLZMADict)
+	result = append(result, lzmaProps(lz.opts.LC, lz.opts.LP, lz.opts.PB))
+	result = binary.LittleEndian.AppendUint32(result, lzmaDictSize(dict))
+	result = binary.LittleEndian.AppendUint64(result, uint64(len(data)))
+
+	e.rc.reset(result)
+	if err := e.encode(&t, len(preset)); err != nil {
+		e.data = nil
+		return nil, err
+	}
+	result = e.rc.flush()
+	e.data = nil
+
+	t.finish()
+	return result, nil
+}
+
+// lzmaDictSize rounds n up to 2^k or 2^k+2^(k-1), the only dictionary
+// sizes xz accepts in the header of a .lzma file.
+func lzmaDictSize(n int) uint32 {
+	d := uint32(n - 1)
+	d |= d >> 2
+	d |= d >> 3
+	d |= d >> 4
+	d |= d >> 8
+	d |= d >> 16
+	return d + 1
+}
+
+// appendDecompress reads any .lzma file, including those of unknown size
+// that end with a marker, as xz --format=lzma writes them.
+func (lz *LZMACompressor) appendDecompress(ctx context.Context, dst, compressed []byte) ([]byte, error) {
+	t := newTracker(ctx, "lzma", len(compressed))
+	if len(compressed) == 0 {
+		return dst, nil
+	}
+
+	// With a preset the file follows its ID and decodes after its Content,
+	// which is then dropped from the front of the output.
+	pos := 0
+	var preset []byte
+	if p := lz.opts.Preset; p != nil {
+		if len(compressed) < 4 {
+			return nil, truncated("lzma", len(compressed))
+		}
+		if binary.LittleEndian.Uint32(compressed) != p.ID {
+			return nil, corrupt("lzma", 0)
+		}
+		pos, preset = 4, p.Content
+	}
+	header := pos + lzmaHeaderSize
+
+	if len(compressed) < header {
+		return nil, truncated("lzma", len(compressed))
+	}
+	lc, lp, pb, ok := parseLZMAProps(compressed[pos])
+	if !ok || lp > lzmaPosBitsMax {
+		return nil, corrupt("lzma", pos)
+	}
+	size := binary.LittleEndian.Uint64(compressed[pos+5:])
+	start := len(dst)
+	end := -1
+	if size != lzmaUnknownSize {
+		if !lz.limits.allow(len(compressed), size) || size > maxDecodedSize {
+			return nil, tooLarge("lzma", pos+5)
+		}
+		end = start + len(preset) + int(size)
+	}
+
+	if lz.dec == nil {
+		lz.dec = lzmaDecoderPool.Get().(*lzmaDecoder)
+	}
+	d := lz.dec
+	d.reset(lc, lp, pb)
+	d.offset, d.in, d.base, d.limits = header, len(compressed), start+len(preset), lz.limits
+	if size == 0 {
+		return dst, nil
+	}
+	if !d.rc.init(compressed[header:]) {
+		if len(compressed) < header+5 {
+			return nil, truncated("lzma", len(compressed))
+		}
+		return nil, corrupt("lzma", header)
+	}
+	result, err := d.decode(&t, append(dst, preset...), start, end)
+	if err == nil && d.rc.overrun() {
+		err = ErrTruncated
+	}
+	if err != nil {
+		return nil, lzmaError("lzma", err, header+min(d.rc.pos, len(d.rc.data)))
+	}
+	if len(preset) > 0 {
+		n := copy(result[start:], result[start+len(preset):])
+		result = result[:start+n]
+	}
+
+	t.finish()
+	return result, nil
+}
+
+// lzmaError wraps an error from lzmaDecoder.decode in a DataError.
+func lzmaError(stage string, err error, offset int) error {
+	switch err {
+	case ErrCorrupt, ErrTruncated, ErrOutputLimit:
+		return &DataError{Stage: stage, Offset: int64(offset), Err: err}
+	}
+	return err
+}
+
+// lzmaMatch is a match found at the current position; dist is one less
+// than how far back it starts, as LZMA codes it.
+type lzmaMatch struct {
+	length int
+	dist   uint32
+}
+
+// lzmaNode is a position in the parse: the cheapest known way to reach it
+// and the model state that way leaves behind.
+type lzmaNode struct {
+	price uint32
+	prev  int32 // the node the last packet starts from
+	back  int32 // -1 for a literal, 0 to 3 for a rep, else dist+4
+	state uint32
+	reps  [4]uint32
+}
+
+const (
+	// lzmaParseWindow is how far ahead the parser looks before it commits
+	// to the cheapest way found.
+	lzmaParseWindow = 4096
+	// lzmaTreeDepth is how many positions with the same hash the match
+	// finder compares.
+	lzmaTreeDepth = 48
+	// lzmaPriceRefresh is the number of packets coded between updates of
+	// the length and distance price tables.
+	lzmaPriceRefresh = 256
+	lzmaInfinity     = 1 << 30
+)
+
+type lzmaEncoder struct {
+	lzmaModel
+	rc   rangeEncoder
+	data []byte
+	dict int
+	nice int
+	// joined holds a preset followed by the data, when there is one.
+	joined []byte
+
+	// The match finder remembers the last position of each two- and
+	// three-byte hash, and keeps the positions with the same four-byte
+	// hash in a binary tree ordered by the bytes that follow them. tree
+	// holds the two children of each position in a ring covering the
+	// window.
+	head2, head3 []int32
+	head         []int32
+	tree         []int32
+	hashShift    uint
+	shortShift   uint
+	matches      []lzmaMatch
+
+	nodes   []lzmaNode
+	last    int // the furthest node the parse has reached
+	path    []int32
+	pending int // packets coded since the prices were updated
+
+	matchLenPrices [1 << lzmaPosBitsMax][lzmaMaxMatch + 1]uint32
+	repLenPrices   [1 << lzmaPosBitsMax][lzmaMaxMatch + 1]uint32
+	slotPrices     [lzmaLenStates][lzmaDistSlots]uint32
+	distPrices     [lzmaLenStates][lzmaFullDistances]uint32
+	alignPrices    [1 << lzmaAlignBits]uint32
+}
+
+func (e *lzmaEncoder) init(data []byte, opts LZMAOptions) {
+	e.reset(uint(opts.LC), uint(opts.LP), uint(opts.PB))
+	e.data = data
+	e.dict = opts.DictSize
+	e.nice = opts.NiceLen
+
+	window := min(e.dict, len(data))
+	hashBits := max(min(bits.Len(uint(window)), 20), 12)
+	shortBits := min(hashBits, 16)
+	e.hashShift, e.shortShift = uint(32-hashBits), uint(32-shortBits)
+	e.head = heads(e.head, 1<<hashBits)
+	e.head2 = heads(e.head2, 1<<shortBits)
+	e.head3 = heads(e.head3, 1<<shortBits)
+	e.tree = int32s(e.tree, 2<<bits.Len(uint(window-1)))
+	if e.nodes == nil {
+		e.nodes = make([]lzmaNode, lzmaParseWindow+lzmaMaxMatch+1)
+	}
+	e.pending = lzmaPriceRefresh
+}
+
+// int32s returns s resized to n, reallocating only when it is too small.
+func int32s(s []int32, n int) []int32 {
+	if cap(s) < n {
+		return make([]int32, n)
+	}
+	return s[:n]
+}
+
+// heads returns a hash table of n empty entries, reusing s.
+func heads(s []int32, n int) []int32 {
+	s = int32s(s, n)
+	for i := range s {
+		s[i] = -1
+	}
+	return s
+}
+
+// insert adds pos to the hash tables and returns the previous positions
+// with the same two, three and four-byte hashes, or -1.
+func (e *lzmaEncoder) insert(pos int) (c2, c3, c4 int) {
+	v := binary.LittleEndian.Uint32(e.data[pos:])
+	h2 := (v & 0xFFFF) * 2654435761 >> e.shortShift
+	h3 := (v & 0xFFFFFF) * 2654435761 >> e.shortShift
+	h4 := v * 2654435761 >> e.hashShift
+	c2, c3, c4 = int(e.head2[h2]), int(e.head3[h3]), int(e.head[h4])
+	e.head2[h2], e.head3[h3], e.head[h4] = int32(pos), int32(pos), int32(pos)
+	return c2, c3, c4
+}
+
+// findMatches adds pos to the match finder and collects in e.matches the
+// matches that start there, each longer than the one before.
+func (e *lzmaEncoder) findMatches(pos int) []lzmaMatch {
+	e.matches = e.matches[:0]
+	full := min(lzmaMaxMatch, len(e.data)-pos)
+	if full < 4 {
+		return e.matches
+	}
+	limit := min(e.nice, full)
+	c2, c3, root := e.insert(pos)
+
+	// The last positions with the same two and three bytes give the short,
+	// close matches that the tree may not reach.
+	best := 1
+	for _, c := range [2]int{c2, c3} {
+		if c < 0 || pos-c > e.dict {
+			continue
+		}
+		if n := matchLen(e.data[c:], e.data[pos:], limit); n > best {
+			best = n
+			e.matches = append(e.matches, lzmaMatch{length: n, dist: uint32(pos - c - 1)})
+		}
+	}
+	e.walk(pos, root, limit, best, true)
+
+	// The tree compares no further than limit; extend the longest match.
+	if k := len(e.matches) - 1; k >= 0 && e.matches[k].length == limit && limit < full {
+		m := &e.matches[k]
+		from := pos - int(m.dist) - 1
+		m.length += matchLen(e.data[from+limit:], e.data[pos+limit:], full-limit)
+	}
+	return e.matches
+}
+
+// skip adds the positions from up to end to the match finder.
+func (e *lzmaEncoder) skip(from, end int) {
+	for pos := from; pos < end; pos++ {
+		if len(e.data)-pos >= 4 {
+			_, _, root := e.insert(pos)
+			e.walk(pos, root, min(e.nice, len(e.data)-pos), 0, false)
+		}
+	}
+}
+
+// lzmaPresetKey is what the match finder state after a preset depends on.
+type lzmaPresetKey struct {
+	hashShift, shortShift uint
+	treeLen, dict, nice   int
+}
+
+// lzmaPreset is the match finder after the Content of a SharedDict has
+// been added to it, copied into the encoder for every input rather than
+// adding the Content again, which would take most of the time for small
+// inputs. Positions at the end of Content are compared with no bytes
+// beyond it, so a few matches running on into an input may be missed.
+type lzmaPreset struct {
+	head, head2, head3 []int32
+	tree               []int32 // the nodes of the Content's positions
+}
+
+// usePreset fills the match finder, just initialized, with the positions of
+// the n bytes of the preset p at the start of e.data.
+func (e *lzmaEncoder) usePreset(p *SharedDict, n int) {
+	k := lzmaPresetKey{e.hashShift, e.shortShift, len(e.tree), e.dict, e.nice}
+	p.lzmaMu.Lock()
+	mf, ok := p.lzma[k]
+	if !ok {
+		mf = newLZMAPreset(e.data[:n], k)
+		if p.lzma == nil {
+			p.lzma = make(map[lzmaPresetKey]*lzmaPreset)
+		}
+		p.lzma[k] = mf
+	}
+	p.lzmaMu.Unlock()
+
+	copy(e.head, mf.head)
+	copy(e.head2, mf.head2)
+	copy(e.head3, mf.head3)
+	copy(e.tree, mf.tree)
+}
+
+func newLZMAPreset(content []byte, k lzmaPresetKey) *lzmaPreset {
+	e := &lzmaEncoder{data: content, dict: k.dict, nice: k.nice, hashShift: k.hashShift, shortShift: k.shortShift}
+	e.head = heads(nil, 1<<(32-k.hashShift))
+	e.head2 = heads(nil, 1<<(32-k.shortShift))
+	e.head3 = heads(nil, 1<<(32-k.shortShift))
+	e.tree = int32s(nil, k.treeLen)
+	e.skip(0, len(content))
+	// The tree is a ring of at least twice the window, so unless the
+	// window is smaller than Content its nodes are the first ones.
+	return &lzmaPreset{head: e.head, head2: e.head2, head3: e.head3, tree: e.tree[:min(2*len(content), k.treeLen)]}
+}
+
+// walk makes pos the root of the tree whose old root is cand. Going down
+// from cand, each position is compared with pos and hung below or above
+// it, so the walk passes the positions sharing the longest prefixes with
+// pos; with record, the matches longer than best are appended to
+// e.matches.
+func (e *lzmaEncoder) walk(pos, cand, limit, best int, record bool) {
+	mask := len(e.tree)/2 - 1
+	below, above := 2*(pos&mask), 2*(pos&mask)+1 // where the next ones hang
+	belowLen, aboveLen := 0, 0
+	for depth := lzmaTreeDepth; ; depth-- {
+		back := pos - cand
+		if cand < 0 || depth == 0 || back > e.dict || back > mask {
+			e.tree[below], e.tree[above] = -1, -1
+			return
+		}
+		node := 2 * (cand & mask)
+		// Everything under this node shares at least the shorter of
+		// belowLen and aboveLen bytes with pos.
+		n := min(belowLen, aboveLen)
+		n += matchLen(e.data[cand+n:], e.data[pos+n:], limit-n)
+		if record && n > best {
+			best = n
+			e.matches = append(e.matches, lzmaMatch{length: n, dist: uint32(back - 1)})
+		}
+		if n == limit {
+			// pos takes the place of cand, which is as good but further.
+			e.tree[below], e.tree[above] = e.tree[node], e.tree[node+1]
+			return
+		}
+		if e.data[cand+n] < e.data[pos+n] {
+			e.tree[below] = int32(cand)
+			below, belowLen = node+1, n
+			cand = int(e.tree[below])
+		} else {
+			e.tree[above] = int32(cand)
+			above, aboveLen = node, n
+			cand = int(e.tree[above])
+		}
+	}
+}
+
+// matchLen is the length of the common prefix of a and b, up to limit.
+func matchLen(a, b []byte, limit int) int {
+	n := 0
+	for n+8 <= limit {
+		if x := binary.LittleEndian.Uint64(a[n:]) ^ binary.LittleEndian.Uint64(b[n:]); x != 0 {
+			return n + bits.TrailingZeros64(x)/8
+		}
+		n += 8
+	}
+	for n < limit && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// repMatchLen is the length of the match at pos with distance rep, 0 if
+// it reaches before the data.
+func (e *lzmaEncoder) repMatchLen(pos int, rep uint32, limit int) int {
+	if int(rep) >= pos {
+		return 0
+	}
+	return matchLen(e.data[pos-int(rep)-1:], e.data[pos:], limit)
+}
+
+// encode codes e.data from start on.
+func (e *lzmaEncoder) encode(t *tracker, start int) error {
+	for pos := start; pos < len(e.data); {
+		if err := t.update(pos - start); err != nil {
+			return err
+		}
+		if e.pending >= lzmaPriceRefresh {
+			e.updatePrices()
+		}
+		pos = e.parse(pos)
+	}
+	return nil
+}
+
+// parse codes the packets for the bytes from pos on and returns the
+// position after them. Long matches are taken directly; otherwise the
+// cheapest path through the next positions is found, each reachable by a
+// literal, a short rep, a rep or a match from an earlier one.
+func (e *lzmaEncoder) parse(pos int) int {
+	limit := min(lzmaMaxMatch, len(e.data)-pos)
+	matches := e.findMatches(pos)
+
+	bestRep, repLen := 0, 0
+	for r, rep := range e.reps {
+		if n := e.repMatchLen(pos, rep, limit); n > repLen {
+			bestRep, repLen = r, n
+		}
+	}
+	if repLen >= e.nice {
+		e.encodeRep(pos, bestRep, repLen)
+		e.skip(pos+1, pos+repLen)
+		return pos + repLen
+	}
+	if len(matches) > 0 && matches[len(matches)-1].length >= e.nice {
+		m := matches[len(matches)-1]
+		e.encodeMatch(pos, m.dist, m.length)
+		e.skip(pos+1, pos+m.length)
+		return pos + m.length
+	}
+	if len(matches) == 0 && repLen < lzmaMinMatch &&
+		(pos == 0 || int(e.reps[0]) >= pos || e.data[pos] != e.data[pos-int(e.reps[0])-1]) {
+		e.encodeLiteral(pos)
+		return pos + 1
+	}
+
+	nodes := e.nodes
+	nodes[0] = lzmaNode{state: e.state, reps: e.reps}
+	e.last = 0
+
+	end := 0
+	for cur := 0; ; cur++ {
+		if cur > 0 {
+			if cur == e.last || cur >= lzmaParseWindow {
+				end = cur
+				break
+			}
+			e.follow(cur)
+			matches = e.findMatches(pos + cur)
+			if len(matches) > 0 && matches[len(matches)-1].length >= e.nice {
+				m := matches[len(matches)-1]
+				end = cur + m.length
+				nodes[end] = lzmaNode{prev: int32(cur), back: int32(m.dist) + 4}
+				e.skip(pos+cur+1, pos+end)
+				break
+			}
+		}
+		e.relaxFrom(pos, cur, matches)
+	}
+
+	// Walk back from the end and code the path forwards.
+	e.path = e.path[:0]
+	for i := end; i > 0; i = int(nodes[i].prev) {
+		e.path = append(e.path, int32(i))
+	}
+	at := pos
+	for k := len(e.path) - 1; k >= 0; k-- {
+		i := e.path[k]
+		n := &nodes[i]
+		length := int(i - n.prev)
+		switch {
+		case n.back < 0:
+			e.encodeLiteral(at)
+		case n.back < 4:
+			e.encodeRep(at, int(n.back), length)
+		default:
+			e.encodeMatch(at, uint32(n.back-4), length)
+		}
+		at += length
+	}
+	return pos + end
+}
+
+// follow sets the state and reps of node cur from the packet that reaches
+// it.
+func (e *lzmaEncoder) follow(cur int) {
+	n := &e.nodes[cur]
+	from := &e.nodes[n.prev]
+	n.reps = from.reps
+	switch {
+	case n.back < 0:
+		n.state = literalState(from.state)
+	case n.back == 0 && int(n.prev) == cur-1:
+		n.state = shortRepState(from.state)
+	case n.back < 4:
+		n.state = repState(from.state)
+		dist := n.reps[n.back]
+		copy(n.reps[1:n.back+1], n.reps[:n.back])
+		n.reps[0] = dist
+	default:
+		n.state = matchState(from.state)
+		n.reps = [4]uint32{uint32(n.back - 4), from.reps[0], from.reps[1], from.reps[2]}
+	}
+}
+
+// relax records a way to reach node i for price, by the packet back from
+// node from, if it is the cheapest so far.
+func (e *lzmaEncoder) relax(i int, price uint32, from int, back int32) {
+	for e.last < i {
+		e.last++
+		e.nodes[e.last].price = lzmaInfinity
+	}
+	if n := &e.nodes[i]; price < n.price {
+		n.price, n.prev, n.back = price, int32(from), back
+	}
+}
+
+// relaxFrom offers every packet that can start at node cur.
+func (e *lzmaEncoder) relaxFrom(pos, cur int, matches []lzmaMatch) {
+	n := &e.nodes[cur]
+	at := pos + cur
+	limit := min(lzmaMaxMatch, len(e.data)-at)
+	ps := uint32(at) & (1<<e.pb - 1)
+	s := n.state
+	price := n.price
+
+	e.relax(cur+1, price+bitPrice(e.isMatch[s<<lzmaPosBitsMax+ps], 0)+e.literalPrice(at, s, n.reps[0]), cur, -1)
+
+	matchPrice := price + bitPrice(e.isMatch[s<<lzmaPosBitsMax+ps], 1)
+	repPrice := matchPrice + bitPrice(e.isRep[s], 1)
+	if int(n.reps[0]) < at && e.data[at] == e.data[at-int(n.reps[0])-1] {
+		short := repPrice + bitPrice(e.isRepG0[s], 0) + bitPrice(e.isRep0Long[s<<lzmaPosBitsMax+ps], 0)
+		e.relax(cur+1, short, cur, 0)
+	}
+	if limit < lzmaMinMatch {
+		return
+	}
+
+	for r, rep := range n.reps {
+		length := e.repMatchLen(at, rep, limit)
+		if length < lzmaMinMatch {
+			continue
+		}
+		p := repPrice + e.repIndexPrice(r, s, ps)
+		for l := lzmaMinMatch; l <= length; l++ {
+			e.relax(cur+l, p+e.repLenPrices[ps][l], cur, int32(r))
+		}
+	}
+
+	normal := matchPrice + bitPrice(e.isRep[s], 0)
+	l := lzmaMinMatch
+	for _, m := range matches {
+		for ; l <= m.length; l++ {
+			e.relax(cur+l, normal+e.matchLenPrices[ps][l]+e.distPrice(m.dist, l), cur, int32(m.dist)+4)
+		}
+	}
+}
+
+func (e *lzmaEncoder) repIndexPrice(r int, s, ps uint32) uint32 {
+	if r == 0 {
+		return bitPrice(e.isRepG0[s], 0) + bitPrice(e.isRep0Long[s<<lzmaPosBitsMax+ps], 1)
+	}
+	price := bitPrice(e.isRepG0[s], 1)
+	if r == 1 {
+		return price + bitPrice(e.isRepG1[s], 0)
+	}
+	return price + bitPrice(e.isRepG1[s], 1) + bitPrice(e.isRepG2[s], uint32(r-2))
+}
+
+func (e *lzmaEncoder) literalPrice(pos int, s, rep0 uint32) uint32 {
+	var prev byte
+	if pos > 0 {
+		prev = e.data[pos-1]
+	}
+	probs := e.literalProbs(pos, prev)
+	b := uint32(e.data[pos])
+	if s < 7 {
+		return treePrice(probs, 8, b)
+	}
+	var price uint32
+	match := uint32(e.data[pos-int(rep0)-1])
+	sym := uint32(1)
+	matched := true
+	for i := 7; i >= 0; i-- {
+		bit := b >> i & 1
+		if matched {
+			matchBit := match >> i & 1
+			price += bitPrice(probs[(1+matchBit)<<8+sym], bit)
+			matched = bit == matchBit
+		} else {
+			price += bitPrice(probs[sym], bit)
+		}
+		sym = sym<<1 | bit
+	}
+	return price
+}
+
+func (e *lzmaEncoder) distPrice(dist uint32, length int) uint32 {
+	ls := lenState(length)
+	if dist < lzmaFullDistances {
+		return e.distPrices[ls][dist]
+	}
+	return e.slotPrices[ls][distSlot(dist)] + e.alignPrices[dist&(1<<lzmaAlignBits-1)]
+}
+
+// updatePrices recomputes the price tables from the current probs.
+func (e *lzmaEncoder) updatePrices() {
+	e.pending = 0
+	for ps := 0; ps < 1<<e.pb; ps++ {
+		lenPrices(&e.matchLen, ps, &e.matchLenPrices[ps])
+		lenPrices(&e.repLen, ps, &e.repLenPrices[ps])
+	}
+	slots := distSlot(uint32(e.dict-1)) + 1
+	for ls := range e.slotPrices {
+		for slot := uint32(0); slot < slots; slot++ {
+			price := treePrice(e.distSlot[ls][:], 6, slot)
+			if slot >= lzmaEndDistModel {
+				price += (slot>>1 - 1 - lzmaAlignBits) << priceShift
+			}
+			e.slotPrices[ls][slot] = price
+		}
+	}
+	for dist := uint32(0); dist < lzmaFullDistances; dist++ {
+		slot := distSlot(dist)
+		var extra uint32
+		if slot >= 4 {
+			footer := uint(slot>>1 - 1)
+			base := (2 | slot&1) << footer
+			extra = reversePrice(e.distSpecial[base-slot:], footer, dist-base)
+		}
+		for ls := range e.distPrices {
+			e.distPrices[ls][dist] = e.slotPrices[ls][slot] + extra
+		}
+	}
+	for i := range e.alignPrices {
+		e.alignPrices[i] = reversePrice(e.align[:], lzmaAlignBits, uint32(i))
+	}
+}
+
+func lenPrices(lm *lzmaLenModel, ps int, prices *[lzmaMaxMatch + 1]uint32) {
+	low := bitPrice(lm.choice, 0)
+	mid := bitPrice(lm.choice, 1) + bitPrice(lm.choice2, 0)
+	high := bitPrice(lm.choice, 1) + bitPrice(lm.choice2, 1)
+	for l := lzmaMinMatch; l <= lzmaMaxMatch; l++ {
+		v := uint32(l - lzmaMinMatch)
+		switch {
+		case v < 8:
+			prices[l] = low + treePrice(lm.low[ps][:], 3, v)
+		case v < 16:
+			prices[l] = mid + treePrice(lm.mid[ps][:], 3, v-8)
+		default:
+			prices[l] = high + treePrice(lm.high[:], 8, v-16)
+		}
+	}
+}
+
+func (e *lzmaEncoder) posState(pos int) uint32 { return uint32(pos) & (1<<e.pb - 1) }
+
+func (e *lzmaEncoder) encodeLiteral(pos int) {
+	s := e.state
+	e.rc.encodeBit(&e.isMatch[s<<lzmaPosBitsMax+e.posState(pos)], 0)
+	var prev byte
+	if pos > 0 {
+		prev = e.data[pos-1]
+	}
+	probs := e.literalProbs(pos, prev)
+	b := uint32(e.data[pos])
+	if s < 7 {
+		e.rc.encodeTree(probs, 8, b)
+	} else {
+		match := uint32(e.data[pos-int(e.reps[0])-1])
+		sym := uint32(1)
+		matched := true
+		for i := 7; i >= 0; i-- {
+			bit := b >> i & 1
+			if matched {
+				matchBit := match >> i & 1
+				e.rc.encodeBit(&probs[(1+matchBit)<<8+sym], bit)
+				matched = bit == matchBit
+			} else {
+				e.rc.encodeBit(&probs[sym], bit)
+			}
+			sym = sym<<1 | bit
+		}
+	}
+	e.state = literalState(s)
+	e.pending++
+}
+
+func (e *lzmaEncoder) encodeMatch(pos int, dist uint32, length int) {
+	s, ps := e.state, e.posState(pos)
+	e.rc.encodeBit(&e.isMatch[s<<lzmaPosBitsMax+ps], 1)
+	e.rc.encodeBit(&e.isRep[s], 0)
+	e.encodeLen(&e.matchLen, length, ps)
+
+	ls := lenState(length)
+	slot := distSlot(dist)
+	e.rc.encodeTree(e.distSlot[ls][:], 6, slot)
+	if slot >= 4 {
+		footer := uint(slot>>1 - 1)
+		base := (2 | slot&1) << footer
+		if slot < lzmaEndDistModel {
+			e.rc.encodeReverse(e.distSpecial[base-slot:], footer, dist-base)
+		} else {
+			e.rc.encodeDirect((dist-base)>>lzmaAlignBits, footer-lzmaAlignBits)
+			e.rc.encodeReverse(e.align[:], lzmaAlignBits, dist-base)
+		}
+	}
+
+	e.reps = [4]uint32{dist, e.reps[0], e.reps[1], e.reps[2]}
+	e.state = matchState(s)
+	e.pending++
+}
+
+// encodeRep codes a match at the distance of reps[r]; with r 0 and length
+// 1 it is a short rep.
+func (e *lzmaEncoder) encodeRep(pos, r, length int) {
+	s, ps := e.state, e.posState(pos)
+	e.rc.encodeBit(&e.isMatch[s<<lzmaPosBitsMax+ps], 1)
+	e.rc.encodeBit(&e.isRep[s], 1)
+	if r == 0 {
+		e.rc.encodeBit(&e.isRepG0[s], 0)
+		if length == 1 {
+			e.rc.encodeBit(&e.isRep0Long[s<<lzmaPosBitsMax+ps], 0)
+			e.state = shortRepState(s)
+			e.pending++
+			return
+		}
+		e.rc.encodeBit(&e.isRep0Long[s<<lzmaPosBitsMax+ps], 1)
+	} else {
+		e.rc.encodeBit(&e.isRepG0[s], 1)
+		if r == 1 {
+			e.rc.encodeBit(&e.isRepG1[s], 0)
+		} else {
+			e.rc.encodeBit(&e.isRepG1[s], 1)
+			e.rc.encodeBit(&e.isRepG2[s], uint32(r-2))
+		}
+		e.useRep(r)
+	}
+	e.encodeLen(&e.repLen, length, ps)
+	e.state = repState(s)
+	e.pending++
+}
+
+func (e *lzmaEncoder) encodeLen(lm *lzmaLenModel, length int, ps uint32) {
+	v := uint32(length - lzmaMinMatch)
+	switch {
+	case v < 8:
+		e.rc.encodeBit(&lm.choice, 0)
+		e.rc.encodeTree(lm.low[ps][:], 3, v)
+	case v < 16:
+		e.rc.encodeBit(&lm.choice, 1)
+		e.rc.encodeBit(&lm.choice2, 0)
+		e.rc.encodeTree(lm.mid[ps][:], 3, v-8)
+	default:
+		e.rc.encodeBit(&lm.choice, 1)
+		e.rc.encodeBit(&lm.choice2, 1)
+		e.rc.encodeTree(lm.high[:], 8, v-16)
+	}
+}
@@ -0,0 +1,172 @@
+// compress/lzma_test.go
+package compress
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// Files written by xz 5 from xzText and xzRandom, as hex.
+const (
+	xzTextCRC64    = "fd377a585a000004e6d6b44604c01bca02210116000000000000000042c7f529e0014900135d00341949ee8def8c6bed3925e7d3f5f66d1fe000000037daab9f0f298f49000137ca0200000039db86d3b1c467fb020000000004595a"
+	xzTextNone     = "fd377a585a000000ff12d94104c01bca02210116000000000000000042c7f529e0014900135d00341949ee8def8c6bed3925e7d3f5f66d1fe000000000012fca02000000cf5b033ca8000afc020000000000595a"
+	xzTextBlocks   = "fd377a585a0000016922de3602c01a642101160054a03120e0006300125d00341949ee8def8c6bed3925e77f1a06900000000000e9bc586702c01a642101160054a03120e0006300125d00329b2cde2c051a10a26b60ecf2e7e39e0000000000678d6a1802c01a642101160054a03120e0006300125d003661b858203c2f7a5cd48645cf5a84020000000000ab87c11e02c01a1e210116003a585393e0001d00125d00361bc180a3803609de958e1bc38b2d42e0000000006d2bc71c00042a642a642a642a1e0000c9d601969be35140030000000001595a"
+	xzRandomSHA256 = "fd377a585a00000ae1fb0ca104c068642101160000000000000000003b1492a501006352fdfc072182654f163f5f0f9a621d729566c74d10037c4d7bbb0407d1e2c64981855ad8681d0d86d1e91e00167939cb6694d2c422acd208a0072939487f6999eb9d18a44784045d87f3c67cf22746e995af5a25367951baa2ff6cd471c483f15fb90bad00f06ecd58bd5414ccf81eebd167e95a1f43c09d564ffd526d56d7cc91a57ce40500019c0164000000014bd520b6e9df1c02000000000a595a"
+	// xz --delta=dist=4 --check=crc32, from xzSeries.
+	xzSeriesDelta = "fd377a585a0000016922de3604c12180020301032101160000000000daccbe10e000ff00195d007400bc1747c0591cf13e0565c3546bf027d6c535bbdff13200000000000846fd370001398002000000a1facffb3e300d8b020000000001595a"
+	// xz --x86 and --arm64 --check=crc32, from x86Code(512) and
+	// arm64Code(512).
+	xzX86   = "fd377a585a0000016922de3604c1da018004040021011600000000007f440531e001ff00d25d0061ba02000d1c5afc866d50e0f907daff1626661b4934e29a2ae172e8658f7540a0c46311e39ebdcc7094f71c491f6af4341c238d46c1c0af9fd735244998fb848675622ef1ec7121c821bcbddcb02c2f0da5260f294c3a2af2a916e6c902b48d6561e6779b4245bcb6eee9db32cc1baef47a2aa533d825063062b9b8de2620a2fdd1f5f56b42b482cb96de48def81f5d0c2dcdb4638c82a1f1de0cea854f6ca4250ca2c0546c13771ac5b717fa5f7570beef10916ffe5887fd0878f22aa8b2792870e2259ebc0cb1ab2a4e25a56073495a00000000b68d1c9d0001f20180040000985b3f4c3e300d8b020000000001595a"
+	xzARM64 = "fd377a585a0000016922de3604c1d90180040a0021011600000000001751ad53e001ff00d15d0031802d281380348047cece8fb6f326c0c995eca88b9901950f70dc7178203baf33318599d83cbc7acec779ec9d0f7e9a30089791a8ddaa71df5105dcabe1aa2d3a31837fbeb47295ecf8ae6d190d38304eff7a7c1f5e66c8def6049aad04b7e82465dc18ecd0b922cbb3c0249821eb14abe7df3e5ce356ee7460525fbe410e4e6ca505fd5add41821961a51befe724c41fb15f30e173e285c1bfc8e19043057ddd4cf4707f97c6ef31cf69784dab20c4a072632509224a6ae6fa89e13e1e7889f6b804b939e47e0793058004e6ceefec6d000000005963d0bf0001f101800400003629abca3e300d8b020000000001595a"
+	// xz --format=lzma leaves the size unknown and ends with a marker.
+	lzmaTextMarker = "5d00008000ffffffffffffffff00341949ee8def8c6bed3925e7d3f5f66e132a13ffff8d9e0000"
+)
+
+var xzText = bytes.Repeat([]byte("hello, xz. "), 30)
+
+func xzRandom() []byte {
+	random := make([]byte, 100)
+	rand.New(rand.NewSource(1)).Read(random)
+	return random
+}
+
+// xzSeries is 64 little-endian uint32s that grow by about 7.
+func xzSeries() []byte {
+	var series []byte
+	for i := 0; i < 64; i++ {
+		series = binary.LittleEndian.AppendUint32(series, uint32(1000+i*7+i%5))
+	}
+	return series
+}
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestLZMARoundTrip(t *testing.T) {
+	random := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 2000)
+	// Words drawn at random, so that the parser has choices to make.
+	words := []string{"alpha ", "beta ", "gamma ", "delta ", "epsilon ", "zeta "}
+	r := rand.New(rand.NewSource(2))
+	var mixed []byte
+	for len(mixed) < 100*1024 {
+		mixed = append(mixed, words[r.Intn(len(words))]...)
+	}
+
+	roundTrip(t, []string{"lzma", "lzma:lc=0:lp=2:pb=0", "lzma:lc=8:pb=4", "lzma:dict=4k:nice=8", "lzma:nice=273"},
+		map[string][]byte{"random": random, "text": text, "mixed": mixed, "1MB": largeInput(), "a": []byte("a")})
+
+	// The words are close to random, but lzma still needs 40% less than
+	// LZW for them.
+	lzma, _ := NewLZMACompressor(DefaultLZMAOptions).Compress(mixed)
+	lzw, _ := NewLZWCompressor().Compress(mixed)
+	if len(lzma)*5 > len(lzw)*3 {
+		t.Errorf("lzma output %d bytes, lzw %d", len(lzma), len(lzw))
+	}
+}
+
+func TestLZMAParams(t *testing.T) {
+	for _, spec := range []string{"lzma:dict=1k", "lzma:lc=9", "lzma:lp=5", "lzma:pb=-1", "lzma:nice=300", "lzma:level=9"} {
+		if _, err := ParseChain(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestLZMAReadsMarker(t *testing.T) {
+	got, err := NewLZMACompressor(DefaultLZMAOptions).Decompress(unhex(t, lzmaTextMarker))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, xzText) {
+		t.Errorf("got %q", got)
+	}
+}
+
+// The dictionary sizes in the headers xz --format=lzma --lzma1=dict=n wrote
+// for these n; xz refuses to read any other.
+func TestLZMAHeaderDict(t *testing.T) {
+	for _, tt := range []struct {
+		n    int
+		want string
+	}{
+		{5000, "00180000"},
+		{6144, "00180000"},
+		{7000, "00200000"},
+		{100000, "00000200"},
+	} {
+		data := bytes.Repeat(xzText, tt.n/len(xzText)+1)[:tt.n]
+		out, err := NewLZMACompressor(DefaultLZMAOptions).Compress(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(out[1:5]); got != tt.want {
+			t.Errorf("%d bytes: dictionary size %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeXZ(t *testing.T) {
+	text, random := xzText, xzRandom()
+	for _, tc := range []struct {
+		name string
+		file []byte
+		want []byte
+	}{
+		{"crc64", unhex(t, xzTextCRC64), text},
+		{"none", unhex(t, xzTextNone), text},
+		{"blocks", unhex(t, xzTextBlocks), text},
+		{"sha256 stored", unhex(t, xzRandomSHA256), random},
+		{"delta", unhex(t, xzSeriesDelta), xzSeries()},
+		{"x86", unhex(t, xzX86), x86Code(512)},
+		{"arm64", unhex(t, xzARM64), arm64Code(512)},
+		{"concatenated", append(append(unhex(t, xzTextCRC64), 0, 0, 0, 0), unhex(t, xzRandomSHA256)...), append(text, random...)},
+	} {
+		if !IsXZ(tc.file) {
+			t.Errorf("%s: IsXZ = false", tc.name)
+		}
+		got, err := DecodeXZ(context.Background(), tc.file, DefaultLimits)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: got %q", tc.name, got)
+		}
+	}
+}
+
+func TestDecodeXZErrors(t *testing.T) {
+	file := unhex(t, xzTextCRC64)
+	flipped := bytes.Clone(file)
+	flipped[60] ^= 1 // the first byte of the block's CRC64
+
+	for _, tc := range []struct {
+		name   string
+		file   []byte
+		limits Limits
+		want   error
+	}{
+		{"truncated", file[:len(file)-5], DefaultLimits, ErrTruncated},
+		{"check", flipped, DefaultLimits, ErrChecksum},
+		{"trailing", append(bytes.Clone(file), 1, 2, 3, 4), DefaultLimits, ErrCorrupt},
+		{"limit", file, Limits{MaxOutput: 100}, ErrOutputLimit},
+	} {
+		_, err := DecodeXZ(context.Background(), tc.file, tc.limits)
+		var de *DataError
+		if !errors.Is(err, tc.want) || !errors.As(err, &de) || de.Stage != "xz" {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
@@ -2,124 +2,369 @@
 package compress
 
 import (
-	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
+	"slices"
+	"sync"
 )
 
+func init() {
+	Register("lzw", 1, func(p Params) (Compressor, error) {
+		if err := p.Allow("dict"); err != nil {
+			return nil, err
+		}
+		dict, err := p.Dict("dict")
+		if err != nil {
+			return nil, err
+		}
+		return NewLZWDictCompressor(dict), nil
+	})
+}
+
+// maxLZWCodes is the number of codes that fit the 16-bit output. Once the
+// dictionary holds that many, it stops growing.
+const maxLZWCodes = 1 << 16
+
+// lzwSlots is the size of the dictionary's hash table, twice the number of
+// codes so probe sequences stay short.
+const lzwSlots = 2 * maxLZWCodes
+
+type lzwSlot struct {
+	key   uint32 // prefix code << 8 | byte
+	epoch uint32 // the slot is in use if this is the dictionary's epoch
+	code  uint16
+}
+
+// Dictionary maps a (prefix code, byte) pair to the code of the string the
+// prefix extends by that byte. Codes 0 to 255 are the single bytes and are
+// not stored. It is an open-addressing hash table of fixed size, so its
+// memory is bounded and Reset does not clear it: slots of an older epoch
+// count as empty. A dictionary seeded with the strings of a SharedDict
+// looks them up in a shared, read-only Dictionary before its own slots.
 type Dictionary struct {
-	entries  map[string]int
+	slots    []lzwSlot
+	epoch    uint32
 	nextCode int
+	base     *Dictionary
 }
 
 func NewDictionary() *Dictionary {
-	dict := &Dictionary{
-		entries:  make(map[string]int),
-		nextCode: 256, // Reserve first 256 codes for single bytes
+	dict := &Dictionary{slots: make([]lzwSlot, lzwSlots)}
+	dict.Reset()
+	return dict
+}
+
+// Reset empties the dictionary back to the single bytes.
+func (d *Dictionary) Reset() {
+	d.epoch++
+	if d.epoch == 0 {
+		clear(d.slots)
+		d.epoch = 1
+	}
+	d.nextCode = 256 // Reserve first 256 codes for single bytes
+	d.base = nil
+}
+
+// seed makes the strings of base, which must not change, the first codes
+// after the single bytes. It follows a Reset.
+func (d *Dictionary) seed(base *Dictionary) {
+	d.base, d.nextCode = base, base.nextCode
+}
+
+// find returns the slot of (prefix, b), or the empty slot where it belongs.
+func (d *Dictionary) find(prefix int, b byte) *lzwSlot {
+	key := uint32(prefix)<<8 | uint32(b)
+	i := (key * 2654435761) >> (32 - 17) // Fibonacci hashing into lzwSlots
+	for {
+		slot := &d.slots[i]
+		if slot.epoch != d.epoch || slot.key == key {
+			return slot
+		}
+		i = (i + 1) % lzwSlots
+	}
+}
+
+// lookup returns the code of prefix extended by b.
+func (d *Dictionary) lookup(prefix int, b byte) (int, bool) {
+	if d.base != nil {
+		if code, ok := d.base.lookup(prefix, b); ok {
+			return code, true
+		}
 	}
+	slot := d.find(prefix, b)
+	if slot.epoch != d.epoch {
+		return 0, false
+	}
+	return int(slot.code), true
+}
+
+// add assigns the next code to prefix extended by b, unless the dictionary
+// is full.
+func (d *Dictionary) add(prefix int, b byte) {
+	if d.nextCode >= maxLZWCodes {
+		return
+	}
+	slot := d.find(prefix, b)
+	*slot = lzwSlot{key: uint32(prefix)<<8 | uint32(b), epoch: d.epoch, code: uint16(d.nextCode)}
+	d.nextCode++
+}
+
+// lzwTable is the decoder's dictionary: each code is its prefix code and
+// last byte, so a string is rebuilt by walking back from its last byte.
+type lzwTable struct {
+	prefix [maxLZWCodes]uint16
+	suffix [maxLZWCodes]byte
+	first  [maxLZWCodes]byte
+	length [maxLZWCodes]int32
+}
+
+// maxLZWPresetCodes is the most codes the strings of a SharedDict take,
+// leaving the rest for those of the input.
+const maxLZWPresetCodes = maxLZWCodes * 3 / 4
 
-	// Initialize with single byte sequences
+// lzwPreset holds the strings of a SharedDict as both sides of the lzw
+// stage start with them: a Dictionary for the encoder to seed its own
+// with, and the decoder's table of the same codes.
+type lzwPreset struct {
+	dict  *Dictionary
+	table *lzwTable
+	codes int // the first code after the strings
+}
+
+// newLZWPreset adds the strings LZW finds in two passes over content, the
+// second extending those of the first.
+func newLZWPreset(content []byte) *lzwPreset {
+	p := &lzwPreset{dict: NewDictionary(), table: new(lzwTable)}
+	dict, table := p.dict, p.table
 	for i := 0; i < 256; i++ {
-		dict.entries[string([]byte{byte(i)})] = i
+		table.suffix[i], table.first[i], table.length[i] = byte(i), byte(i), 1
+	}
+	for pass := 0; pass < 2 && len(content) > 0; pass++ {
+		current := int(content[0])
+		for _, b := range content[1:] {
+			if code, ok := dict.lookup(current, b); ok {
+				current = code
+				continue
+			}
+			if dict.nextCode >= maxLZWPresetCodes {
+				break
+			}
+			code := dict.nextCode
+			table.prefix[code] = uint16(current)
+			table.suffix[code] = b
+			table.first[code] = table.first[current]
+			table.length[code] = table.length[current] + 1
+			dict.add(current, b)
+			current = int(b)
+		}
 	}
+	p.codes = dict.nextCode
+	return p
+}
 
-	return dict
+// lzwPreset returns the strings of d, found on first use.
+func (d *SharedDict) lzwPreset() *lzwPreset {
+	d.lzwOnce.Do(func() { d.lzw = newLZWPreset(d.Content) })
+	return d.lzw
 }
 
+var (
+	lzwDictPool  = sync.Pool{New: func() any { return NewDictionary() }}
+	lzwTablePool = sync.Pool{New: func() any { return new(lzwTable) }}
+)
+
 type LZWCompressor struct {
-	dict *Dictionary
+	limiter
+	dict   *Dictionary
+	table  *lzwTable
+	preset *SharedDict
 }
 
 func NewLZWCompressor() *LZWCompressor {
-	return &LZWCompressor{
-		dict: NewDictionary(),
+	return &LZWCompressor{limiter: limiter{DefaultLimits}}
+}
+
+// NewLZWDictCompressor returns an lzw stage whose dictionary starts with
+// the strings of preset, for inputs too small to build a useful one of
+// their own. Its output starts with the ID of preset. A nil preset gives
+// the plain stage.
+func NewLZWDictCompressor(preset *SharedDict) *LZWCompressor {
+	return &LZWCompressor{limiter: limiter{DefaultLimits}, preset: preset}
+}
+
+// Reset returns the dictionaries to the pool and restores DefaultLimits.
+func (lzw *LZWCompressor) Reset() {
+	if lzw.dict != nil {
+		lzwDictPool.Put(lzw.dict)
+		lzw.dict = nil
+	}
+	if lzw.table != nil {
+		lzwTablePool.Put(lzw.table)
+		lzw.table = nil
 	}
+	lzw.limiter.Reset()
+}
+
+func (lzw *LZWCompressor) clearScratch() {
+	lzw.dict = nil
+	lzw.table = nil
 }
 
 func (lzw *LZWCompressor) Compress(data []byte) ([]byte, error) {
-	if len(data) == 0 {
-		return nil, nil
-	}
+	return compressOnce(context.Background(), lzw, data)
+}
 
-	dict := NewDictionary()
-	current := []byte{}
-	result := []int{}
+func (lzw *LZWCompressor) Decompress(compressed []byte) ([]byte, error) {
+	return decompressOnce(context.Background(), lzw, compressed)
+}
 
-	for _, b := range data {
-		probe := append(current, b)
+func (lzw *LZWCompressor) CompressContext(ctx context.Context, data []byte) ([]byte, error) {
+	return compressOnce(ctx, lzw, data)
+}
 
-		if _, exists := dict.entries[string(probe)]; exists {
-			current = probe
-		} else {
-			result = append(result, dict.entries[string(current)])
-			dict.entries[string(probe)] = dict.nextCode
-			dict.nextCode++
-			current = []byte{b}
-		}
+func (lzw *LZWCompressor) DecompressContext(ctx context.Context, compressed []byte) ([]byte, error) {
+	return decompressOnce(ctx, lzw, compressed)
+}
+
+func (lzw *LZWCompressor) AppendCompress(dst, src []byte) ([]byte, error) {
+	return lzw.appendCompress(context.Background(), dst, src)
+}
+
+func (lzw *LZWCompressor) AppendDecompress(dst, src []byte) ([]byte, error) {
+	return lzw.appendDecompress(context.Background(), dst, src)
+}
+
+// appendCompress writes one little-endian 16-bit code per dictionary
+// string, after the 32-bit ID of the SharedDict if there is one.
+func (lzw *LZWCompressor) appendCompress(ctx context.Context, dst, data []byte) ([]byte, error) {
+	t := newTracker(ctx, "lzw", len(data))
+	if len(data) == 0 {
+		return dst, nil
 	}
 
-	if len(current) > 0 {
-		result = append(result, dict.entries[string(current)])
+	if lzw.dict == nil {
+		lzw.dict = lzwDictPool.Get().(*Dictionary)
 	}
+	dict := lzw.dict
+	dict.Reset()
 
-	var buf bytes.Buffer
-	for _, code := range result {
-		err := binary.Write(&buf, binary.LittleEndian, uint16(code))
-		if err != nil {
+	result := dst
+	if lzw.preset != nil {
+		dict.seed(lzw.preset.lzwPreset().dict)
+		result = binary.LittleEndian.AppendUint32(result, lzw.preset.ID)
+	}
+	current := int(data[0])
+	for i := 1; i < len(data); i++ {
+		if err := t.update(i); err != nil {
 			return nil, err
 		}
+		b := data[i]
+		if code, ok := dict.lookup(current, b); ok {
+			current = code
+			continue
+		}
+		result = binary.LittleEndian.AppendUint16(result, uint16(current))
+		dict.add(current, b)
+		current = int(b)
 	}
+	result = binary.LittleEndian.AppendUint16(result, uint16(current))
 
-	return buf.Bytes(), nil
+	t.finish()
+	return result, nil
 }
 
-func (lzw *LZWCompressor) Decompress(compressed []byte) ([]byte, error) {
+func (lzw *LZWCompressor) appendDecompress(ctx context.Context, dst, compressed []byte) ([]byte, error) {
+	t := newTracker(ctx, "lzw", len(compressed))
 	if len(compressed) == 0 {
-		return nil, nil
+		return dst, nil
 	}
 
-	codes := make([]int, 0)
-	buf := bytes.NewReader(compressed)
-	for {
-		var code uint16
-		err := binary.Read(buf, binary.LittleEndian, &code)
-		if err != nil {
-			break
+	start := 0
+	if lzw.preset != nil {
+		if len(compressed) < 4 {
+			return nil, truncated("lzw", len(compressed))
 		}
-		codes = append(codes, int(code))
+		if binary.LittleEndian.Uint32(compressed) != lzw.preset.ID {
+			return nil, corrupt("lzw", 0)
+		}
+		start = 4
+	}
+	if (len(compressed)-start)%2 != 0 {
+		return nil, truncated("lzw", len(compressed)-1)
 	}
 
-	dict := make(map[int][]byte)
-	for i := 0; i < 256; i++ {
-		dict[i] = []byte{byte(i)}
+	if lzw.table == nil {
+		lzw.table = lzwTablePool.Get().(*lzwTable)
 	}
+	table := lzw.table
 	nextCode := 256
-
-	result := []byte{}
-
-	if len(codes) == 0 {
-		return result, nil
+	if lzw.preset != nil {
+		p := lzw.preset.lzwPreset()
+		nextCode = p.codes
+		copy(table.prefix[:nextCode], p.table.prefix[:nextCode])
+		copy(table.suffix[:nextCode], p.table.suffix[:nextCode])
+		copy(table.first[:nextCode], p.table.first[:nextCode])
+		copy(table.length[:nextCode], p.table.length[:nextCode])
+	} else {
+		for i := 0; i < 256; i++ {
+			table.suffix[i], table.first[i], table.length[i] = byte(i), byte(i), 1
+		}
 	}
 
-	current := dict[codes[0]]
-	result = append(result, current...)
-
-	for i := 1; i < len(codes); i++ {
-		var word []byte
+	result := dst
+	prev := -1
+	for i := start; i < len(compressed); i += 2 {
+		if err := t.update(i); err != nil {
+			return nil, err
+		}
+		code := int(binary.LittleEndian.Uint16(compressed[i:]))
 
-		if entry, ok := dict[codes[i]]; ok {
-			word = entry
-		} else if codes[i] == nextCode {
-			word = append(current, current[0])
-		} else {
-			return nil, errors.New("invalid compressed data")
+		if prev >= 0 && nextCode < maxLZWCodes {
+			// The new entry is the previous string plus the first byte
+			// of this one, which is the previous string's own first
+			// byte when the code is the entry being defined.
+			last := table.first[prev]
+			if code < nextCode {
+				last = table.first[code]
+			}
+			table.prefix[nextCode] = uint16(prev)
+			table.suffix[nextCode] = last
+			table.first[nextCode] = table.first[prev]
+			table.length[nextCode] = table.length[prev] + 1
+			nextCode++
+		}
+		if code >= nextCode {
+			return nil, corrupt("lzw", i)
 		}
 
-		result = append(result, word...)
-		dict[nextCode] = append(current, word[0])
-		nextCode++
-		current = word
+		n := int(table.length[code])
+		if !lzw.limits.allow(len(compressed), uint64(len(result)-len(dst)+n)) {
+			return nil, tooLarge("lzw", i)
+		}
+		result = slices.Grow(result, n)[:len(result)+n]
+		for j, c := len(result)-1, code; j >= len(result)-n; j-- {
+			result[j] = table.suffix[c]
+			c = int(table.prefix[c])
+		}
+		prev = code
 	}
 
+	t.finish()
 	return result, nil
 }
+
+// legacyLZWCompressor decodes lzw data written before the container header
+// existed. The huffman decoder of that time could leave an odd byte from its
+// padding bits after the codes, which the lzw decoder then ignored.
+type legacyLZWCompressor struct {
+	lzw *LZWCompressor
+}
+
+func (ll legacyLZWCompressor) Compress(data []byte) ([]byte, error) {
+	return nil, errors.New("lzw: the layout of files without a header is only decoded")
+}
+
+func (ll legacyLZWCompressor) Decompress(data []byte) ([]byte, error) {
+	return ll.lzw.Decompress(data[:len(data)&^1])
+}
@@ -0,0 +1,112 @@
+// compress/lzw_test.go
+package compress
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// largeInput is the 1 MB input of the CLI's TestLargeFile.
+func largeInput() []byte {
+	data := make([]byte, 1024*1024)
+	for i := range data {
+		data[i] = byte(i % 256)
+	}
+	return data
+}
+
+// roundTrip checks that every chain in specs gives back each of inputs.
+func roundTrip(t *testing.T, specs []string, inputs map[string][]byte) {
+	t.Helper()
+	for _, spec := range specs {
+		chain, err := ParseChain(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, data := range inputs {
+			compressed, err := chain.Compress(data)
+			if err != nil {
+				t.Fatalf("%s %s: %v", spec, name, err)
+			}
+			restored, err := chain.Decompress(compressed)
+			if err != nil {
+				t.Fatalf("%s %s: %v", spec, name, err)
+			}
+			if !bytes.Equal(restored, data) {
+				t.Errorf("%s %s: round trip failed", spec, name)
+			}
+		}
+	}
+}
+
+func TestLZWFullDictionary(t *testing.T) {
+	// Random bytes fill all 65536 codes long before the end, so the rest
+	// is coded with a frozen dictionary.
+	random := make([]byte, 512*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 20000)
+
+	lzw := NewLZWCompressor()
+	for name, data := range map[string][]byte{"random": random, "text": text, "1MB": largeInput()} {
+		compressed, err := lzw.Compress(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored, err := lzw.Decompress(compressed)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(restored, data) {
+			t.Errorf("%s: round trip failed", name)
+		}
+	}
+}
+
+func TestLZWKnownOutput(t *testing.T) {
+	// The format is unchanged from the string-keyed dictionary: codes of
+	// the classic example, with "TO" as 256, "OB" as 257 and so on.
+	compressed, err := NewLZWCompressor().Compress([]byte("TOBEORNOTTOBEORTOBEORNOT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint16{'T', 'O', 'B', 'E', 'O', 'R', 'N', 'O', 'T', 256, 258, 260, 265, 259, 261, 263}
+	if len(compressed) != 2*len(want) {
+		t.Fatalf("got %d codes, want %d", len(compressed)/2, len(want))
+	}
+	for i, code := range want {
+		if got := uint16(compressed[2*i]) | uint16(compressed[2*i+1])<<8; got != code {
+			t.Errorf("code %d = %d, want %d", i, got, code)
+		}
+	}
+}
+
+func BenchmarkLZW1MB(b *testing.B) {
+	data := largeInput()
+	lzw := NewLZWCompressor()
+	compressed, err := lzw.Compress(data)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("compress", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		var dst []byte
+		for i := 0; i < b.N; i++ {
+			if dst, err = lzw.AppendCompress(dst[:0], data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("decompress", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		var dst []byte
+		for i := 0; i < b.N; i++ {
+			if dst, err = lzw.AppendDecompress(dst[:0], compressed); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,111 @@
+// compress/pool.go
+package compress
+
+import "context"
+
+// Appender is implemented by stages that append their output to a buffer
+// supplied by the caller. Together with the scratch space stages keep
+// between calls, reusing dst lets a stage compress many small inputs
+// without allocating.
+type Appender interface {
+	AppendCompress(dst, src []byte) ([]byte, error)
+	AppendDecompress(dst, src []byte) ([]byte, error)
+}
+
+// Resetter is implemented by stages that keep scratch space between calls
+// to AppendCompress and AppendDecompress. Reset returns it to a shared
+// sync.Pool and restores DefaultLimits, so an idle stage holds no memory
+// and can be pooled.
+//
+// Because of that scratch space, a stage or chain must not be used by
+// several goroutines at once through AppendCompress or AppendDecompress;
+// build one per goroutine, or keep them in a sync.Pool and Reset them
+// before putting them back. Compress, Decompress and their Context forms
+// keep nothing: they take scratch space from the pool and hand it back on
+// each call, so they may be called from several goroutines at once.
+type Resetter interface {
+	Reset()
+}
+
+// stageAppender is the common implementation behind Compress,
+// CompressContext and AppendCompress of the built-in stages.
+type stageAppender interface {
+	appendCompress(ctx context.Context, dst, src []byte) ([]byte, error)
+	appendDecompress(ctx context.Context, dst, src []byte) ([]byte, error)
+}
+
+// appendCompress runs c on src under ctx and appends the output to dst.
+func appendCompress(ctx context.Context, c Compressor, dst, src []byte) ([]byte, error) {
+	if a, ok := c.(stageAppender); ok {
+		return a.appendCompress(ctx, dst, src)
+	}
+	out, err := CompressContext(ctx, c, src)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, out...), nil
+}
+
+// appendDecompress reverses appendCompress.
+func appendDecompress(ctx context.Context, c Compressor, dst, src []byte) ([]byte, error) {
+	if a, ok := c.(stageAppender); ok {
+		return a.appendDecompress(ctx, dst, src)
+	}
+	out, err := DecompressContext(ctx, c, src)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, out...), nil
+}
+
+// scratchClearer is implemented by stages that keep scratch space.
+// clearScratch drops the stage's references to it without returning it to
+// the pool, on a copy that must not share the original's.
+type scratchClearer interface {
+	clearScratch()
+}
+
+// onceStage is a pointer to a stage that compressOnce can copy.
+type onceStage[T any] interface {
+	*T
+	stageAppender
+	Resetter
+	scratchClearer
+}
+
+// compressOnce runs a copy of s without its scratch space, and hands the
+// scratch space the copy took back to the pool, so that s is unchanged.
+func compressOnce[T any, S onceStage[T]](ctx context.Context, s S, src []byte) ([]byte, error) {
+	c := S(new(T))
+	*c = *s
+	c.clearScratch()
+	defer c.Reset()
+	return c.appendCompress(ctx, nil, src)
+}
+
+// decompressOnce reverses compressOnce.
+func decompressOnce[T any, S onceStage[T]](ctx context.Context, s S, src []byte) ([]byte, error) {
+	c := S(new(T))
+	*c = *s
+	c.clearScratch()
+	defer c.Reset()
+	return c.appendDecompress(ctx, nil, src)
+}
+
+// compressStage and decompressStage run c without it keeping scratch
+// space, appending to dst, for the chain's Compress and Decompress.
+func compressStage(ctx context.Context, c Compressor, dst, src []byte) ([]byte, error) {
+	out, err := CompressContext(ctx, c, src)
+	if err != nil || dst == nil {
+		return out, err
+	}
+	return append(dst, out...), nil
+}
+
+func decompressStage(ctx context.Context, c Compressor, dst, src []byte) ([]byte, error) {
+	out, err := DecompressContext(ctx, c, src)
+	if err != nil || dst == nil {
+		return out, err
+	}
+	return append(dst, out...), nil
+}
@@ -0,0 +1,158 @@
+// compress/pool_test.go
+package compress
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+// payload is a small, compressible message like the ones a server
+// compresses many times a second.
+var payload = bytes.Repeat([]byte(`{"id":1234,"status":"ok","items":["alpha","beta"]} `), 20)
+
+func TestAppendAllocs(t *testing.T) {
+	if testing.Short() {
+		t.Skip("allocation counts need a warmed-up run")
+	}
+	dict := trainedDict(t).String()
+	for _, spec := range []string{"store", "rle", "huffman", "bwt", "bwt,rle,huffman", "lzw:dict=" + dict, "huffman:dict=" + dict} {
+		chain, err := ParseChain(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed, err := chain.AppendCompress(nil, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored, err := chain.AppendDecompress(nil, compressed)
+		if err != nil || !bytes.Equal(restored, payload) {
+			t.Fatalf("%s: round trip failed: %v", spec, err)
+		}
+
+		allocs := testing.AllocsPerRun(100, func() {
+			compressed, _ = chain.AppendCompress(compressed[:0], payload)
+		})
+		if allocs != 0 {
+			t.Errorf("%s: AppendCompress allocates %.1f times per call, want 0", spec, allocs)
+		}
+		allocs = testing.AllocsPerRun(100, func() {
+			restored, _ = chain.AppendDecompress(restored[:0], compressed)
+		})
+		if allocs != 0 {
+			t.Errorf("%s: AppendDecompress allocates %.1f times per call, want 0", spec, allocs)
+		}
+	}
+}
+
+// Compress and Decompress keep no scratch space, so one chain may serve
+// several goroutines at once. Run with -race.
+func TestConcurrentCompress(t *testing.T) {
+	dict := trainedDict(t).String()
+	chain, err := ParseChain("bwt,lzw,huffman,ppm:mem=1m,cm:mem=1m,lzma:dict=64k,huffman:dict=" + dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := append(bytes.Repeat([]byte{byte('a' + i)}, i*100), payload...)
+			for j := 0; j < 5; j++ {
+				compressed, err := chain.Compress(data)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				restored, err := chain.Decompress(compressed)
+				if err != nil || !bytes.Equal(restored, data) {
+					t.Errorf("goroutine %d: round trip failed: %v", i, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestReset(t *testing.T) {
+	chain, err := ParseChain("bwt,rle,huffman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := chain.Compress(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain.SetLimits(Limits{MaxOutput: 1})
+	chain.Reset()
+	got, err := chain.AppendCompress([]byte("prefix"), payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:6], []byte("prefix")) || !bytes.Equal(got[6:], want) {
+		t.Error("AppendCompress after Reset differs from Compress")
+	}
+	if _, err := chain.Decompress(want); err != nil {
+		t.Errorf("Reset did not restore DefaultLimits: %v", err)
+	}
+}
+
+func BenchmarkCompress(b *testing.B) {
+	for _, spec := range []string{"store", "rle", "huffman", "sf", "lzw", "bwt", "lzma", "ppm", "cm:mem=1m", "delta:stride=4", "bcj", "bwt,rle,huffman"} {
+		chain, err := ParseChain(spec)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(spec, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(payload)))
+			for i := 0; i < b.N; i++ {
+				if _, err := chain.Compress(payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(spec+"/append", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(payload)))
+			var dst []byte
+			for i := 0; i < b.N; i++ {
+				if dst, err = chain.AppendCompress(dst[:0], payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(testing.AllocsPerRun(10, func() {
+				dst, _ = chain.AppendCompress(dst[:0], payload)
+			}), "steady-allocs/op")
+		})
+	}
+}
+
+func BenchmarkDecompress(b *testing.B) {
+	for _, spec := range []string{"store", "rle", "huffman", "sf", "lzw", "bwt", "lzma", "ppm", "cm:mem=1m", "delta:stride=4", "bcj", "bwt,rle,huffman"} {
+		chain, err := ParseChain(spec)
+		if err != nil {
+			b.Fatal(err)
+		}
+		compressed, err := chain.Compress(payload)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(spec+"/append", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(payload)))
+			var dst []byte
+			for i := 0; i < b.N; i++ {
+				if dst, err = chain.AppendDecompress(dst[:0], compressed); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(testing.AllocsPerRun(10, func() {
+				dst, _ = chain.AppendDecompress(dst[:0], compressed)
+			}), "steady-allocs/op")
+		})
+	}
+}
@@ -0,0 +1,578 @@
+// compress/ppm.go
+package compress
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+func init() {
+	Register("ppm", 7, func(p Params) (Compressor, error) {
+		if err := p.Allow("order", "mem", "escape"); err != nil {
+			return nil, err
+		}
+		opts := DefaultPPMOptions
+		var err error
+		if opts.Order, err = p.Int("order", opts.Order); err != nil {
+			return nil, err
+		}
+		if opts.MemLimit, err = p.Size("mem", opts.MemLimit); err != nil {
+			return nil, err
+		}
+		if name, ok := p["escape"]; ok {
+			if opts.Escape, err = ParsePPMEscape(name); err != nil {
+				return nil, err
+			}
+		}
+		if err := opts.validate(); err != nil {
+			return nil, err
+		}
+		return NewPPMCompressor(opts), nil
+	})
+}
+
+// PPMEscape is how the ppm stage estimates the chance that a context has
+// not seen the next byte before.
+type PPMEscape byte
+
+const (
+	// PPMEscapeC counts an escape for each distinct byte of the context,
+	// and one for each time a byte was seen (method C).
+	PPMEscapeC PPMEscape = iota + 1
+	// PPMEscapeD counts half an escape for each distinct byte (method D).
+	PPMEscapeD
+	// PPMEscapeSEE learns the escape rate of contexts with similar
+	// statistics as they are coded (secondary escape estimation, as in
+	// PPMd).
+	PPMEscapeSEE
+)
+
+var ppmEscapeNames = []string{PPMEscapeC: "c", PPMEscapeD: "d", PPMEscapeSEE: "see"}
+
+func (e PPMEscape) String() string {
+	if int(e) < len(ppmEscapeNames) && ppmEscapeNames[e] != "" {
+		return ppmEscapeNames[e]
+	}
+	return fmt.Sprintf("PPMEscape(%d)", byte(e))
+}
+
+// ParsePPMEscape parses "c", "d" or "see".
+func ParsePPMEscape(name string) (PPMEscape, error) {
+	for e, n := range ppmEscapeNames {
+		if n != "" && n == name {
+			return PPMEscape(e), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown escape method %q (use c, d or see)", name)
+}
+
+// PPMOptions configures the ppm stage.
+type PPMOptions struct {
+	// Order is the number of preceding bytes of the longest context.
+	Order int
+	// MemLimit bounds the memory of the context tree in bytes. When the
+	// tree reaches it, the model starts again from an empty tree.
+	MemLimit int
+	// Escape is the escape estimation method.
+	Escape PPMEscape
+}
+
+// DefaultPPMOptions are the settings of a plain "ppm" stage.
+var DefaultPPMOptions = PPMOptions{Order: 5, MemLimit: 16 << 20, Escape: PPMEscapeSEE}
+
+const (
+	maxPPMOrder = 16
+	minPPMMem   = 64 << 10
+	maxPPMMem   = 1 << 30
+)
+
+func (o PPMOptions) validate() error {
+	switch {
+	case o.Order < 1 || o.Order > maxPPMOrder:
+		return fmt.Errorf("order must be between 1 and %d", maxPPMOrder)
+	case o.MemLimit < minPPMMem || o.MemLimit > maxPPMMem:
+		return fmt.Errorf("mem must be between %d and %d", minPPMMem, maxPPMMem)
+	case o.Escape < PPMEscapeC || o.Escape > PPMEscapeSEE:
+		return fmt.Errorf("unknown escape method %d", o.Escape)
+	}
+	return nil
+}
+
+// ppmContext is a string of up to Order bytes and the bytes that have
+// followed it.
+type ppmContext struct {
+	first  int32  // the first of its symbols, -1 if none
+	suffix int32  // the context one byte shorter, -1 for the empty one
+	sum    uint32 // of the counts of its symbols
+	order  uint8
+}
+
+// ppmSymbol is a byte that followed a context, in a list ordered roughly
+// by count.
+type ppmSymbol struct {
+	next  int32 // -1 at the end of the list
+	child int32 // the context extended by this byte, -1 until needed
+	count uint16
+	sym   byte
+}
+
+// The sizes of ppmContext and ppmSymbol, for the memory limit.
+const (
+	ppmContextSize = 16
+	ppmSymbolSize  = 12
+)
+
+const (
+	// Counts are halved when one passes ppmMaxCount or their sum passes
+	// ppmMaxSum, so that the model follows changes in the data and totals
+	// stay within what the range coder can code.
+	ppmMaxCount = 1 << 10
+	ppmMaxSum   = 1 << 15
+	// seeBits is the precision of the escape probabilities of SEE.
+	seeBits = 12
+)
+
+// ppmModel is the context tree, shared in structure by the encoder and the
+// decoder, which update it in the same way after each byte.
+type ppmModel struct {
+	opts     PPMOptions
+	contexts []ppmContext
+	symbols  []ppmSymbol
+	ctx      int32   // the longest context of the current position
+	path     []int32 // contexts that lacked the byte being coded
+	excluded [256]uint32
+	stamp    uint32 // excluded[b] == stamp if b is excluded for this byte
+	see      [16][8][4]uint16
+	seeBin   *uint16 // the SEE probability of the last escape decision
+}
+
+func (m *ppmModel) init(opts PPMOptions) {
+	m.opts = opts
+	for i := range m.see {
+		for j := range m.see[i] {
+			for k := range m.see[i][j] {
+				m.see[i][j][k] = 1 << (seeBits - 2)
+			}
+		}
+	}
+	m.restart()
+}
+
+// restart empties the context tree, at the start and when it reaches the
+// memory limit. The SEE statistics are kept.
+func (m *ppmModel) restart() {
+	m.contexts = append(m.contexts[:0], ppmContext{first: -1, suffix: -1})
+	m.symbols = m.symbols[:0]
+	m.ctx = 0
+}
+
+func (m *ppmModel) size() int {
+	return len(m.contexts)*ppmContextSize + len(m.symbols)*ppmSymbolSize
+}
+
+// begin starts coding a byte, with no contexts visited and none excluded.
+func (m *ppmModel) begin() {
+	m.path = m.path[:0]
+	m.stamp++
+	if m.stamp == 0 {
+		clear(m.excluded[:])
+		m.stamp = 1
+	}
+}
+
+// scan sums the counts of the symbols of c that are not excluded.
+func (m *ppmModel) scan(c int32) (sum, n uint32) {
+	for i := m.contexts[c].first; i >= 0; i = m.symbols[i].next {
+		s := &m.symbols[i]
+		if m.excluded[s.sym] != m.stamp {
+			sum += uint32(s.count)
+			n++
+		}
+	}
+	return sum, n
+}
+
+// escapeCount is the count of an escape from c, whose n symbols not
+// excluded have counts summing to sum.
+func (m *ppmModel) escapeCount(c int32, sum, n uint32) uint32 {
+	switch m.opts.Escape {
+	case PPMEscapeC, PPMEscapeD:
+		return n
+	}
+	order := min(int(m.contexts[c].order), 7)
+	var avg int
+	switch mean := sum / n; {
+	case mean <= 2:
+		avg = 0
+	case mean <= 6:
+		avg = 1
+	case mean <= 20:
+		avg = 2
+	default:
+		avg = 3
+	}
+	m.seeBin = &m.see[min(n-1, 15)][order][avg]
+	p := uint32(*m.seeBin)
+	esc := uint64(p) * uint64(sum) / uint64(1<<seeBits-p)
+	return uint32(max(min(esc, 1<<14), 1))
+}
+
+// escaped updates SEE with the outcome of the last escape decision.
+func (m *ppmModel) escaped(escape bool) {
+	if m.opts.Escape != PPMEscapeSEE {
+		return
+	}
+	p := *m.seeBin
+	if escape {
+		p += (1<<seeBits - p) >> 5
+	} else {
+		p -= p >> 5
+	}
+	*m.seeBin = max(p, 1)
+}
+
+// exclude marks the symbols of c, which the byte is not among.
+func (m *ppmModel) exclude(c int32) {
+	for i := m.contexts[c].first; i >= 0; i = m.symbols[i].next {
+		m.excluded[m.symbols[i].sym] = m.stamp
+	}
+}
+
+// update records byte b, found as symbol i (after prev in its list) of
+// context c, or with c -1 coded in order -1. The contexts on m.path lacked
+// it and gain it.
+func (m *ppmModel) update(c, i, prev int32, b byte) {
+	inc := uint16(2)
+	if m.opts.Escape == PPMEscapeC {
+		inc = 1
+	}
+	if c >= 0 {
+		ctx := &m.contexts[c]
+		s := &m.symbols[i]
+		s.count += inc
+		ctx.sum += uint32(inc)
+		count := s.count
+		if prev >= 0 && count > m.symbols[prev].count {
+			// Move it forwards, so frequent symbols are found sooner.
+			p := &m.symbols[prev]
+			p.sym, s.sym = s.sym, p.sym
+			p.count, s.count = s.count, p.count
+			p.child, s.child = s.child, p.child
+		}
+		if count > ppmMaxCount || ctx.sum > ppmMaxSum {
+			m.rescale(c)
+		}
+	}
+	for _, p := range m.path {
+		ctx := &m.contexts[p]
+		m.symbols = append(m.symbols, ppmSymbol{next: ctx.first, child: -1, count: 1, sym: b})
+		ctx.first = int32(len(m.symbols) - 1)
+		ctx.sum++
+	}
+
+	top := m.ctx
+	if int(m.contexts[top].order) == m.opts.Order {
+		top = m.contexts[top].suffix
+	}
+	m.ctx = m.child(top, b)
+	if m.size() > m.opts.MemLimit {
+		m.restart()
+	}
+}
+
+// rescale halves the counts of c.
+func (m *ppmModel) rescale(c int32) {
+	var sum uint32
+	for i := m.contexts[c].first; i >= 0; i = m.symbols[i].next {
+		s := &m.symbols[i]
+		s.count = (s.count + 1) / 2
+		sum += uint32(s.count)
+	}
+	m.contexts[c].sum = sum
+}
+
+// child returns context c extended by b, creating it and the shorter
+// contexts it needs as its suffix. c has b among its symbols.
+func (m *ppmModel) child(c int32, b byte) int32 {
+	i := m.contexts[c].first
+	for i >= 0 && m.symbols[i].sym != b {
+		i = m.symbols[i].next
+	}
+	if i < 0 {
+		return 0
+	}
+	if child := m.symbols[i].child; child >= 0 {
+		return child
+	}
+	suffix := int32(0)
+	if c != 0 {
+		suffix = m.child(m.contexts[c].suffix, b)
+	}
+	child := int32(len(m.contexts))
+	m.contexts = append(m.contexts, ppmContext{first: -1, suffix: suffix, order: m.contexts[c].order + 1})
+	m.symbols[i].child = child
+	return child
+}
+
+// encode codes b: in the longest context that has seen it, after an
+// escape from each longer one, or failing that as one of the bytes no
+// context offered.
+func (m *ppmModel) encode(rc *rangeEncoder, b byte) {
+	m.begin()
+	for c := m.ctx; c >= 0; c = m.contexts[c].suffix {
+		sum, n := m.scan(c)
+		if n == 0 {
+			m.path = append(m.path, c)
+			continue
+		}
+		esc := m.escapeCount(c, sum, n)
+		var cum uint32
+		prev := int32(-1)
+		for i := m.contexts[c].first; i >= 0; prev, i = i, m.symbols[i].next {
+			s := &m.symbols[i]
+			if m.excluded[s.sym] == m.stamp {
+				continue
+			}
+			if s.sym == b {
+				rc.encodeFreq(cum, uint32(s.count), sum+esc)
+				m.escaped(false)
+				m.update(c, i, prev, b)
+				return
+			}
+			cum += uint32(s.count)
+		}
+		rc.encodeFreq(sum, esc, sum+esc)
+		m.escaped(true)
+		m.exclude(c)
+		m.path = append(m.path, c)
+	}
+
+	var cum, total uint32
+	for x := 0; x < 256; x++ {
+		if m.excluded[x] != m.stamp {
+			if x < int(b) {
+				cum++
+			}
+			total++
+		}
+	}
+	rc.encodeFreq(cum, 1, total)
+	m.update(-1, -1, -1, b)
+}
+
+// decode reverses encode. It fails only on input no encoder wrote.
+func (m *ppmModel) decode(rd *rangeDecoder) (byte, bool) {
+	m.begin()
+	for c := m.ctx; c >= 0; c = m.contexts[c].suffix {
+		sum, n := m.scan(c)
+		if n == 0 {
+			m.path = append(m.path, c)
+			continue
+		}
+		esc := m.escapeCount(c, sum, n)
+		v := rd.decodeFreq(sum + esc)
+		if v >= sum+esc {
+			return 0, false
+		}
+		if v >= sum {
+			rd.consume(sum, esc)
+			m.escaped(true)
+			m.exclude(c)
+			m.path = append(m.path, c)
+			continue
+		}
+		var cum uint32
+		prev := int32(-1)
+		for i := m.contexts[c].first; i >= 0; prev, i = i, m.symbols[i].next {
+			s := &m.symbols[i]
+			if m.excluded[s.sym] == m.stamp {
+				continue
+			}
+			if v < cum+uint32(s.count) {
+				b := s.sym
+				rd.consume(cum, uint32(s.count))
+				m.escaped(false)
+				m.update(c, i, prev, b)
+				return b, true
+			}
+			cum += uint32(s.count)
+		}
+		return 0, false // unreachable: v < sum
+	}
+
+	var total uint32
+	for x := 0; x < 256; x++ {
+		if m.excluded[x] != m.stamp {
+			total++
+		}
+	}
+	v := rd.decodeFreq(total)
+	var cum uint32
+	for x := 0; x < 256; x++ {
+		if m.excluded[x] == m.stamp {
+			continue
+		}
+		if cum == v {
+			rd.consume(cum, 1)
+			m.update(-1, -1, -1, byte(x))
+			return byte(x), true
+		}
+		cum++
+	}
+	return 0, false
+}
+
+var ppmPool = sync.Pool{New: func() any { return new(ppmModel) }}
+
+// PPMCompressor predicts each byte from the longest context of preceding
+// bytes that has seen it before, escaping to shorter contexts as needed,
+// and codes the prediction with a range coder. The output starts with the
+// order, escape method, memory limit and length, so it decodes whatever
+// the options of the decoding stage.
+type PPMCompressor struct {
+	limiter
+	opts  PPMOptions
+	model *ppmModel
+}
+
+func NewPPMCompressor(opts PPMOptions) *PPMCompressor {
+	return &PPMCompressor{limiter: limiter{DefaultLimits}, opts: opts}
+}
+
+// Reset returns the context tree to the pool and restores DefaultLimits.
+func (ppm *PPMCompressor) Reset() {
+	if ppm.model != nil {
+		ppmPool.Put(ppm.model)
+		ppm.model = nil
+	}
+	ppm.limiter.Reset()
+}
+
+func (ppm *PPMCompressor) scratchSpace() *ppmModel {
+	if ppm.model == nil {
+		ppm.model = ppmPool.Get().(*ppmModel)
+	}
+	return ppm.model
+}
+
+func (ppm *PPMCompressor) clearScratch() {
+	ppm.model = nil
+}
+
+func (ppm *PPMCompressor) Compress(data []byte) ([]byte, error) {
+	return compressOnce(context.Background(), ppm, data)
+}
+
+func (ppm *PPMCompressor) Decompress(compressed []byte) ([]byte, error) {
+	return decompressOnce(context.Background(), ppm, compressed)
+}
+
+func (ppm *PPMCompressor) CompressContext(ctx context.Context, data []byte) ([]byte, error) {
+	return compressOnce(ctx, ppm, data)
+}
+
+func (ppm *PPMCompressor) DecompressContext(ctx context.Context, compressed []byte) ([]byte, error) {
+	return decompressOnce(ctx, ppm, compressed)
+}
+
+func (ppm *PPMCompressor) AppendCompress(dst, src []byte) ([]byte, error) {
+	return ppm.appendCompress(context.Background(), dst, src)
+}
+
+func (ppm *PPMCompressor) AppendDecompress(dst, src []byte) ([]byte, error) {
+	return ppm.appendDecompress(context.Background(), dst, src)
+}
+
+func (ppm *PPMCompressor) appendCompress(ctx context.Context, dst, data []byte) ([]byte, error) {
+	t := newTracker(ctx, "ppm", len(data))
+	if len(data) == 0 {
+		return dst, nil
+	}
+
+	result := append(dst, byte(ppm.opts.Order), byte(ppm.opts.Escape))
+	result = binary.AppendUvarint(result, uint64(ppm.opts.MemLimit))
+	result = binary.AppendUvarint(result, uint64(len(data)))
+
+	m := ppm.scratchSpace()
+	m.init(ppm.opts)
+	var rc rangeEncoder
+	rc.reset(result)
+	for i, b := range data {
+		if err := t.update(i); err != nil {
+			return nil, err
+		}
+		m.encode(&rc, b)
+	}
+	result = rc.flush()
+
+	t.finish()
+	return result, nil
+}
+
+func (ppm *PPMCompressor) appendDecompress(ctx context.Context, dst, compressed []byte) ([]byte, error) {
+	t := newTracker(ctx, "ppm", len(compressed))
+	if len(compressed) == 0 {
+		return dst, nil
+	}
+
+	if len(compressed) < 2 {
+		return nil, truncated("ppm", len(compressed))
+	}
+	opts := PPMOptions{Order: int(compressed[0]), Escape: PPMEscape(compressed[1])}
+	pos := 2
+	mem, n := binary.Uvarint(compressed[pos:])
+	if n <= 0 {
+		return nil, truncated("ppm", len(compressed))
+	}
+	pos += n
+	size, n := binary.Uvarint(compressed[pos:])
+	if n <= 0 {
+		return nil, truncated("ppm", len(compressed))
+	}
+	if mem > maxPPMMem {
+		return nil, corrupt("ppm", 2)
+	}
+	opts.MemLimit = int(mem)
+	if opts.validate() != nil {
+		return nil, corrupt("ppm", 0)
+	}
+	if !ppm.limits.allow(len(compressed), size) || size > maxDecodedSize {
+		return nil, tooLarge("ppm", pos)
+	}
+	pos += n
+
+	var rd rangeDecoder
+	if !rd.init(compressed[pos:]) {
+		if len(compressed)-pos < 5 {
+			return nil, truncated("ppm", len(compressed))
+		}
+		return nil, corrupt("ppm", pos)
+	}
+	m := ppm.scratchSpace()
+	m.init(opts)
+	// The size comes from the input, so only part of it is allocated up
+	// front.
+	result := slices.Grow(dst, min(int(size), maxPrealloc))
+	for i := 0; i < int(size); i++ {
+		if err := t.update(pos + rd.pos); err != nil {
+			return nil, err
+		}
+		if rd.overrun() {
+			return nil, truncated("ppm", len(compressed))
+		}
+		b, ok := m.decode(&rd)
+		if !ok {
+			return nil, corrupt("ppm", pos+min(rd.pos, len(rd.data)))
+		}
+		result = append(result, b)
+	}
+	if rd.overrun() {
+		return nil, truncated("ppm", len(compressed))
+	}
+
+	t.finish()
+	return result, nil
+}
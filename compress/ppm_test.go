@@ -0,0 +1,94 @@
+// compress/ppm_test.go
+package compress
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// logCorpus is n bytes of application logs and JSON records, the kind of
+// text ppm is meant for.
+func logCorpus(n int) []byte {
+	r := rand.New(rand.NewSource(3))
+	levels := []string{"INFO", "INFO", "INFO", "DEBUG", "WARN", "ERROR"}
+	messages := []string{
+		"request completed", "cache miss for key", "connection reset by peer",
+		"retrying upstream call", "user logged in", "slow query detected",
+	}
+	paths := []string{"/api/v1/users", "/api/v1/orders", "/healthz", "/api/v1/search", "/static/app.js"}
+	var b bytes.Buffer
+	for b.Len() < n {
+		ts := fmt.Sprintf("2024-03-%02dT%02d:%02d:%02d.%03dZ", 1+r.Intn(28), r.Intn(24), r.Intn(60), r.Intn(60), r.Intn(1000))
+		if r.Intn(3) == 0 {
+			fmt.Fprintf(&b, `{"time":%q,"level":%q,"path":%q,"status":%d,"duration_ms":%d,"user_id":%d}`+"\n",
+				ts, levels[r.Intn(len(levels))], paths[r.Intn(len(paths))], []int{200, 200, 200, 404, 500}[r.Intn(5)], r.Intn(2000), r.Intn(100000))
+		} else {
+			fmt.Fprintf(&b, "%s %-5s [worker-%d] %s path=%s latency=%dms\n",
+				ts, levels[r.Intn(len(levels))], r.Intn(16), messages[r.Intn(len(messages))], paths[r.Intn(len(paths))], r.Intn(2000))
+		}
+	}
+	return b.Bytes()[:n]
+}
+
+func TestPPMRoundTrip(t *testing.T) {
+	random := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	logs := logCorpus(256 * 1024)
+
+	// mem=64k makes the model start again many times.
+	roundTrip(t, []string{"ppm", "ppm:order=1", "ppm:order=16", "ppm:escape=c", "ppm:escape=d:order=3", "ppm:mem=64k", "bwt,ppm"},
+		map[string][]byte{"random": random, "logs": logs, "1MB": largeInput(), "a": []byte("a")})
+
+	// The header carries the options, so any ppm stage decodes the output.
+	compressed, _ := NewPPMCompressor(PPMOptions{Order: 3, MemLimit: 1 << 20, Escape: PPMEscapeC}).Compress(logs)
+	restored, err := NewPPMCompressor(DefaultPPMOptions).Decompress(compressed)
+	if err != nil || !bytes.Equal(restored, logs) {
+		t.Errorf("decoding with other options: %v", err)
+	}
+}
+
+// On logs ppm beats bwt,huffman by a wide margin.
+func TestPPMRatio(t *testing.T) {
+	logs := logCorpus(256 * 1024)
+	ppm, _ := NewPPMCompressor(DefaultPPMOptions).Compress(logs)
+	chain, _ := ParseChain("bwt,huffman")
+	bwt, _ := chain.Compress(logs)
+	if len(ppm)*3 > len(bwt)*2 {
+		t.Errorf("ppm output %d bytes, bwt,huffman %d", len(ppm), len(bwt))
+	}
+}
+
+func TestPPMParams(t *testing.T) {
+	for _, spec := range []string{"ppm:order=0", "ppm:order=17", "ppm:mem=1k", "ppm:mem=2g", "ppm:escape=a", "ppm:level=9"} {
+		if _, err := ParseChain(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+	for _, e := range []PPMEscape{PPMEscapeC, PPMEscapeD, PPMEscapeSEE} {
+		if got, err := ParsePPMEscape(e.String()); err != nil || got != e {
+			t.Errorf("ParsePPMEscape(%q) = %v, %v", e, got, err)
+		}
+	}
+}
+
+// BenchmarkPPMRatio compares ppm with cm, lzma and bwt chains on logs,
+// reporting the compressed size in percent of the input.
+func BenchmarkPPMRatio(b *testing.B) {
+	logs := logCorpus(1 << 20)
+	for _, spec := range []string{"ppm", "ppm:order=3", "ppm:escape=d", "bwt:block=900k,rle,huffman", "bwt,huffman", "lzma", "cm"} {
+		chain, err := ParseChain(spec)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(spec, func(b *testing.B) {
+			b.SetBytes(int64(len(logs)))
+			var compressed []byte
+			for i := 0; i < b.N; i++ {
+				compressed, _ = chain.AppendCompress(compressed[:0], logs)
+			}
+			b.ReportMetric(100*float64(len(compressed))/float64(len(logs)), "%size")
+		})
+	}
+}
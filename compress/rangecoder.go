@@ -0,0 +1,271 @@
+// compress/rangecoder.go
+package compress
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// The range coder codes one bit at a time under an adaptive probability,
+// the scheme of LZMA: a prob is the chance, out of 2048, that the next bit
+// in its context is 0, and moves 1/32 of the way towards each bit coded
+// with it.
+const (
+	probBits     = 11
+	probInit     = 1 << (probBits - 1)
+	probMoveBits = 5
+	rcTop        = 1 << 24
+)
+
+type prob uint16
+
+func initProbs(probs []prob) {
+	for i := range probs {
+		probs[i] = probInit
+	}
+}
+
+type rangeEncoder struct {
+	out       []byte
+	low       uint64
+	rng       uint32
+	cache     byte
+	cacheSize int
+}
+
+// reset starts a new stream appended to out.
+func (e *rangeEncoder) reset(out []byte) {
+	*e = rangeEncoder{out: out, rng: 0xFFFFFFFF, cacheSize: 1}
+}
+
+func (e *rangeEncoder) encodeBit(p *prob, bit uint32) {
+	bound := (e.rng >> probBits) * uint32(*p)
+	if bit == 0 {
+		e.rng = bound
+		*p += (1<<probBits - *p) >> probMoveBits
+	} else {
+		e.low += uint64(bound)
+		e.rng -= bound
+		*p -= *p >> probMoveBits
+	}
+	if e.rng < rcTop {
+		e.rng <<= 8
+		e.shiftLow()
+	}
+}
+
+// encodeDirect codes the low n bits of v, most significant first, each
+// with probability one half.
+func (e *rangeEncoder) encodeDirect(v uint32, n uint) {
+	for ; n > 0; n-- {
+		e.rng >>= 1
+		if v>>(n-1)&1 != 0 {
+			e.low += uint64(e.rng)
+		}
+		if e.rng < rcTop {
+			e.rng <<= 8
+			e.shiftLow()
+		}
+	}
+}
+
+// encodeTree codes the low n bits of v most significant first, each under
+// the prob its preceding bits select.
+func (e *rangeEncoder) encodeTree(probs []prob, n uint, v uint32) {
+	m := uint32(1)
+	for ; n > 0; n-- {
+		bit := v >> (n - 1) & 1
+		e.encodeBit(&probs[m], bit)
+		m = m<<1 | bit
+	}
+}
+
+// encodeReverse is encodeTree with the bits taken least significant first.
+func (e *rangeEncoder) encodeReverse(probs []prob, n uint, v uint32) {
+	m := uint32(1)
+	for ; n > 0; n-- {
+		bit := v & 1
+		v >>= 1
+		e.encodeBit(&probs[m], bit)
+		m = m<<1 | bit
+	}
+}
+
+// encodeFreq codes a symbol that takes freq of total, after cum of it.
+// total must stay below 1<<16.
+func (e *rangeEncoder) encodeFreq(cum, freq, total uint32) {
+	r := e.rng / total
+	e.low += uint64(r * cum)
+	e.rng = r * freq
+	for e.rng < rcTop {
+		e.rng <<= 8
+		e.shiftLow()
+	}
+}
+
+// shiftLow emits the top byte of low. A byte of 0xFF is held back in
+// cacheSize until it is known whether a carry will turn it into 0x00.
+func (e *rangeEncoder) shiftLow() {
+	if uint32(e.low) < 0xFF000000 || e.low>>32 != 0 {
+		carry := byte(e.low >> 32)
+		b := e.cache
+		for ; e.cacheSize > 0; e.cacheSize-- {
+			e.out = append(e.out, b+carry)
+			b = 0xFF
+		}
+		e.cache = byte(e.low >> 24)
+	}
+	e.cacheSize++
+	e.low = uint64(uint32(e.low) << 8)
+}
+
+// flush writes out the rest of low and returns the stream.
+func (e *rangeEncoder) flush() []byte {
+	for i := 0; i < 5; i++ {
+		e.shiftLow()
+	}
+	return e.out
+}
+
+// rangeDecoder reverses rangeEncoder. Reading past the end of data yields
+// zeros and moves pos beyond len(data), which callers report as truncation.
+type rangeDecoder struct {
+	data []byte
+	pos  int
+	rng  uint32
+	code uint32
+}
+
+// init starts decoding data, whose first byte is always zero.
+func (d *rangeDecoder) init(data []byte) bool {
+	*d = rangeDecoder{data: data, rng: 0xFFFFFFFF}
+	if len(data) < 5 || data[0] != 0 {
+		return false
+	}
+	d.code = binary.BigEndian.Uint32(data[1:])
+	d.pos = 5
+	return true
+}
+
+func (d *rangeDecoder) overrun() bool { return d.pos > len(d.data) }
+
+func (d *rangeDecoder) normalize() {
+	if d.rng < rcTop {
+		d.rng <<= 8
+		d.code <<= 8
+		if d.pos < len(d.data) {
+			d.code |= uint32(d.data[d.pos])
+		}
+		d.pos++
+	}
+}
+
+func (d *rangeDecoder) decodeBit(p *prob) uint32 {
+	bound := (d.rng >> probBits) * uint32(*p)
+	var bit uint32
+	if d.code < bound {
+		d.rng = bound
+		*p += (1<<probBits - *p) >> probMoveBits
+	} else {
+		d.code -= bound
+		d.rng -= bound
+		*p -= *p >> probMoveBits
+		bit = 1
+	}
+	d.normalize()
+	return bit
+}
+
+func (d *rangeDecoder) decodeDirect(n uint) uint32 {
+	var v uint32
+	for ; n > 0; n-- {
+		d.rng >>= 1
+		d.code -= d.rng
+		mask := 0 - d.code>>31 // all ones if code was below rng
+		d.code += d.rng & mask
+		v = v<<1 + mask + 1
+		d.normalize()
+	}
+	return v
+}
+
+func (d *rangeDecoder) decodeTree(probs []prob, n uint) uint32 {
+	m := uint32(1)
+	for i := n; i > 0; i-- {
+		m = m<<1 | d.decodeBit(&probs[m])
+	}
+	return m - 1<<n
+}
+
+func (d *rangeDecoder) decodeReverse(probs []prob, n uint) uint32 {
+	m, v := uint32(1), uint32(0)
+	for i := uint(0); i < n; i++ {
+		bit := d.decodeBit(&probs[m])
+		m = m<<1 | bit
+		v |= bit << i
+	}
+	return v
+}
+
+// decodeFreq returns where in total the next symbol falls; the caller
+// finds the symbol and passes its share to consume. A result of total or
+// more means the input is corrupt.
+func (d *rangeDecoder) decodeFreq(total uint32) uint32 {
+	d.rng /= total
+	return d.code / d.rng
+}
+
+func (d *rangeDecoder) consume(cum, freq uint32) {
+	d.code -= cum * d.rng
+	d.rng *= freq
+	for d.rng < rcTop {
+		d.normalize()
+	}
+}
+
+// Prices estimate the cost of coding a bit, in sixteenths of a bit, from
+// the prob it would be coded with. The encoder compares them to choose
+// between ways of coding the same bytes.
+const (
+	priceShift  = 4
+	priceReduce = 4 // probs are bucketed by their top 7 bits
+)
+
+var probPrices [1 << (probBits - priceReduce)]uint32
+
+func init() {
+	for i := range probPrices {
+		p := (float64(i) + 0.5) / float64(len(probPrices))
+		probPrices[i] = uint32(math.Round(-math.Log2(p) * (1 << priceShift)))
+	}
+}
+
+func bitPrice(p prob, bit uint32) uint32 {
+	if bit == 0 {
+		return probPrices[p>>priceReduce]
+	}
+	return probPrices[(1<<probBits-p)>>priceReduce]
+}
+
+func treePrice(probs []prob, n uint, v uint32) uint32 {
+	var price uint32
+	m := uint32(1)
+	for ; n > 0; n-- {
+		bit := v >> (n - 1) & 1
+		price += bitPrice(probs[m], bit)
+		m = m<<1 | bit
+	}
+	return price
+}
+
+func reversePrice(probs []prob, n uint, v uint32) uint32 {
+	var price uint32
+	m := uint32(1)
+	for ; n > 0; n-- {
+		bit := v & 1
+		v >>= 1
+		price += bitPrice(probs[m], bit)
+		m = m<<1 | bit
+	}
+	return price
+}
@@ -0,0 +1,251 @@
+// compress/registry.go
+package compress
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Params holds the parameters of a single stage, e.g. block=900k in
+// "bwt:block=900k".
+type Params map[string]string
+
+// Factory builds a configured Compressor from its parameters.
+type Factory func(p Params) (Compressor, error)
+
+// Algorithm is a registered compression stage.
+type Algorithm struct {
+	Name    string
+	ID      byte
+	Factory Factory
+}
+
+var (
+	registryMu sync.RWMutex
+	byName     = make(map[string]Algorithm)
+	byID       = make(map[byte]Algorithm)
+)
+
+// Register makes a compression stage available under name and id. The id is
+// what identifies the stage in compressed output, so it must never change
+// once data has been written with it. Register panics if name or id is
+// already taken, like database/sql.Register.
+func Register(name string, id byte, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("compress: Register factory is nil for " + name)
+	}
+	if name == "" || strings.ContainsAny(name, ",:= ") {
+		panic("compress: invalid algorithm name " + strconv.Quote(name))
+	}
+	if _, dup := byName[name]; dup {
+		panic("compress: Register called twice for " + name)
+	}
+	if other, dup := byID[id]; dup {
+		panic(fmt.Sprintf("compress: id %d of %s already used by %s", id, name, other.Name))
+	}
+
+	algo := Algorithm{Name: name, ID: id, Factory: factory}
+	byName[name] = algo
+	byID[id] = algo
+}
+
+// Lookup returns the algorithm registered under name.
+func Lookup(name string) (Algorithm, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	algo, ok := byName[name]
+	return algo, ok
+}
+
+// LookupID returns the algorithm registered under id.
+func LookupID(id byte) (Algorithm, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	algo, ok := byID[id]
+	return algo, ok
+}
+
+// Algorithms returns all registered algorithms ordered by id.
+func Algorithms() []Algorithm {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	algos := make([]Algorithm, 0, len(byID))
+	for _, algo := range byID {
+		algos = append(algos, algo)
+	}
+	sort.Slice(algos, func(i, j int) bool { return algos[i].ID < algos[j].ID })
+	return algos
+}
+
+// New builds a single stage from a spec such as "lzw" or "bwt:block=900k".
+// Several parameters are separated by colons: "name:a=1:b=2".
+func New(spec string) (Compressor, error) {
+	name, params, err := parseStage(spec)
+	if err != nil {
+		return nil, err
+	}
+	algo, ok := Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownAlgorithm, name)
+	}
+	c, err := algo.Factory(params)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return c, nil
+}
+
+// ParseChain builds a chain from a comma-separated list of stage specs, e.g.
+// "bwt:block=900k,rle,huffman".
+func ParseChain(spec string) (*CompressionChain, error) {
+	chain := make([]Compressor, 0)
+	for _, stage := range strings.Split(spec, ",") {
+		c, err := New(strings.TrimSpace(stage))
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, c)
+	}
+	return NewCompressionChain(chain...), nil
+}
+
+// ParseLegacyChain is ParseChain for data written before the container
+// header existed, which has no header to say how it was produced. Its
+// huffman and lzw stages read the data as the decoders of that time did;
+// the others have kept their layout, or never decoded what they wrote.
+func ParseLegacyChain(spec string) (*CompressionChain, error) {
+	chain, err := ParseChain(spec)
+	if err != nil {
+		return nil, err
+	}
+	for i, c := range chain.compressors {
+		switch c := c.(type) {
+		case *HuffmanCompressor:
+			if c.static == nil {
+				chain.compressors[i] = &legacyHuffmanCompressor{limiter: c.limiter}
+			}
+		case *LZWCompressor:
+			if c.preset == nil {
+				chain.compressors[i] = legacyLZWCompressor{c}
+			}
+		}
+	}
+	return chain, nil
+}
+
+func parseStage(spec string) (string, Params, error) {
+	parts := strings.Split(spec, ":")
+	name := parts[0]
+	if name == "" {
+		return "", nil, fmt.Errorf("empty algorithm name in %q", spec)
+	}
+
+	params := make(Params)
+	for _, kv := range parts[1:] {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok || key == "" {
+			return "", nil, fmt.Errorf("invalid parameter %q in %q (want key=value)", kv, spec)
+		}
+		if _, dup := params[key]; dup {
+			return "", nil, fmt.Errorf("duplicate parameter %q in %q", key, spec)
+		}
+		params[key] = value
+	}
+	return name, params, nil
+}
+
+// Allow returns an error if p contains a key not listed in keys.
+func (p Params) Allow(keys ...string) error {
+	for key := range p {
+		found := false
+		for _, k := range keys {
+			if key == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown parameter %q", key)
+		}
+	}
+	return nil
+}
+
+// Int returns the integer value of key, or def if it is not set.
+func (p Params) Int(key string, def int) (int, error) {
+	value, ok := p[key]
+	if !ok {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("parameter %s: %q is not an integer", key, value)
+	}
+	return n, nil
+}
+
+// Size returns the value of key as a byte count, or def if it is not set.
+// The suffixes k, m and g multiply by 1024, 1024² and 1024³.
+func (p Params) Size(key string, def int) (int, error) {
+	value, ok := p[key]
+	if !ok {
+		return def, nil
+	}
+	n, err := ParseSize(value)
+	if err != nil {
+		return 0, fmt.Errorf("parameter %s: %w", key, err)
+	}
+	return n, nil
+}
+
+// Dict returns the registered dictionary whose ID is the value of key, or
+// nil if it is not set.
+func (p Params) Dict(key string) (*SharedDict, error) {
+	value, ok := p[key]
+	if !ok {
+		return nil, nil
+	}
+	id, err := ParseDictID(value)
+	if err != nil {
+		return nil, fmt.Errorf("parameter %s: %w", key, err)
+	}
+	d, ok := LookupDict(id)
+	if !ok {
+		return nil, fmt.Errorf("%w %08x", ErrUnknownDictionary, id)
+	}
+	return d, nil
+}
+
+// ParseSize parses a byte count such as "4096", "64k" or "1m".
+func ParseSize(s string) (int, error) {
+	multiplier := 1
+	digits := strings.ToLower(s)
+	switch {
+	case strings.HasSuffix(digits, "k"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(digits, "m"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(digits, "g"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		digits = digits[:len(digits)-1]
+	}
+
+	n, err := strconv.Atoi(digits)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxInt/multiplier {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,116 @@
+// compress/registry_test.go
+package compress
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestParseChain(t *testing.T) {
+	periodic := make([]byte, 200000)
+	for i := range periodic {
+		periodic[i] = byte(i % 256)
+	}
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	specs := []string{"bwt:block=64k", "bwt:block=300", "rle,bwt:block=1m"}
+	for _, spec := range specs {
+		chain, err := ParseChain(spec)
+		if err != nil {
+			t.Fatalf("%s: %v", spec, err)
+		}
+		for _, input := range [][]byte{periodic, random, bytes.Repeat([]byte("a"), 5000)} {
+			compressed, err := chain.Compress(input)
+			if err != nil {
+				t.Fatalf("%s: compression failed: %v", spec, err)
+			}
+			out, err := chain.Decompress(compressed)
+			if err != nil {
+				t.Fatalf("%s: decompression failed: %v", spec, err)
+			}
+			if !bytes.Equal(input, out) {
+				t.Errorf("%s: data mismatch after round trip", spec)
+			}
+		}
+	}
+}
+
+func TestParseChainErrors(t *testing.T) {
+	for _, spec := range []string{"", "nope", "lzw,", "bwt:block", "bwt:block=0", "bwt:block=9x", "bwt:size=1k", "lzw:x=1", "bwt:block=1k:block=2k"} {
+		if _, err := ParseChain(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+	if _, err := ParseChain("rle,nope"); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Errorf("unknown stage: got %v, want ErrUnknownAlgorithm", err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	Register("test-identity", 250, func(p Params) (Compressor, error) {
+		return NewCompressionChain(), nil
+	})
+
+	if _, ok := Lookup("test-identity"); !ok {
+		t.Fatal("registered algorithm not found by name")
+	}
+	if algo, ok := LookupID(250); !ok || algo.Name != "test-identity" {
+		t.Fatal("registered algorithm not found by id")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic on duplicate id")
+		}
+	}()
+	Register("test-other", 250, func(p Params) (Compressor, error) { return nil, nil })
+}
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]int{"0": 0, "4096": 4096, "64k": 64 << 10, "900K": 900 << 10, "1m": 1 << 20, "2g": 2 << 30}
+	for in, want := range cases {
+		got, err := ParseSize(in)
+		if err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "k", "-1", "1.5m", "1t"} {
+		if _, err := ParseSize(in); err == nil {
+			t.Errorf("ParseSize(%q): expected an error", in)
+		}
+	}
+}
+
+// Files without a header were written by the last version without it. Its
+// huffman decoder also decoded the padding bits, here into a trailing "e".
+func TestParseLegacyChain(t *testing.T) {
+	text := "TOBEORNOTTOBEORTOBEORNOT, that is the question.\n"
+	for spec, file := range map[string]string{
+		"huffman":     "3b000000000165014e0000016f016100012e012c000154000169014500000001420152000001680173012000014f0001740000010a016e00017501715a1f48e4b43e95a1f48e47bea17adab7d40bffe0af313d3780",
+		"lzw,huffman": "560001000000000000016e010300016f01420001730168000001540001040105000001450107017400000000012c0001750102012000014f0000014e012e000111015200000000016101710169000165000109010a0101a348d634ded8d287e3fabfb7c3f5fdbf832ba6e0bb2e526ef9ba65c589d24bb94481b5dc",
+	} {
+		data, _ := hex.DecodeString(file)
+		chain, err := ParseLegacyChain(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := chain.Decompress(data)
+		want := text
+		if spec == "huffman" {
+			want += "e"
+		}
+		if err != nil || string(got) != want {
+			t.Errorf("%s: got %q, %v", spec, got, err)
+		}
+		for _, n := range []int{0, 1, 2, len(data) / 2} {
+			chain.Decompress(data[:n])
+		}
+		if _, err := chain.Decompress([]byte{200, 0, 1}); !errors.Is(err, ErrTruncated) {
+			t.Errorf("%s: short tree: got %v, want ErrTruncated", spec, err)
+		}
+	}
+}
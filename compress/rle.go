@@ -1,22 +1,66 @@
 // compress/rle.go
 package compress
 
-type RLECompressor struct{}
+import (
+	"context"
+	"slices"
+)
+
+func init() {
+	Register("rle", 3, func(p Params) (Compressor, error) {
+		if err := p.Allow(); err != nil {
+			return nil, err
+		}
+		return NewRLECompressor(), nil
+	})
+}
+
+type RLECompressor struct {
+	limiter
+}
 
 func NewRLECompressor() *RLECompressor {
-	return &RLECompressor{}
+	return &RLECompressor{limiter{DefaultLimits}}
 }
 
 func (rc *RLECompressor) Compress(data []byte) ([]byte, error) {
+	return rc.appendCompress(context.Background(), nil, data)
+}
+
+func (rc *RLECompressor) Decompress(data []byte) ([]byte, error) {
+	return rc.appendDecompress(context.Background(), nil, data)
+}
+
+func (rc *RLECompressor) CompressContext(ctx context.Context, data []byte) ([]byte, error) {
+	return rc.appendCompress(ctx, nil, data)
+}
+
+func (rc *RLECompressor) DecompressContext(ctx context.Context, data []byte) ([]byte, error) {
+	return rc.appendDecompress(ctx, nil, data)
+}
+
+func (rc *RLECompressor) AppendCompress(dst, src []byte) ([]byte, error) {
+	return rc.appendCompress(context.Background(), dst, src)
+}
+
+func (rc *RLECompressor) AppendDecompress(dst, src []byte) ([]byte, error) {
+	return rc.appendDecompress(context.Background(), dst, src)
+}
+
+func (rc *RLECompressor) appendCompress(ctx context.Context, dst, data []byte) ([]byte, error) {
+	t := newTracker(ctx, "rle", len(data))
 	if len(data) == 0 {
-		return nil, nil
+		return dst, nil
 	}
 
-	var result []byte
+	result := dst
 	count := 1
 	current := data[0]
 
 	for i := 1; i < len(data); i++ {
+		if err := t.update(i); err != nil {
+			return nil, err
+		}
 		if data[i] == current && count < 255 {
 			count++
 		} else {
@@ -27,16 +71,38 @@ func (rc *RLECompressor) Compress(data []byte) ([]byte, error) {
 	}
 	result = append(result, byte(count), current)
 
+	t.finish()
 	return result, nil
 }
 
-func (rc *RLECompressor) Decompress(data []byte) ([]byte, error) {
+func (rc *RLECompressor) appendDecompress(ctx context.Context, dst, data []byte) ([]byte, error) {
+	t := newTracker(ctx, "rle", len(data))
 	if len(data) == 0 {
-		return nil, nil
+		return dst, nil
+	}
+
+	if len(data)%2 != 0 {
+		return nil, truncated("rle", len(data)-1)
 	}
 
-	var result []byte
+	// Size the output, and check it against the limits, before
+	// expanding anything.
+	size := 0
 	for i := 0; i < len(data); i += 2 {
+		if data[i] == 0 {
+			return nil, corrupt("rle", i)
+		}
+		size += int(data[i])
+		if !rc.limits.allow(len(data), uint64(size)) {
+			return nil, tooLarge("rle", i)
+		}
+	}
+
+	result := slices.Grow(dst, size)
+	for i := 0; i < len(data); i += 2 {
+		if err := t.update(i); err != nil {
+			return nil, err
+		}
 		count := int(data[i])
 		char := data[i+1]
 		for j := 0; j < count; j++ {
@@ -44,5 +110,6 @@ func (rc *RLECompressor) Decompress(data []byte) ([]byte, error) {
 		}
 	}
 
+	t.finish()
 	return result, nil
 }
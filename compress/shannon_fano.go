@@ -2,21 +2,33 @@
 package compress
 
 import (
-	"errors"
+	"context"
+	"encoding/binary"
+	"slices"
 	"sort"
-	// "bytes"
 )
 
+func init() {
+	Register("sf", 4, func(p Params) (Compressor, error) {
+		if err := p.Allow(); err != nil {
+			return nil, err
+		}
+		return NewShannonFanoCompressor(), nil
+	})
+}
+
 type SFNode struct {
 	Symbol byte
 	Freq   int
 	Code   string
 }
 
-type ShannonFanoCompressor struct{}
+type ShannonFanoCompressor struct {
+	limiter
+}
 
 func NewShannonFanoCompressor() *ShannonFanoCompressor {
-	return &ShannonFanoCompressor{}
+	return &ShannonFanoCompressor{limiter{DefaultLimits}}
 }
 
 func (sf *ShannonFanoCompressor) buildFrequencyTable(data []byte) []*SFNode {
@@ -31,7 +43,10 @@ func (sf *ShannonFanoCompressor) buildFrequencyTable(data []byte) []*SFNode {
 	}
 
 	sort.Slice(nodes, func(i, j int) bool {
-		return nodes[i].Freq > nodes[j].Freq
+		if nodes[i].Freq != nodes[j].Freq {
+			return nodes[i].Freq > nodes[j].Freq
+		}
+		return nodes[i].Symbol < nodes[j].Symbol
 	})
 
 	return nodes
@@ -43,7 +58,10 @@ func (sf *ShannonFanoCompressor) divide(nodes []*SFNode, start, end int) {
 	}
 
 	if start+1 == end {
-		nodes[start].Code += "0"
+		// A lone symbol still needs a code of at least one bit.
+		if nodes[start].Code == "" {
+			nodes[start].Code = "0"
+		}
 		return
 	}
 
@@ -82,9 +100,37 @@ func abs(x int) int {
 	return x
 }
 
+// Compress writes the symbol count, the code table and the codes:
+//
+//	uvarint count | uvarint symbols | (symbol, code length, code bits)... | code bits
 func (sf *ShannonFanoCompressor) Compress(data []byte) ([]byte, error) {
+	return sf.appendCompress(context.Background(), nil, data)
+}
+
+func (sf *ShannonFanoCompressor) Decompress(compressed []byte) ([]byte, error) {
+	return sf.appendDecompress(context.Background(), nil, compressed)
+}
+
+func (sf *ShannonFanoCompressor) CompressContext(ctx context.Context, data []byte) ([]byte, error) {
+	return sf.appendCompress(ctx, nil, data)
+}
+
+func (sf *ShannonFanoCompressor) DecompressContext(ctx context.Context, compressed []byte) ([]byte, error) {
+	return sf.appendDecompress(ctx, nil, compressed)
+}
+
+func (sf *ShannonFanoCompressor) AppendCompress(dst, src []byte) ([]byte, error) {
+	return sf.appendCompress(context.Background(), dst, src)
+}
+
+func (sf *ShannonFanoCompressor) AppendDecompress(dst, src []byte) ([]byte, error) {
+	return sf.appendDecompress(context.Background(), dst, src)
+}
+
+func (sf *ShannonFanoCompressor) appendCompress(ctx context.Context, dst, data []byte) ([]byte, error) {
+	t := newTracker(ctx, "sf", len(data))
 	if len(data) == 0 {
-		return nil, nil
+		return dst, nil
 	}
 
 	// Build frequency table and generate codes
@@ -92,105 +138,116 @@ func (sf *ShannonFanoCompressor) Compress(data []byte) ([]byte, error) {
 	sf.divide(nodes, 0, len(nodes))
 
 	// Create lookup table
-	codeTable := make(map[byte]string)
+	var codeTable [256]string
 	for _, node := range nodes {
 		codeTable[node.Symbol] = node.Code
 	}
 
-	// Convert data to bits
-	var bits string
-	for _, b := range data {
-		bits += codeTable[b]
-	}
-
-	// Create header with symbol table
-	header := make([]byte, 0)
-	header = append(header, byte(len(nodes))) // Number of symbols
-
+	result := binary.AppendUvarint(dst, uint64(len(data)))
+	result = binary.AppendUvarint(result, uint64(len(nodes)))
 	for _, node := range nodes {
-		header = append(header, node.Symbol)
-		header = append(header, byte(len(node.Code)))
-
-		// Convert code string to bytes
-		codeBytes := make([]byte, (len(node.Code)+7)/8)
-		for i := 0; i < len(node.Code); i++ {
-			if node.Code[i] == '1' {
-				codeBytes[i/8] |= 1 << uint(7-(i%8))
-			}
-		}
-		header = append(header, codeBytes...)
+		result = append(result, node.Symbol, byte(len(node.Code)))
+		w := bitWriter{buf: result, nbits: len(result) * 8}
+		w.writeCode(node.Code)
+		result = w.buf
 	}
 
-	// Convert compressed bits to bytes
-	compressed := make([]byte, (len(bits)+7)/8)
-	for i := 0; i < len(bits); i++ {
-		if bits[i] == '1' {
-			compressed[i/8] |= 1 << uint(7-(i%8))
+	w := bitWriter{buf: result, nbits: len(result) * 8}
+	for i, b := range data {
+		if err := t.update(i); err != nil {
+			return nil, err
 		}
+		w.writeCode(codeTable[b])
 	}
-
-	// Combine header and compressed data
-	result := make([]byte, len(header)+len(compressed)+1)
-	result[0] = byte(len(header))
-	copy(result[1:], header)
-	copy(result[1+len(header):], compressed)
-
-	return result, nil
+	t.finish()
+	return w.buf, nil
 }
 
-func (sf *ShannonFanoCompressor) Decompress(compressed []byte) ([]byte, error) {
+func (sf *ShannonFanoCompressor) appendDecompress(ctx context.Context, dst, compressed []byte) ([]byte, error) {
+	t := newTracker(ctx, "sf", len(compressed))
 	if len(compressed) == 0 {
-		return nil, nil
+		return dst, nil
 	}
 
-	// Read header
-	headerLen := int(compressed[0])
-	if headerLen+1 >= len(compressed) {
-		return nil, errors.New("invalid compressed data")
+	count, n := binary.Uvarint(compressed)
+	if n == 0 {
+		return nil, truncated("sf", 0)
+	}
+	if n < 0 || count == 0 {
+		return nil, corrupt("sf", 0)
 	}
+	if !sf.limits.allow(len(compressed), count) {
+		return nil, tooLarge("sf", 0)
+	}
+	pos := n
 
-	header := compressed[1 : headerLen+1]
-	numSymbols := int(header[0])
-	pos := 1
+	numSymbols, n := binary.Uvarint(compressed[pos:])
+	if n == 0 {
+		return nil, truncated("sf", pos)
+	}
+	if n < 0 || numSymbols == 0 || numSymbols > 256 {
+		return nil, corrupt("sf", pos)
+	}
+	pos += n
 
 	// Rebuild code table
-	codeTable := make(map[string]byte)
-	for i := 0; i < numSymbols && pos < len(header); i++ {
-		symbol := header[pos]
-		pos++
-		codeLen := int(header[pos])
-		pos++
-
-		codeBytes := header[pos:(pos + (codeLen+7)/8)]
-		var code string
+	codeTable := make(map[string]byte, numSymbols)
+	maxLen := 0
+	code := make([]byte, 0, 255)
+	for i := uint64(0); i < numSymbols; i++ {
+		if len(compressed)-pos < 2 {
+			return nil, truncated("sf", pos)
+		}
+		symbol, codeLen := compressed[pos], int(compressed[pos+1])
+		if codeLen == 0 {
+			return nil, corrupt("sf", pos+1)
+		}
+		pos += 2
+		size := (codeLen + 7) / 8
+		if len(compressed)-pos < size {
+			return nil, truncated("sf", pos)
+		}
+		r := bitReader{data: compressed[pos : pos+size]}
+		code = code[:0]
 		for bit := 0; bit < codeLen; bit++ {
-			if (codeBytes[bit/8] & (1 << uint(7-(bit%8)))) != 0 {
-				code += "1"
-			} else {
-				code += "0"
-			}
+			b, _ := r.readBit()
+			code = append(code, '0'+b)
 		}
-		codeTable[code] = symbol
-		pos += (codeLen + 7) / 8
+		codeTable[string(code)] = symbol
+		maxLen = max(maxLen, codeLen)
+		pos += size
 	}
 
-	// Decompress data
-	data := compressed[headerLen+1:]
-	var result []byte
-	currentCode := ""
+	// Every symbol takes at least one bit.
+	bits := compressed[pos:]
+	if count > uint64(len(bits))*8 {
+		return nil, truncated("sf", len(compressed))
+	}
 
-	for i := 0; i < len(data)*8; i++ {
-		if (data[i/8] & (1 << uint(7-(i%8)))) != 0 {
-			currentCode += "1"
-		} else {
-			currentCode += "0"
+	result := slices.Grow(dst, int(count))
+	r := bitReader{data: bits}
+	code = code[:0]
+	for uint64(len(result)-len(dst)) < count {
+		if err := t.update(pos + r.pos/8); err != nil {
+			return nil, err
 		}
-
-		if symbol, ok := codeTable[currentCode]; ok {
+		bit, ok := r.readBit()
+		if !ok {
+			return nil, truncated("sf", len(compressed))
+		}
+		code = append(code, '0'+bit)
+		if symbol, ok := codeTable[string(code)]; ok {
 			result = append(result, symbol)
-			currentCode = ""
+			code = code[:0]
+		} else if len(code) >= maxLen {
+			return nil, corrupt("sf", pos+r.pos/8)
 		}
 	}
 
+	// Only padding may follow the last code.
+	if (r.pos+7)/8 != len(bits) {
+		return nil, corrupt("sf", pos+(r.pos+7)/8)
+	}
+	t.finish()
 	return result, nil
 }
@@ -0,0 +1,217 @@
+// compress/stats.go
+package compress
+
+import (
+	"math"
+	"math/bits"
+)
+
+// Statistics is a detailed breakdown of data that explains how the
+// algorithms behave on it. Analyze computes the cheaper subset used for
+// auto selection.
+type Statistics struct {
+	Size int
+	// Histogram counts each byte value.
+	Histogram [256]int
+	// Distinct is the number of byte values that occur.
+	Distinct int
+
+	// Entropy is the order-0 Shannon entropy in bits per byte, and
+	// Order1Entropy the entropy of a byte given the one before it.
+	Entropy       float64
+	Order1Entropy float64
+	// MinSize and Order1MinSize are the sizes in bytes an ideal coder
+	// reaches with the respective model, ignoring any header.
+	MinSize       int
+	Order1MinSize int
+
+	// Runs is the number of runs of equal bytes, LongestRun the longest.
+	// RunLengths[i] counts runs of length 2^i to 2^(i+1)-1.
+	Runs       int
+	LongestRun int
+	RunLengths []int
+
+	LZ LZStatistics
+
+	// HuffmanLengths and ShannonFanoLengths are the code lengths in bits
+	// the huffman and sf stages assign to each byte value, 0 for bytes
+	// that do not occur. HuffmanBits and ShannonFanoBits are the resulting
+	// payload sizes in bits, without the code tables.
+	HuffmanLengths     [256]int
+	ShannonFanoLengths [256]int
+	HuffmanBits        int
+	ShannonFanoBits    int
+}
+
+// LZStatistics describes the repeats a greedy LZ77 parse finds.
+type LZStatistics struct {
+	// Window is the maximum match distance searched, MinMatch the shortest
+	// match counted.
+	Window   int
+	MinMatch int
+
+	Matches      int
+	MatchedBytes int
+	Literals     int
+	LongestMatch int
+	MeanLength   float64
+	MeanDistance float64
+}
+
+const (
+	statsWindow   = 32 << 10
+	statsMinMatch = 4
+	statsMaxChain = 32
+)
+
+// ComputeStatistics returns the Statistics of data.
+func ComputeStatistics(data []byte) Statistics {
+	s := Statistics{Size: len(data)}
+	if len(data) == 0 {
+		return s
+	}
+
+	for _, b := range data {
+		s.Histogram[b]++
+	}
+	for _, f := range s.Histogram {
+		if f > 0 {
+			s.Distinct++
+		}
+	}
+	s.Entropy = entropy(s.Histogram[:], len(data))
+	s.MinSize = int(math.Ceil(s.Entropy * float64(len(data)) / 8))
+
+	// Order 1: entropy of each context weighted by how often it occurs.
+	pairs := make([][256]int, 256)
+	for i := 1; i < len(data); i++ {
+		pairs[data[i-1]][data[i]]++
+	}
+	if len(data) > 1 {
+		for _, next := range pairs {
+			total := 0
+			for _, f := range next {
+				total += f
+			}
+			if total > 0 {
+				s.Order1Entropy += float64(total) / float64(len(data)-1) * entropy(next[:], total)
+			}
+		}
+	}
+	// The first byte is coded without context.
+	s.Order1MinSize = int(math.Ceil((8 + s.Order1Entropy*float64(len(data)-1)) / 8))
+
+	run := 1
+	for i := 1; i <= len(data); i++ {
+		if i < len(data) && data[i] == data[i-1] {
+			run++
+			continue
+		}
+		s.Runs++
+		if run > s.LongestRun {
+			s.LongestRun = run
+		}
+		bucket := bits.Len(uint(run)) - 1
+		for len(s.RunLengths) <= bucket {
+			s.RunLengths = append(s.RunLengths, 0)
+		}
+		s.RunLengths[bucket]++
+		run = 1
+	}
+
+	s.LZ = lzStatistics(data)
+
+	hc := NewHuffmanCompressor()
+	codes, _ := hc.buildCodes(hc.buildTree(&s.Histogram))
+	for b, code := range codes {
+		s.HuffmanLengths[b] = int(code.n)
+		s.HuffmanBits += int(code.n) * s.Histogram[b]
+	}
+	hc.Reset()
+
+	sf := NewShannonFanoCompressor()
+	nodes := sf.buildFrequencyTable(data)
+	sf.divide(nodes, 0, len(nodes))
+	for _, node := range nodes {
+		s.ShannonFanoLengths[node.Symbol] = len(node.Code)
+		s.ShannonFanoBits += len(node.Code) * node.Freq
+	}
+
+	return s
+}
+
+func entropy(freqs []int, total int) float64 {
+	h := 0.0
+	for _, f := range freqs {
+		if f > 0 {
+			p := float64(f) / float64(total)
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+// lzStatistics runs a greedy LZ77 parse with hash chains over 4-byte
+// prefixes.
+func lzStatistics(data []byte) LZStatistics {
+	lz := LZStatistics{Window: statsWindow, MinMatch: statsMinMatch}
+
+	const hashBits = 16
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, len(data))
+	hash := func(i int) uint32 {
+		v := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		return (v * 2654435761) >> (32 - hashBits)
+	}
+	insert := func(i int) {
+		if i+statsMinMatch <= len(data) {
+			h := hash(i)
+			prev[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+
+	distances := 0
+	for i := 0; i < len(data); {
+		bestLen, bestDist := 0, 0
+		if i+statsMinMatch <= len(data) {
+			candidate := head[hash(i)]
+			for chain := 0; candidate >= 0 && chain < statsMaxChain && i-int(candidate) <= statsWindow; chain++ {
+				j := int(candidate)
+				n := 0
+				for i+n < len(data) && data[j+n] == data[i+n] {
+					n++
+				}
+				if n > bestLen {
+					bestLen, bestDist = n, i-j
+				}
+				candidate = prev[j]
+			}
+		}
+
+		if bestLen < statsMinMatch {
+			lz.Literals++
+			insert(i)
+			i++
+			continue
+		}
+		lz.Matches++
+		lz.MatchedBytes += bestLen
+		distances += bestDist
+		if bestLen > lz.LongestMatch {
+			lz.LongestMatch = bestLen
+		}
+		for end := i + bestLen; i < end; i++ {
+			insert(i)
+		}
+	}
+
+	if lz.Matches > 0 {
+		lz.MeanLength = float64(lz.MatchedBytes) / float64(lz.Matches)
+		lz.MeanDistance = float64(distances) / float64(lz.Matches)
+	}
+	return lz
+}
@@ -0,0 +1,61 @@
+// compress/stats_test.go
+package compress
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestComputeStatistics(t *testing.T) {
+	s := ComputeStatistics([]byte("abababababababab"))
+	if s.Entropy != 1 {
+		t.Errorf("entropy = %v, want 1", s.Entropy)
+	}
+	// Each byte is fully determined by the one before it.
+	if s.Order1Entropy != 0 {
+		t.Errorf("order-1 entropy = %v, want 0", s.Order1Entropy)
+	}
+	if s.MinSize != 2 {
+		t.Errorf("minimum size = %d, want 2", s.MinSize)
+	}
+	if s.LZ.Matches != 1 || s.LZ.MatchedBytes != 14 || s.LZ.MeanDistance != 2 {
+		t.Errorf("lz = %+v, want one match of 14 bytes at distance 2", s.LZ)
+	}
+	if s.HuffmanLengths['a'] != 1 || s.HuffmanLengths['b'] != 1 || s.HuffmanBits != 16 {
+		t.Errorf("huffman lengths a=%d b=%d bits=%d, want 1, 1, 16",
+			s.HuffmanLengths['a'], s.HuffmanLengths['b'], s.HuffmanBits)
+	}
+	// Huffman codes are optimal, Shannon-Fano codes can only be longer.
+	if s.ShannonFanoLengths['a'] == 0 || s.ShannonFanoBits < s.HuffmanBits {
+		t.Errorf("shannon-fano bits = %d, huffman bits = %d", s.ShannonFanoBits, s.HuffmanBits)
+	}
+}
+
+func TestComputeStatisticsRuns(t *testing.T) {
+	data := append(bytes.Repeat([]byte{'x'}, 5), 'y', 'z', 'z')
+	s := ComputeStatistics(data)
+	if s.Runs != 3 || s.LongestRun != 5 {
+		t.Errorf("runs = %d, longest = %d, want 3 and 5", s.Runs, s.LongestRun)
+	}
+	// One run of 1, one of 2-3, one of 4-7.
+	want := []int{1, 1, 1}
+	if len(s.RunLengths) != len(want) {
+		t.Fatalf("run lengths = %v, want %v", s.RunLengths, want)
+	}
+	for i := range want {
+		if s.RunLengths[i] != want[i] {
+			t.Errorf("run lengths = %v, want %v", s.RunLengths, want)
+		}
+	}
+
+	// Huffman codes satisfy the Kraft equality.
+	var kraft float64
+	for _, l := range s.HuffmanLengths {
+		if l > 0 {
+			kraft += 1 / float64(uint(1)<<l)
+		}
+	}
+	if kraft != 1 {
+		t.Errorf("Kraft sum = %v, want 1", kraft)
+	}
+}
@@ -0,0 +1,50 @@
+// compress/store.go
+package compress
+
+import "context"
+
+func init() {
+	Register("store", 0, func(p Params) (Compressor, error) {
+		if err := p.Allow(); err != nil {
+			return nil, err
+		}
+		return NewStoreCompressor(), nil
+	})
+}
+
+// StoreCompressor copies data through unchanged. It is what auto selection
+// picks for input that no chain can shrink.
+type StoreCompressor struct{}
+
+func NewStoreCompressor() *StoreCompressor {
+	return &StoreCompressor{}
+}
+
+func (sc *StoreCompressor) Compress(data []byte) ([]byte, error) {
+	return append([]byte(nil), data...), nil
+}
+
+func (sc *StoreCompressor) Decompress(data []byte) ([]byte, error) {
+	return append([]byte(nil), data...), nil
+}
+
+func (sc *StoreCompressor) AppendCompress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (sc *StoreCompressor) AppendDecompress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (sc *StoreCompressor) appendCompress(ctx context.Context, dst, src []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	t := newTracker(ctx, "store", len(src))
+	t.finish()
+	return append(dst, src...), nil
+}
+
+func (sc *StoreCompressor) appendDecompress(ctx context.Context, dst, src []byte) ([]byte, error) {
+	return sc.appendCompress(ctx, dst, src)
+}
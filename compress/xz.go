@@ -0,0 +1,425 @@
+// compress/xz.go
+package compress
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/crc64"
+)
+
+// xzMagic starts every .xz stream.
+var xzMagic = []byte{0xFD, '7', 'z', 'X', 'Z', 0}
+
+const (
+	xzHeaderSize  = 12
+	xzFilterDelta = 0x03
+	xzFilterX86   = 0x04
+	xzFilterARM64 = 0x0A
+	xzFilterLZMA2 = 0x21
+)
+
+// xzFilter is a filter of a block other than the final LZMA2.
+type xzFilter struct {
+	id    uint64
+	dist  int    // of a delta filter
+	start uint32 // the offset a BCJ filter starts counting from
+}
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// IsXZ reports whether data starts like an .xz file.
+func IsXZ(data []byte) bool { return bytes.HasPrefix(data, xzMagic) }
+
+// DecodeXZ decompresses an .xz file as written by xz and liblzma: one or
+// more streams of blocks, each checked against its CRC32, CRC64 or
+// SHA-256. Blocks must be compressed with LZMA2, optionally after delta,
+// x86 or ARM64 BCJ filters. Errors
+// are DataErrors of stage "xz", so Limits and the sentinels apply as for
+// the stages.
+func DecodeXZ(ctx context.Context, data []byte, limits Limits) ([]byte, error) {
+	t := newTracker(ctx, "xz", len(data))
+	x := xzReader{data: data, d: lzmaDecoderPool.Get().(*lzmaDecoder)}
+	defer lzmaDecoderPool.Put(x.d)
+	x.d.in, x.d.base, x.d.limits = len(data), 0, limits
+
+	var out []byte
+	for {
+		var err error
+		if out, err = x.stream(&t, out); err != nil {
+			return nil, err
+		}
+		// Streams may be followed by padding in multiples of four zero
+		// bytes, and by further streams.
+		for x.pos+4 <= len(data) && binary.LittleEndian.Uint32(data[x.pos:]) == 0 {
+			x.pos += 4
+		}
+		if x.pos == len(data) {
+			break
+		}
+		if !IsXZ(data[x.pos:]) {
+			return nil, corrupt("xz", x.pos)
+		}
+	}
+
+	t.finish()
+	return out, nil
+}
+
+type xzReader struct {
+	data []byte
+	pos  int
+	d    *lzmaDecoder
+}
+
+// xzRecord is the index entry of a block.
+type xzRecord struct {
+	unpadded, uncompressed uint64
+}
+
+func (x *xzReader) corrupt() error   { return corrupt("xz", x.pos) }
+func (x *xzReader) truncated() error { return truncated("xz", len(x.data)) }
+
+// need returns the next n bytes of input.
+func (x *xzReader) need(n int) ([]byte, error) {
+	if n > len(x.data)-x.pos {
+		return nil, x.truncated()
+	}
+	return x.data[x.pos : x.pos+n], nil
+}
+
+// uvarint reads a number of up to 63 bits, seven bits per byte.
+func uvarint(b []byte, pos *int) (uint64, bool) {
+	v, n := binary.Uvarint(b[*pos:])
+	if n <= 0 || n > 9 {
+		return 0, false
+	}
+	*pos += n
+	return v, true
+}
+
+// stream decodes one stream, from its header to its footer.
+func (x *xzReader) stream(t *tracker, out []byte) ([]byte, error) {
+	header, err := x.need(xzHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	flags := header[6:8]
+	if !IsXZ(header) || flags[0] != 0 || flags[1] > 0x0F ||
+		crc32.ChecksumIEEE(flags) != binary.LittleEndian.Uint32(header[8:]) {
+		return nil, x.corrupt()
+	}
+	check := flags[1]
+	x.pos += xzHeaderSize
+
+	var records []xzRecord
+	for {
+		b, err := x.need(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == 0 {
+			break // the index
+		}
+		start := len(out)
+		var unpadded int
+		if out, unpadded, err = x.block(t, out, check); err != nil {
+			return nil, err
+		}
+		records = append(records, xzRecord{uint64(unpadded), uint64(len(out) - start)})
+	}
+
+	indexSize, err := x.index(records)
+	if err != nil {
+		return nil, err
+	}
+
+	footer, err := x.need(xzHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(footer[4:10]) != binary.LittleEndian.Uint32(footer) ||
+		(uint64(binary.LittleEndian.Uint32(footer[4:]))+1)*4 != uint64(indexSize) ||
+		!bytes.Equal(footer[8:10], flags) || footer[10] != 'Y' || footer[11] != 'Z' {
+		return nil, x.corrupt()
+	}
+	x.pos += xzHeaderSize
+	return out, nil
+}
+
+// block decodes one block and verifies its check. It also returns the
+// block's size without padding, as the index records it.
+func (x *xzReader) block(t *tracker, out []byte, check byte) ([]byte, int, error) {
+	blockStart := x.pos
+	size := (int(x.data[x.pos]) + 1) * 4
+	header, err := x.need(size)
+	if err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(header[:size-4]) != binary.LittleEndian.Uint32(header[size-4:]) {
+		return nil, 0, x.corrupt()
+	}
+	header = header[:size-4]
+	flags := header[1]
+	if flags&0x3C != 0 {
+		return nil, 0, x.corrupt()
+	}
+	p := 2
+	compressedSize, uncompressedSize := int64(-1), int64(-1)
+	if flags&0x40 != 0 {
+		v, ok := uvarint(header, &p)
+		if !ok || v == 0 || v > maxDecodedSize {
+			return nil, 0, x.corrupt()
+		}
+		compressedSize = int64(v)
+	}
+	if flags&0x80 != 0 {
+		v, ok := uvarint(header, &p)
+		if !ok || v > maxDecodedSize {
+			return nil, 0, x.corrupt()
+		}
+		uncompressedSize = int64(v)
+	}
+	// The filters are listed in the order they were applied when
+	// compressing; the last must be LZMA2.
+	var filters [3]xzFilter
+	last := int(flags & 3)
+	for i := 0; i <= last; i++ {
+		id, ok1 := uvarint(header, &p)
+		n, ok2 := uvarint(header, &p)
+		if !ok1 || !ok2 || n > uint64(len(header)-p) {
+			return nil, 0, x.corrupt()
+		}
+		props := header[p : p+int(n)]
+		p += int(n)
+		switch {
+		case id == xzFilterLZMA2 && i == last:
+			// The dictionary size in props needs no buffer here: the
+			// whole output is the dictionary.
+			if len(props) != 1 || props[0] > 40 {
+				return nil, 0, x.corrupt()
+			}
+		case id == xzFilterDelta && i < last:
+			if len(props) != 1 {
+				return nil, 0, x.corrupt()
+			}
+			filters[i] = xzFilter{id: id, dist: int(props[0]) + 1}
+		case (id == xzFilterX86 || id == xzFilterARM64) && i < last:
+			f := xzFilter{id: id}
+			switch len(props) {
+			case 0:
+			case 4:
+				f.start = binary.LittleEndian.Uint32(props)
+			default:
+				return nil, 0, x.corrupt()
+			}
+			if id == xzFilterARM64 && f.start%4 != 0 {
+				return nil, 0, x.corrupt()
+			}
+			filters[i] = f
+		default:
+			return nil, 0, fmt.Errorf("xz: filter %#x is not supported", id)
+		}
+	}
+	for _, b := range header[p:] {
+		if b != 0 {
+			return nil, 0, x.corrupt()
+		}
+	}
+	x.pos += size
+
+	dataStart, outStart := x.pos, len(out)
+	if out, err = x.lzma2(t, out); err != nil {
+		return nil, 0, err
+	}
+	if compressedSize >= 0 && int64(x.pos-dataStart) != compressedSize ||
+		uncompressedSize >= 0 && int64(len(out)-outStart) != uncompressedSize {
+		return nil, 0, x.corrupt()
+	}
+	for i := last - 1; i >= 0; i-- {
+		switch f := filters[i]; f.id {
+		case xzFilterDelta:
+			deltaDecode(out[outStart:], 0, f.dist, DeltaSub)
+		case xzFilterX86:
+			bcjCode(nil, out[outStart:], BCJX86, f.start, false)
+		case xzFilterARM64:
+			bcjCode(nil, out[outStart:], BCJARM64, f.start, false)
+		}
+	}
+	unpadded := x.pos - blockStart + xzCheckSize(check)
+	for x.pos%4 != 0 {
+		if x.pos >= len(x.data) {
+			return nil, 0, x.truncated()
+		}
+		if x.data[x.pos] != 0 {
+			return nil, 0, x.corrupt()
+		}
+		x.pos++
+	}
+
+	sum, err := x.need(xzCheckSize(check))
+	if err != nil {
+		return nil, 0, err
+	}
+	decoded := out[outStart:]
+	ok := true
+	switch check {
+	case 0x01:
+		ok = crc32.ChecksumIEEE(decoded) == binary.LittleEndian.Uint32(sum)
+	case 0x04:
+		ok = crc64.Checksum(decoded, crc64Table) == binary.LittleEndian.Uint64(sum)
+	case 0x0A:
+		digest := sha256.Sum256(decoded)
+		ok = bytes.Equal(digest[:], sum)
+	}
+	if !ok {
+		return nil, 0, &DataError{Stage: "xz", Offset: int64(x.pos), Err: ErrChecksum}
+	}
+	x.pos += len(sum)
+	return out, unpadded, nil
+}
+
+// xzCheckSize is the size of a check of the given type. Types other than
+// none, CRC32, CRC64 and SHA-256 are reserved and only skipped.
+func xzCheckSize(check byte) int {
+	if check == 0 {
+		return 0
+	}
+	return 4 << ((check - 1) / 3)
+}
+
+// lzma2 decodes the chunks of an LZMA2 stream. Each chunk either stores
+// bytes as they are or holds LZMA packets, and may reset the dictionary,
+// the probs and state, or the properties before it.
+func (x *xzReader) lzma2(t *tracker, out []byte) ([]byte, error) {
+	d := x.d
+	start := len(out)
+	needDict, needProps := true, true
+	for {
+		b, err := x.need(1)
+		if err != nil {
+			return nil, err
+		}
+		control := b[0]
+		if control == 0 {
+			x.pos++
+			return out, nil
+		}
+
+		if control == 1 || control == 2 {
+			head, err := x.need(3)
+			if err != nil {
+				return nil, err
+			}
+			if control == 1 {
+				start, needDict = len(out), false
+			} else if needDict {
+				return nil, x.corrupt()
+			}
+			n := int(binary.BigEndian.Uint16(head[1:])) + 1
+			x.pos += 3
+			stored, err := x.need(n)
+			if err != nil {
+				return nil, err
+			}
+			if !d.limits.allow(d.in, uint64(len(out)+n)) {
+				return nil, tooLarge("xz", x.pos)
+			}
+			out = append(out, stored...)
+			x.pos += n
+			continue
+		}
+		if control < 0x80 {
+			return nil, x.corrupt()
+		}
+
+		head, err := x.need(5)
+		if err != nil {
+			return nil, err
+		}
+		unpacked := int(control&0x1F)<<16 + int(binary.BigEndian.Uint16(head[1:])) + 1
+		packed := int(binary.BigEndian.Uint16(head[3:])) + 1
+		x.pos += 5
+		reset := control >> 5 & 3
+		if reset == 3 {
+			start, needDict = len(out), false
+		} else if needDict {
+			return nil, x.corrupt()
+		}
+		switch {
+		case reset >= 2:
+			b, err := x.need(1)
+			if err != nil {
+				return nil, err
+			}
+			lc, lp, pb, ok := parseLZMAProps(b[0])
+			if !ok || lc+lp > 4 {
+				return nil, x.corrupt()
+			}
+			d.reset(lc, lp, pb)
+			needProps = false
+			x.pos++
+		case needProps:
+			return nil, x.corrupt()
+		case reset == 1:
+			d.reset(d.lc, d.lp, d.pb)
+		}
+
+		chunk, err := x.need(packed)
+		if err != nil {
+			return nil, err
+		}
+		if !d.rc.init(chunk) {
+			return nil, x.corrupt()
+		}
+		d.offset = x.pos
+		out, err = d.decode(t, out, start, len(out)+unpacked)
+		if err == nil && d.rc.pos != len(chunk) {
+			err = ErrCorrupt
+		}
+		if err != nil {
+			return nil, lzmaError("xz", err, x.pos+min(d.rc.pos, len(chunk)))
+		}
+		x.pos += packed
+	}
+}
+
+// index reads the index that follows the blocks of a stream, checks it
+// against the blocks decoded and returns its size.
+func (x *xzReader) index(records []xzRecord) (int, error) {
+	start := x.pos
+	p := x.pos + 1
+	count, ok := uvarint(x.data, &p)
+	if !ok || count != uint64(len(records)) {
+		return 0, x.corrupt()
+	}
+	for _, r := range records {
+		unpadded, ok1 := uvarint(x.data, &p)
+		uncompressed, ok2 := uvarint(x.data, &p)
+		if !ok1 || !ok2 || unpadded != r.unpadded || uncompressed != r.uncompressed {
+			return 0, x.corrupt()
+		}
+	}
+	for p%4 != 0 {
+		if p >= len(x.data) {
+			return 0, x.truncated()
+		}
+		if x.data[p] != 0 {
+			return 0, x.corrupt()
+		}
+		p++
+	}
+	x.pos = p
+	sum, err := x.need(4)
+	if err != nil {
+		return 0, err
+	}
+	if crc32.ChecksumIEEE(x.data[start:p]) != binary.LittleEndian.Uint32(sum) {
+		return 0, &DataError{Stage: "xz", Offset: int64(p), Err: ErrChecksum}
+	}
+	x.pos += 4
+	return x.pos - start, nil
+}
@@ -0,0 +1,137 @@
+// errors.go
+package main
+
+import (
+	"errors"
+	"filecompressor/compress"
+	"fmt"
+	"io/fs"
+)
+
+// Error codes reported in -json output. They are part of the interface for
+// scripts and must not change meaning.
+const (
+	codeUsage            = "usage"             // invalid flags or arguments
+	codeUnknownAlgorithm = "unknown_algorithm" // -algo names an unregistered stage
+	codeNotFound         = "not_found"         // an input or key file does not exist
+	codePermission       = "permission"        // a file could not be read or written for lack of permission
+	codeExists           = "exists"            // the output exists and -f was not given
+	codeIO               = "io"                // any other read or write failure
+	codeCorrupt          = "corrupt"           // the input is not valid compressed data
+	codeChecksum         = "checksum"          // the data decoded but does not match its checksum
+	codeDecrypt          = "decrypt"           // wrong key or passphrase, or tampered data
+	codeKeyRequired      = "key_required"      // the input is encrypted and no key was given
+	codeDictRequired     = "dict_required"     // the chain names a dictionary that was not loaded with -dict
+	codeOutputLimit      = "output_limit"      // decoding would exceed -max-output, -max-ratio or -max-memory
+	codeInternal         = "internal"          // anything else
+)
+
+// Exit codes of the CLI.
+const (
+	exitOK      = 0
+	exitFailure = 1 // internal errors, or failures of different kinds
+	exitUsage   = 2 // invalid flags, arguments or algorithm names
+	exitIO      = 3 // files could not be read or written
+	exitCorrupt = 4 // input is corrupt, fails its checksum or cannot be decrypted
+	exitLimit   = 5 // decoding would exceed -max-output, -max-ratio or -max-memory
+)
+
+// exitCode maps err to the exit status of the process.
+func exitCode(err error) int {
+	var files *filesError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &files):
+		return files.exit
+	}
+	switch errorCode(err) {
+	case codeUsage, codeUnknownAlgorithm, codeKeyRequired, codeDictRequired:
+		return exitUsage
+	case codeNotFound, codePermission, codeExists, codeIO:
+		return exitIO
+	case codeCorrupt, codeChecksum, codeDecrypt:
+		return exitCorrupt
+	case codeOutputLimit:
+		return exitLimit
+	}
+	return exitFailure
+}
+
+// filesError is returned when some of several files failed. Its exit code
+// is that of the failures if they all agree.
+type filesError struct {
+	failed, total int
+	exit          int
+}
+
+func (e *filesError) Error() string {
+	return fmt.Sprintf("%d of %d files failed", e.failed, e.total)
+}
+
+// add records one failure.
+func (e *filesError) add(err error) {
+	code := exitCode(err)
+	if e.failed == 0 {
+		e.exit = code
+	} else if e.exit != code {
+		e.exit = exitFailure
+	}
+	e.failed++
+}
+
+// codedError attaches an error code to err.
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+func withCode(code string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &codedError{code: code, err: err}
+}
+
+// errorCode classifies err. Causes found in the chain, such as a missing
+// file or a failed decryption, take precedence over codes attached by the
+// caller, which only describe the step that failed.
+func errorCode(err error) string {
+	var pathErr *fs.PathError
+	var coded *codedError
+	switch {
+	case errors.Is(err, compress.ErrDecrypt):
+		return codeDecrypt
+	case errors.Is(err, compress.ErrChecksum):
+		return codeChecksum
+	case errors.Is(err, compress.ErrOutputLimit):
+		return codeOutputLimit
+	case errors.Is(err, compress.ErrCorrupt), errors.Is(err, compress.ErrTruncated):
+		return codeCorrupt
+	case errors.Is(err, compress.ErrUnknownAlgorithm):
+		return codeUnknownAlgorithm
+	case errors.Is(err, compress.ErrUnknownDictionary):
+		return codeDictRequired
+	case errors.Is(err, errWalkFailures):
+		return codeIO
+	case errors.Is(err, fs.ErrNotExist):
+		return codeNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return codePermission
+	case errors.As(err, &coded):
+		return coded.code
+	case errors.As(err, &pathErr):
+		return codeIO
+	}
+	return codeInternal
+}
+
+// reportedError marks a failure already written as a -json record, so it is
+// not reported a second time.
+type reportedError struct{ err error }
+
+func (e *reportedError) Error() string { return e.err.Error() }
+func (e *reportedError) Unwrap() error { return e.err }
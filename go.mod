@@ -1,3 +1,8 @@
 module filecompressor
 
 go 1.21.0
+
+require (
+	golang.org/x/crypto v0.33.0
+	golang.org/x/sys v0.30.0
+)
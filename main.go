@@ -2,130 +2,142 @@
 package main
 
 import (
-	"encoding/hex"
-	"filecompressor/compress"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"strings"
 )
 
-func main() {
-	var algorithms string
-	var decompress bool
-	var verbose bool
-
-	flag.StringVar(&algorithms, "algo", "lzw", "Compression algorithms (comma-separated: lzw,huffman,rle,sf,bwt)")
-	flag.BoolVar(&decompress, "d", false, "Decompress mode")
-	flag.BoolVar(&verbose, "v", false, "Verbose output")
-	flag.Parse()
+// command is a filecompressor subcommand.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
 
-	if flag.NArg() < 1 {
-		fmt.Println("Usage: compress [-d] [-v] [-algo=<algorithm>] <filename>")
-		os.Exit(1)
+func commands() []command {
+	return []command{
+		{"compress", "Compress files", runCompress},
+		{"decompress", "Decompress files", runDecompress},
+		{"test", "Verify that compressed files decompress, without writing anything", runTest},
+		{"info", "Show header, chain, sizes and ratio of compressed files", runInfo},
+		{"list", "List the available algorithms", runList},
+		{"bench", "Compare ratio, speed and memory of chains over files", runBench},
+		{"analyze", "Report entropy, runs, repeats and code lengths of files", runAnalyze},
+		{"train", "Build a dictionary for many small, similar inputs from samples", runTrain},
+		{"help", "Show help for a command", runHelp},
 	}
+}
 
-	algoList := strings.Split(algorithms, ",")
-	chain := make([]compress.Compressor, 0)
+func main() {
+	if code := run(os.Args[1:]); code != 0 {
+		os.Exit(code)
+	}
+}
 
-	for _, algo := range algoList {
-		switch algo {
-		case "lzw":
-			chain = append(chain, compress.NewLZWCompressor())
-		case "huffman":
-			chain = append(chain, compress.NewHuffmanCompressor())
-		case "rle":
-			chain = append(chain, compress.NewRLECompressor())
-		case "sf":
-			chain = append(chain, compress.NewShannonFanoCompressor())
-		case "bwt":
-			chain = append(chain, compress.NewBWTCompressor(1024))
-		default:
-			fmt.Printf("Unknown algorithm: %s\n", algo)
-			os.Exit(1)
+// run executes the command line and returns the process exit code. Without
+// a subcommand it behaves like the original single flag set, where -d
+// switches to decompression.
+func run(args []string) int {
+	var err error
+	if len(args) > 0 {
+		if cmd, ok := lookupCommand(args[0]); ok {
+			err = cmd.run(args[1:])
+		} else {
+			err = runLegacy(args)
 		}
+	} else {
+		usage()
+		return exitUsage
 	}
 
-	compressor := compress.NewCompressionChain(chain...)
-	filename := flag.Arg(0)
-
-	data, err := ioutil.ReadFile(filename)
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
 	if err != nil {
-		fmt.Printf("Error reading file: %v\n", err)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 	}
+	return exitCode(err)
+}
 
-	if verbose {
-		fmt.Printf("Original size: %d bytes\n", len(data))
+func lookupCommand(name string) (command, bool) {
+	for _, cmd := range commands() {
+		if cmd.name == name {
+			return cmd, true
+		}
 	}
+	return command{}, false
+}
 
-	var result []byte
-	if decompress {
-		for _, filename := range flag.Args() {
-			data, err := ioutil.ReadFile(filename)
-			if err != nil {
-				fmt.Printf("Error reading file %s: %v\n", filename, err)
-				os.Exit(1)
-			}
-			decompressedData, err := decompressData(data, algoList)
-			if err != nil {
-				fmt.Printf("Error during decompression: %v\n", err)
-				os.Exit(1)
-			}
-			outputFilename := strings.TrimSuffix(filename, ".comp")
-			if err := ioutil.WriteFile(outputFilename, decompressedData, 0644); err != nil {
-				fmt.Printf("Error writing decompressed file %s: %v\n", outputFilename, err)
-				os.Exit(1)
-			}
-		}
-	} else {
-		result, err = compressor.Compress(data)
-		if err != nil {
-			fmt.Printf("Error during compression: %v\n", err)
-			os.Exit(1)
-		}
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: filecompressor <command> [flags] <file>...\n\nCommands:\n")
+	for _, cmd := range commands() {
+		fmt.Fprintf(os.Stderr, "  %-11s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 'filecompressor help <command>' for the flags of a command.\n")
+	fmt.Fprintf(os.Stderr, "Without a command, 'filecompressor [-d] [flags] <file>' compresses, or decompresses with -d.\n")
+}
 
-		if verbose {
-			fmt.Printf("Compressed size: %d bytes\n", len(result))
-			fmt.Printf("Compression ratio: %.2f%%\n", float64(len(result))/float64(len(data))*100)
-			fmt.Printf("First 32 bytes: %s\n", hex.EncodeToString(result[:min(32, len(result))]))
-		}
+func runHelp(args []string) error {
+	if len(args) == 0 {
+		usage()
+		return nil
+	}
+	cmd, ok := lookupCommand(args[0])
+	if !ok || cmd.name == "help" {
+		usage()
+		return withCode(codeUsage, fmt.Errorf("unknown command: %s", args[0]))
+	}
+	return cmd.run([]string{"-h"})
+}
 
-		// Verify compression
-		if len(result) == 0 {
-			fmt.Printf("Error: Compression produced empty result\n")
-			os.Exit(1)
-		}
+// runLegacy keeps 'filecompressor [-d] [flags] <file>...' working.
+func runLegacy(args []string) error {
+	var o options
+	var decompress bool
 
-		outfile := filename + ".comp"
-		err = ioutil.WriteFile(outfile, result, 0644)
-		if err != nil {
-			fmt.Printf("Error writing compressed file: %v\n", err)
-			os.Exit(1)
-		}
-		fmt.Printf("Successfully compressed to: %s using algorithms: %s\n", outfile, algorithms)
+	fs := newFlagSet("", "[-d] [flags] <file>|-...", "Compress files, or decompress them with -d.")
+	fs.BoolVar(&decompress, "d", false, "Decompress mode")
+	o.outputFlags(fs, true)
+	o.chainFlags(fs)
+	o.dicts.flags(fs)
+	o.keyFlags(fs, true)
+	o.limitFlags(fs)
+	o.walk.flags(fs)
+	o.meta.flags(fs)
+	o.jsonFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if decompress {
+		return o.finishJSON(decompressFiles(&o, fs.Args()))
+	}
+	return o.finishJSON(compressFiles(&o, fs.Args()))
+}
+
+// parseFlags parses args and marks flag errors as usage errors.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return withCode(codeUsage, err)
 	}
+	return nil
 }
 
-func decompressData(data []byte, algorithms []string) ([]byte, error) {
-	chain := make([]compress.Compressor, 0)
-	for _, algo := range algorithms {
-		switch algo {
-		case "lzw":
-			chain = append(chain, compress.NewLZWCompressor())
-		case "huffman":
-			chain = append(chain, compress.NewHuffmanCompressor())
-		case "rle":
-			chain = append(chain, compress.NewRLECompressor())
-		case "sf":
-			chain = append(chain, compress.NewShannonFanoCompressor())
-		case "bwt":
-			chain = append(chain, compress.NewBWTCompressor(1024))
+// newFlagSet returns a flag set whose -h output shows the command usage and
+// summary before the flags.
+func newFlagSet(name, args, summary string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		prog := "filecompressor"
+		if name != "" {
+			prog += " " + name
 		}
+		fmt.Fprintf(fs.Output(), "Usage: %s %s\n\n%s\n\nFlags:\n", prog, args, summary)
+		fs.PrintDefaults()
 	}
-	compressor := compress.NewCompressionChain(chain...)
-	return compressor.Decompress(data)
+	return fs
 }
 
 func min(a, b int) int {
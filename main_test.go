@@ -3,34 +3,26 @@ package main
 
 import (
     "bytes"
+    "context"
+    "encoding/json"
     "filecompressor/compress"
+    "fmt"
+    "io/fs"
     "io/ioutil"
+    "math/rand"
     "os"
     "testing"
     "path/filepath"
     "strings"
+    "time"
 )
 
 // Helper function to handle compression
 func compressData(data []byte, algorithms string) ([]byte, error) {
-    chain := make([]compress.Compressor, 0)
-    
-    for _, algo := range strings.Split(algorithms, ",") {
-        switch algo {
-        case "lzw":
-            chain = append(chain, compress.NewLZWCompressor())
-        case "huffman":
-            chain = append(chain, compress.NewHuffmanCompressor())
-        case "rle":
-            chain = append(chain, compress.NewRLECompressor())
-        case "sf":
-            chain = append(chain, compress.NewShannonFanoCompressor())
-        case "bwt":
-            chain = append(chain, compress.NewBWTCompressor(1024))
-        }
+    compressor, err := compress.ParseChain(algorithms)
+    if err != nil {
+        return nil, err
     }
-    
-    compressor := compress.NewCompressionChain(chain...)
     return compressor.Compress(data)
 }
 
@@ -84,23 +76,10 @@ func TestAllAlgorithms(t *testing.T) {
                     t.Fatalf("Failed to read compressed file: %v", err)
                 }
 
-                chain := make([]compress.Compressor, 0)
-                for _, a := range strings.Split(algo, ",") {
-                    switch a {
-                    case "lzw":
-                        chain = append(chain, compress.NewLZWCompressor())
-                    case "huffman":
-                        chain = append(chain, compress.NewHuffmanCompressor())
-                    case "rle":
-                        chain = append(chain, compress.NewRLECompressor())
-                    case "sf":
-                        chain = append(chain, compress.NewShannonFanoCompressor())
-                    case "bwt":
-                        chain = append(chain, compress.NewBWTCompressor(1024))
-                    }
+                compressor, err := compress.ParseChain(algo)
+                if err != nil {
+                    t.Fatalf("Failed to build chain: %v", err)
                 }
-
-                compressor := compress.NewCompressionChain(chain...)
                 decompressed, err := compressor.Decompress(compressedData)
                 if err != nil {
                     t.Fatalf("Decompression failed: %v", err)
@@ -158,4 +137,717 @@ func TestLargeFile(t *testing.T) {
 			os.Remove(compressFile)
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestStoredFallback(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	inputs := map[string][]byte{
+		"rle":     []byte("abcdefghijklmnopqrstuvwxyz"),
+		"lzw":     []byte("tiny"),
+		"huffman": random,
+	}
+
+	for algo, input := range inputs {
+		out, used, err := compressPayload(context.Background(), input, algo, nil, compress.Header{})
+		if err != nil {
+			t.Fatalf("%s: %v", algo, err)
+		}
+		if used != "store" {
+			t.Errorf("%s: expected fallback to store, got %s", algo, used)
+		}
+		// Magic, version, chain, checksum and end tag.
+		if overhead := len(out) - len(input); overhead > 19 {
+			t.Errorf("%s: stored output is %d bytes larger than the input", algo, overhead)
+		}
+
+		restored, _, err := decompressData(context.Background(), out, "lzw", nil, compress.DefaultLimits)
+		if err != nil {
+			t.Fatalf("%s: %v", algo, err)
+		}
+		if !bytes.Equal(input, restored) {
+			t.Errorf("%s: data mismatch after stored round trip", algo)
+		}
+	}
+}
+
+func TestSubcommands(t *testing.T) {
+	dir := t.TempDir()
+	input := []byte("Repeated repeated repeated repeated data")
+	names := []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")}
+	for _, name := range names {
+		if err := ioutil.WriteFile(name, input, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if code := run(append([]string{"compress", "-algo=bwt,rle"}, names...)); code != 0 {
+		t.Fatalf("compress exited with %d", code)
+	}
+	compressed := []string{names[0] + ".comp", names[1] + ".comp"}
+	if code := run(append([]string{"test"}, compressed...)); code != 0 {
+		t.Fatalf("test exited with %d", code)
+	}
+	if code := run(append([]string{"info"}, compressed...)); code != 0 {
+		t.Fatalf("info exited with %d", code)
+	}
+
+	for _, name := range names {
+		os.Remove(name)
+	}
+	if code := run(append([]string{"decompress"}, compressed...)); code != 0 {
+		t.Fatalf("decompress exited with %d", code)
+	}
+	for _, name := range names {
+		got, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, input) {
+			t.Errorf("%s: data mismatch after decompress", name)
+		}
+	}
+
+	if code := run([]string{"test", filepath.Join(dir, "missing.comp")}); code == 0 {
+		t.Error("test of a missing file succeeded")
+	}
+	if code := run([]string{"nosuchflag", "-x"}); code == 0 {
+		t.Error("unknown flag accepted")
+	}
+}
+
+// Without a command, inputs are kept and outputs overwritten, as they were
+// before the commands.
+func TestLegacyKeepsInput(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "a.txt")
+	input := []byte("Repeated repeated repeated repeated data")
+	if err := ioutil.WriteFile(name, input, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"-q", name}, {"-q", name}, {"-q", "-d", name + ".comp"}} {
+		if code := run(args); code != exitOK {
+			t.Fatalf("%v exited with %d", args, code)
+		}
+	}
+	for _, file := range []string{name, name + ".comp"} {
+		if _, err := os.Stat(file); err != nil {
+			t.Errorf("%s was removed: %v", file, err)
+		}
+	}
+	if got, _ := ioutil.ReadFile(name); !bytes.Equal(got, input) {
+		t.Error("data mismatch after decompress")
+	}
+
+	if code := run([]string{"-q", "-k=false", name}); code != exitOK {
+		t.Fatalf("-k=false exited with %d", code)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("-k=false kept the input: %v", err)
+	}
+}
+
+// myfile.txt.comp was written by the last version without the header.
+func TestLegacyFile(t *testing.T) {
+	data, err := ioutil.ReadFile("myfile.txt.comp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile("myfile.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := decompressData(context.Background(), data, "huffman", nil, compress.DefaultLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRecursiveCompress(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]bool{
+		"a.log":          true,
+		"notes.txt":      false,
+		"sub/b.log":      true,
+		"sub/deep/c.log": true,
+		"vendor/d.log":   false,
+	}
+	for name := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte("log log log log log log"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if code := run([]string{"compress", "-r", "-include=*.log", "-exclude=vendor", "-algo=rle", dir}); code != 0 {
+		t.Fatalf("compress -r exited with %d", code)
+	}
+
+	for name, want := range files {
+		_, err := os.Stat(filepath.Join(dir, name) + ".comp")
+		if got := err == nil; got != want {
+			t.Errorf("%s.comp exists = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestOutputOptions(t *testing.T) {
+	dir := t.TempDir()
+	input := []byte("Repeated repeated repeated repeated data")
+	name := filepath.Join(dir, "data.txt")
+	if err := ioutil.WriteFile(name, input, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// -k keeps the input, and a second run refuses to overwrite without -f.
+	if code := run([]string{"compress", "-k", "-S", ".fc", "-algo=bwt,rle", name}); code != 0 {
+		t.Fatalf("compress exited with %d", code)
+	}
+	if _, err := os.Stat(name); err != nil {
+		t.Fatalf("input removed despite -k: %v", err)
+	}
+	if code := run([]string{"compress", "-k", "-S", ".fc", "-algo=bwt,rle", name}); code == 0 {
+		t.Error("existing output overwritten without -f")
+	}
+	if code := run([]string{"compress", "-k", "-f", "-S", ".fc", "-algo=bwt,rle", name}); code != 0 {
+		t.Errorf("compress -f exited with %d", code)
+	}
+
+	// Without -k the input is removed once the output is written.
+	out := filepath.Join(dir, "restored.txt")
+	if code := run([]string{"decompress", "-S", ".fc", "-o", out, name + ".fc"}); code != 0 {
+		t.Fatalf("decompress exited with %d", code)
+	}
+	if _, err := os.Stat(name + ".fc"); !os.IsNotExist(err) {
+		t.Errorf("compressed input not removed: %v", err)
+	}
+	got, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, input) {
+		t.Error("data mismatch after decompress -o")
+	}
+
+	// A name without the suffix is not decompressed over itself.
+	if code := run([]string{"decompress", out}); code == 0 {
+		t.Error("file without suffix was decompressed")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out")
+	if err := writeFileAtomic(path, []byte("first"), 0600, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(path, []byte("second"), 0600, false); errorCode(err) != codeExists {
+		t.Errorf("second write without force: got %v, want %s", err, codeExists)
+	}
+	if got, _ := ioutil.ReadFile(path); string(got) != "first" {
+		t.Errorf("existing file replaced: %q", got)
+	}
+	if err := writeFileAtomic(path, []byte("third"), 0600, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadFile(path); string(got) != "third" {
+		t.Errorf("force did not replace the file: %q", got)
+	}
+
+	// No temporary files are left behind, nor extra links to the output.
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("directory holds %v, want only out (%v)", entries, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600 (%v)", info.Mode().Perm(), err)
+	}
+}
+
+func TestMetadataRestore(t *testing.T) {
+	dir := t.TempDir()
+	input := []byte("metadata metadata metadata metadata")
+	name := filepath.Join(dir, "notes.txt")
+	if err := ioutil.WriteFile(name, input, 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 5, 17, 10, 30, 0, 0, time.UTC)
+	if err := os.Chtimes(name, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := run([]string{"compress", "-algo=rle", name}); code != 0 {
+		t.Fatalf("compress exited with %d", code)
+	}
+
+	// The stored name wins over the name of the compressed file.
+	renamed := filepath.Join(dir, "copy.comp")
+	if err := os.Rename(name+".comp", renamed); err != nil {
+		t.Fatal(err)
+	}
+	if code := run([]string{"decompress", "-k", renamed}); code != 0 {
+		t.Fatalf("decompress exited with %d", code)
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatalf("original name not restored: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", info.Mode().Perm())
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("mtime = %v, want %v", info.ModTime(), mtime)
+	}
+
+	// The opt-outs fall back to the suffix rule and the current time.
+	if code := run([]string{"decompress", "-no-name", "-no-mtime", renamed}); code != 0 {
+		t.Fatalf("decompress -no-name exited with %d", code)
+	}
+	info, err = os.Stat(filepath.Join(dir, "copy"))
+	if err != nil {
+		t.Fatalf("suffix rule not used with -no-name: %v", err)
+	}
+	if info.ModTime().Equal(mtime) {
+		t.Error("mtime restored despite -no-mtime")
+	}
+}
+
+// With -encrypt the header is authenticated: a changed mode fails to
+// decrypt instead of being restored.
+func TestEncryptedHeaderTampering(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "secret.txt")
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(name, []byte("secret secret secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, bytes.Repeat([]byte("ab"), 32), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := run([]string{"compress", "-q", "-encrypt", "-key-file", keyFile, name}); code != exitOK {
+		t.Fatalf("compress exited with %d", code)
+	}
+	packed, err := ioutil.ReadFile(name + ".comp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mode0600 := []byte{4, 2, 0x80, 0x03} // tag, length, uvarint 0600
+	if !bytes.Contains(packed, mode0600) {
+		t.Fatal("mode field not found")
+	}
+	tampered := bytes.Replace(packed, mode0600, []byte{4, 2, 0xff, 0x03}, 1)
+	if err := ioutil.WriteFile(name+".comp", tampered, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code := run([]string{"decompress", "-q", "-key-file", keyFile, name + ".comp"}); code != exitCorrupt {
+		t.Errorf("decompress of a tampered header exited with %d, want %d", code, exitCorrupt)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("output written despite the tampered header: %v", err)
+	}
+}
+
+// A stored name never replaces the input, and without a command, where
+// outputs are overwritten, it is not used at all.
+func TestStoredNameSafety(t *testing.T) {
+	dir := t.TempDir()
+	pack := func(file, stored string) {
+		packed, _, err := compressPayload(context.Background(), []byte("payload"), "store", nil, compress.Header{Name: stored})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, file), packed, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pack("x.z", "x.z")
+	if code := run([]string{"decompress", "-q", "-f", "-S", ".z", filepath.Join(dir, "x.z")}); code != exitUsage {
+		t.Errorf("decompressing over the input exited with %d, want %d", code, exitUsage)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "x.z")); err != nil {
+		t.Errorf("input lost: %v", err)
+	}
+
+	victim := filepath.Join(dir, "victim")
+	if err := ioutil.WriteFile(victim, []byte("keep me"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pack("other.comp", "victim")
+	if code := run([]string{"-q", "-d", filepath.Join(dir, "other.comp")}); code != exitOK {
+		t.Fatalf("legacy decompress exited with %d", code)
+	}
+	if got, _ := ioutil.ReadFile(victim); string(got) != "keep me" {
+		t.Errorf("victim overwritten with %q", got)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "other")); string(got) != "payload" {
+		t.Errorf("output = %q, want the payload under the suffix rule", got)
+	}
+}
+
+// Setuid, setgid and sticky bits in a header are not restored.
+func TestSpecialModeBits(t *testing.T) {
+	dir := t.TempDir()
+	meta := compress.Header{Mode: 0755 | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky}
+	packed, _, err := compressPayload(context.Background(), []byte("#!/bin/sh\n"), "store", nil, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "tool.comp")
+	if err := ioutil.WriteFile(name, packed, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code := run([]string{"decompress", "-q", name}); code != exitOK {
+		t.Fatalf("decompress exited with %d", code)
+	}
+	info, err := os.Stat(filepath.Join(dir, "tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode(); mode != 0755 {
+		t.Errorf("mode = %v, want %v", mode, fs.FileMode(0755))
+	}
+}
+
+func TestBench(t *testing.T) {
+	data := bytes.Repeat([]byte("bench bench bench "), 200)
+	chain, err := compress.ParseChain("bwt,rle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := benchChain("data", "bwt,rle", chain, data, 2)
+	if r.Error != "" || !r.Verified {
+		t.Fatalf("bench failed: %+v", r)
+	}
+	if r.Size != len(data) || r.Compressed == 0 || r.Ratio <= 0 || r.CompressNanos <= 0 {
+		t.Errorf("incomplete result: %+v", r)
+	}
+
+	var buf bytes.Buffer
+	if err := writeBench(&buf, "json", []benchResult{r}); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []benchResult
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 1 || decoded[0] != r {
+		t.Errorf("json = %+v, want %+v", decoded, r)
+	}
+
+	buf.Reset()
+	if err := writeBench(&buf, "csv", []benchResult{r}); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 2 {
+		t.Errorf("csv has %d lines, want header and one row", lines)
+	}
+}
+
+func TestAnalyzeOutput(t *testing.T) {
+	stats := compress.ComputeStatistics([]byte("hello, hello, hello"))
+	a := newAnalysis("greeting", stats, 3)
+	if len(a.Bytes) != 3 || a.Bytes[0].Value != 'l' {
+		t.Fatalf("top bytes = %+v, want 3 starting with 'l'", a.Bytes)
+	}
+
+	var buf bytes.Buffer
+	if err := printAnalysis(&buf, a); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"entropy (order 0)", "lz repeats", "'l'", "(3 more)"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+// captureStdout runs fn with os.Stdout redirected to a file and returns
+// what was written.
+func captureStdout(t *testing.T, fn func()) []byte {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	saved := os.Stdout
+	os.Stdout = f
+	defer func() { os.Stdout = saved }()
+	fn()
+
+	out, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestJSONOutput(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "data.txt")
+	input := bytes.Repeat([]byte("json json json "), 20)
+	if err := ioutil.WriteFile(name, input, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var code int
+	out := captureStdout(t, func() {
+		code = run([]string{"compress", "-json", "-k", "-algo=bwt,rle", name, filepath.Join(dir, "missing")})
+	})
+	if code == 0 {
+		t.Error("missing input did not fail the command")
+	}
+
+	var records []fileRecord
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for dec.More() {
+		var rec fileRecord
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("invalid JSON output %q: %v", out, err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2:\n%s", len(records), out)
+	}
+
+	ok := records[0]
+	if ok.Error != nil || ok.Command != "compress" || ok.Output != name+".comp" ||
+		ok.InputSize != len(input) || ok.OutputSize == 0 || ok.Chain == "" || ok.Checksum != checksum(input) {
+		t.Errorf("unexpected record %+v", ok)
+	}
+	if failed := records[1]; failed.Error == nil || failed.Error.Code != codeNotFound {
+		t.Errorf("missing input reported as %+v, want code %s", failed.Error, codeNotFound)
+	}
+
+	// Errors outside of a file are reported as a single error record.
+	out = captureStdout(t, func() {
+		run([]string{"compress", "-json", "-algo=nope", name})
+	})
+	var rec errorRecord
+	if err := json.Unmarshal(out, &rec); err != nil || rec.Error.Code != codeUnknownAlgorithm {
+		t.Errorf("error record %q, want code %s", out, codeUnknownAlgorithm)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "data.txt")
+	if err := ioutil.WriteFile(name, bytes.Repeat([]byte("exit codes "), 30), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code := run([]string{"compress", "-k", "-algo=bwt,rle", name}); code != exitOK {
+		t.Fatalf("compress exited with %d", code)
+	}
+	compressed, err := ioutil.ReadFile(name + ".comp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a payload bit: the data still decodes but fails its checksum.
+	damaged := filepath.Join(dir, "damaged.comp")
+	compressed[len(compressed)-1] ^= 1
+	if err := ioutil.WriteFile(damaged, compressed, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{[]string{"test", name + ".comp"}, exitOK},
+		{[]string{"compress", "-no-such-flag", name}, exitUsage},
+		{[]string{"compress", "-algo=nope", name}, exitUsage},
+		{[]string{"test", filepath.Join(dir, "missing.comp")}, exitIO},
+		{[]string{"compress", "-k", name}, exitIO},
+		{[]string{"test", damaged}, exitCorrupt},
+		{[]string{"test", "-max-output=100", name + ".comp"}, exitLimit},
+		{[]string{"test", "-max-output=1k", name + ".comp"}, exitOK},
+		{[]string{"test", "-max-output=lots", name + ".comp"}, exitUsage},
+		{[]string{"test", damaged, filepath.Join(dir, "missing.comp")}, exitFailure},
+	}
+	for _, tt := range tests {
+		if code := run(tt.args); code != tt.want {
+			t.Errorf("%v exited with %d, want %d", tt.args, code, tt.want)
+		}
+	}
+}
+
+// Files far larger and more compressible than any fixed limit read back by
+// default, and a limit that is set fails with its own exit code.
+func TestOutputLimit(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "zeros")
+	input := make([]byte, 32<<20)
+	if err := ioutil.WriteFile(name, input, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code := run([]string{"compress", "-q", "-algo=lzw", name}); code != exitOK {
+		t.Fatalf("compress exited with %d", code)
+	}
+	if code := run([]string{"decompress", "-q", "-k", "-f", name + ".comp"}); code != exitOK {
+		t.Fatalf("decompress exited with %d", code)
+	}
+	if got, _ := ioutil.ReadFile(name); !bytes.Equal(got, input) {
+		t.Error("data mismatch after decompress")
+	}
+	for _, args := range [][]string{
+		{"test", "-max-output=16m", name + ".comp"},
+		{"test", "-max-ratio=1000", name + ".comp"},
+	} {
+		if code := run(args); code != exitLimit {
+			t.Errorf("%v exited with %d, want %d", args, code, exitLimit)
+		}
+	}
+}
+
+// Standard input is read whole, up to -max-stdin.
+func TestMaxStdin(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "input.txt")
+	if err := ioutil.WriteFile(name, bytes.Repeat([]byte("standard input "), 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdin
+	defer func() { os.Stdin = saved }()
+
+	for _, tt := range []struct {
+		limit string
+		want  int
+	}{
+		{"1k", exitIO},
+		{"2k", exitOK},
+		{"0", exitOK},
+	} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Stdin = f
+		var code int
+		out := captureStdout(t, func() { code = run([]string{"compress", "-q", "-max-stdin=" + tt.limit, "-"}) })
+		f.Close()
+		if code != tt.want {
+			t.Errorf("-max-stdin=%s exited with %d, want %d", tt.limit, code, tt.want)
+		}
+		if code == exitOK && !compress.IsContainer(out) {
+			t.Errorf("-max-stdin=%s: no compressed output", tt.limit)
+		}
+	}
+}
+
+func TestTrainDictionary(t *testing.T) {
+	dir := t.TempDir()
+	r := rand.New(rand.NewSource(1))
+	message := func() []byte {
+		return []byte(fmt.Sprintf(`{"event":"order.created","order_id":%d,"customer":{"id":%d,"country":"DE"},"total":{"value":%d,"currency":"EUR"}}`,
+			r.Intn(1000000), r.Intn(100000), r.Intn(1000)))
+	}
+	var samples bytes.Buffer
+	for i := 0; i < 500; i++ {
+		samples.Write(message())
+		samples.WriteByte('\n')
+	}
+	samplesFile := filepath.Join(dir, "samples.jsonl")
+	messageFile := filepath.Join(dir, "message.json")
+	if err := ioutil.WriteFile(samplesFile, samples.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(messageFile, message(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dictFile := filepath.Join(dir, "orders.dict")
+	var code int
+	out := captureStdout(t, func() {
+		code = run([]string{"train", "-lines", "-size=4k", "-o", dictFile, samplesFile})
+	})
+	if code != exitOK {
+		t.Fatalf("train exited with %d", code)
+	}
+	data, err := ioutil.ReadFile(dictFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict, err := compress.ParseDict(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), dict.String()) {
+		t.Errorf("train output %q lacks the ID %s", out, dict)
+	}
+
+	// The message alone would be stored; with the dictionary it shrinks,
+	// and the header records which dictionary it needs.
+	spec := "lzw:dict=" + dict.String()
+	captureStdout(t, func() {
+		code = run([]string{"compress", "-k", "-dict=" + dictFile, "-algo=" + spec, messageFile})
+	})
+	if code != exitOK {
+		t.Fatalf("compress exited with %d", code)
+	}
+	compressed, err := ioutil.ReadFile(messageFile + ".comp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header, _, err := compress.Unpack(compressed); err != nil || header.Chain != spec {
+		t.Errorf("header chain %q, want %q (%v)", header.Chain, spec, err)
+	}
+	if code := run([]string{"test", "-dict=" + dictFile, messageFile + ".comp"}); code != exitOK {
+		t.Errorf("test exited with %d", code)
+	}
+
+	packed := compress.Pack(compress.Header{Chain: "lzw:dict=0badd1c7"}, []byte{1, 2, 3, 4})
+	if _, _, err := decompressData(context.Background(), packed, "lzw", nil, compress.DefaultLimits); errorCode(err) != codeDictRequired {
+		t.Errorf("missing dictionary reported as %q (%v), want %s", errorCode(err), err, codeDictRequired)
+	}
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{[]string{"train", "-o", filepath.Join(dir, "d"), filepath.Join(dir, "missing")}, exitIO},
+		{[]string{"train", "-size=1", "-o", filepath.Join(dir, "d"), samplesFile}, exitUsage},
+		{[]string{"train", "-o", dictFile, samplesFile}, exitIO},
+		{[]string{"test", "-dict=" + filepath.Join(dir, "missing"), messageFile + ".comp"}, exitIO},
+		{[]string{"test", "-dict=" + samplesFile, messageFile + ".comp"}, exitCorrupt},
+	}
+	for _, tt := range tests {
+		if code := run(tt.args); code != tt.want {
+			t.Errorf("%v exited with %d, want %d", tt.args, code, tt.want)
+		}
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	var buf bytes.Buffer
+	bar := newProgressBar(&buf, "big.bin", 4<<20)
+	bar.delay = 0
+	bar.start = time.Now().Add(-2 * time.Second)
+
+	// Encryption runs outside the chain and is not drawn.
+	bar.update(compress.Progress{Name: "encrypt", Total: 100})
+	if buf.Len() != 0 {
+		t.Fatalf("drew %q for a stage outside the chain", buf.String())
+	}
+
+	bar.update(compress.Progress{Stage: 0, Stages: 2, Name: "bwt", Total: 4 << 20})
+	bar.update(compress.Progress{Stage: 0, Stages: 2, Name: "bwt", Done: 4 << 20, Total: 4 << 20})
+	bar.update(compress.Progress{Stage: 1, Stages: 2, Name: "huffman", Done: 4 << 20, Total: 4 << 20})
+	out := buf.String()
+	for _, want := range []string{"big.bin  bwt 1/2", " 50%", "huffman 2/2", "100%", "4.0MiB/4.0MiB", "ETA 0:00"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("progress output %q does not contain %q", out, want)
+		}
+	}
+
+	buf.Reset()
+	bar.clear()
+	if buf.String() != "\r\x1b[K" {
+		t.Errorf("clear wrote %q", buf.String())
+	}
+}
@@ -0,0 +1,104 @@
+// metadata.go
+package main
+
+import (
+	"errors"
+	"filecompressor/compress"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// metadataOptions selects which attributes of the original file are stored
+// when compressing and restored when decompressing. Mode is always kept.
+type metadataOptions struct {
+	noName  bool
+	noMtime bool
+	owner   bool
+	xattrs  bool
+}
+
+func (m *metadataOptions) flags(fs *flag.FlagSet) {
+	fs.BoolVar(&m.noName, "no-name", false, "Do not store or restore the original file name")
+	fs.BoolVar(&m.noMtime, "no-mtime", false, "Do not store or restore the modification time")
+	fs.BoolVar(&m.owner, "owner", false, "Store or restore the owner uid/gid (restoring usually needs root)")
+	fs.BoolVar(&m.xattrs, "xattrs", false, "Store or restore extended attributes")
+}
+
+// permBits are the mode bits stored in the header and restored on files.
+// Like gzip and tar, setuid, setgid and sticky bits are left out: the
+// header is not authenticated, and a crafted file would otherwise produce a
+// setuid executable when root decompresses it.
+const permBits = fs.ModePerm
+
+// collect returns the header fields describing the input file info. Standard
+// input has no metadata.
+func (m *metadataOptions) collect(name string, info fs.FileInfo) (compress.Header, error) {
+	var h compress.Header
+	if name == "-" || info == nil {
+		return h, nil
+	}
+	h.Mode = info.Mode() & permBits
+	if !m.noName {
+		h.Name = filepath.Base(name)
+	}
+	if !m.noMtime {
+		h.ModTime = info.ModTime()
+	}
+	if m.owner {
+		h.UID, h.GID, h.HasOwner = fileOwner(info)
+	}
+	if m.xattrs {
+		attrs, err := readXattrs(name)
+		if err != nil {
+			return h, fmt.Errorf("reading extended attributes: %w", err)
+		}
+		h.Xattrs = attrs
+	}
+	return h, nil
+}
+
+// outputName replaces the base name of path by the name stored in h. Names
+// that could point outside the output directory are ignored.
+func (m *metadataOptions) outputName(path string, h compress.Header) string {
+	name := h.Name
+	if m.noName || name == "" || name == "." || name == ".." ||
+		strings.ContainsAny(name, `/\`) || filepath.Base(name) != name {
+		return path
+	}
+	return filepath.Join(filepath.Dir(path), name)
+}
+
+// restore applies the metadata recorded in h to the file at path. The mode
+// is set when the file is written.
+func (m *metadataOptions) restore(path string, h compress.Header) error {
+	if m.xattrs && len(h.Xattrs) > 0 {
+		if err := writeXattrs(path, h.Xattrs); err != nil {
+			return fmt.Errorf("restoring extended attributes: %w", err)
+		}
+	}
+	if m.owner && h.HasOwner {
+		if err := os.Lchown(path, h.UID, h.GID); err != nil {
+			return fmt.Errorf("restoring owner: %w", err)
+		}
+	}
+	if !m.noMtime && !h.ModTime.IsZero() {
+		if err := os.Chtimes(path, h.ModTime, h.ModTime); err != nil {
+			return fmt.Errorf("restoring modification time: %w", err)
+		}
+	}
+	return nil
+}
+
+// filePerm returns the permissions to create an output with.
+func filePerm(mode fs.FileMode) fs.FileMode {
+	if mode&permBits == 0 {
+		return 0644
+	}
+	return mode & permBits
+}
+
+var errXattrUnsupported = errors.New("extended attributes are not supported on this platform")
@@ -0,0 +1,12 @@
+// metadata_other.go
+
+//go:build !unix
+
+package main
+
+import "io/fs"
+
+// fileOwner reports no owner where files have no uid/gid.
+func fileOwner(info fs.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
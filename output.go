@@ -0,0 +1,155 @@
+// output.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const defaultSuffix = ".comp"
+
+// defaultMaxStdin is the default of -max-stdin.
+const defaultMaxStdin = 1 << 30
+
+// outputPath returns where the result for input name is written. Compressed
+// files get the suffix appended; decompressed files must carry it and lose
+// it, unless -o names the output explicitly.
+func (o *options) outputPath(name string, decompress bool) (string, error) {
+	if o.output != "" {
+		return o.output, nil
+	}
+
+	base := name
+	if decompress {
+		if !strings.HasSuffix(name, o.suffix) || len(name) == len(o.suffix) {
+			return "", withCode(codeUsage, fmt.Errorf("unknown suffix, expected %s (use -o or -S)", o.suffix))
+		}
+		base = strings.TrimSuffix(name, o.suffix)
+	} else {
+		base = name + o.suffix
+	}
+
+	if o.outputDir == "" {
+		return base, nil
+	}
+	// Keep the layout below a walked directory; otherwise use the base name.
+	rel, ok := o.walk.relative[name]
+	if !ok {
+		rel = filepath.Base(name)
+	}
+	if decompress {
+		rel = strings.TrimSuffix(rel, o.suffix)
+	} else {
+		rel += o.suffix
+	}
+	return filepath.Join(o.outputDir, rel), nil
+}
+
+// checkOutputFlags rejects combinations of output flags that cannot work
+// for the given inputs.
+func (o *options) checkOutputFlags(files []string) error {
+	if o.suffix == "" {
+		return withCode(codeUsage, errors.New("-S suffix must not be empty"))
+	}
+	if o.output != "" {
+		switch {
+		case o.outputDir != "":
+			return withCode(codeUsage, errors.New("use either -o or -output-dir, not both"))
+		case o.toStdout:
+			return withCode(codeUsage, errors.New("use either -o or -c, not both"))
+		case len(files) != 1 || o.walk.recursive:
+			return withCode(codeUsage, errors.New("-o needs exactly one input file"))
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, so a crash never leaves a partial output behind. An
+// existing file is only replaced when force is set: otherwise the file is
+// hard-linked into place, which fails if path was created meanwhile, and
+// only renamed on file systems without hard links.
+func writeFileAtomic(path string, data []byte, perm os.FileMode, force bool) error {
+	exists := func() error {
+		return withCode(codeExists, fmt.Errorf("%s already exists (use -f to overwrite)", path))
+	}
+	if !force {
+		if _, err := os.Lstat(path); err == nil {
+			return exists()
+		}
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if !force {
+		err := os.Link(tmp.Name(), path)
+		if errors.Is(err, fs.ErrExist) {
+			return exists()
+		}
+		if err == nil || !linkUnsupported(err) {
+			return err
+		}
+		if _, err := os.Lstat(path); err == nil {
+			return exists()
+		}
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// sameFile reports whether the paths a and b name the same file, either
+// literally or, if both exist, through links.
+func sameFile(a, b string) bool {
+	if b == "-" {
+		return false
+	}
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA == nil && errB == nil && absA == absB {
+		return true
+	}
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(infoA, infoB)
+}
+
+// linkUnsupported reports whether os.Link failed because the file system
+// has no hard links, such as FAT, where Linux reports EPERM.
+func linkUnsupported(err error) bool {
+	return errors.Is(err, errors.ErrUnsupported) || errors.Is(err, fs.ErrPermission)
+}
+
+// removeInput deletes an input once its output has been written, unless -k
+// was given or nothing was written to a file.
+func (o *options) removeInput(name string) error {
+	if o.keep || name == "-" || o.writesStdout(name) {
+		return nil
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,130 @@
+// progress.go
+package main
+
+import (
+	"context"
+	"filecompressor/compress"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// progressDelay keeps the bar away from files that finish quickly.
+	progressDelay = 250 * time.Millisecond
+	// progressRefresh is the shortest time between two redraws.
+	progressRefresh = 100 * time.Millisecond
+	progressWidth   = 20
+)
+
+// progressBar draws the progress of one file on a terminal line: the
+// current stage, bytes processed, throughput and ETA. It is driven by the
+// compress.Progress reports of the chain.
+type progressBar struct {
+	w     io.Writer
+	label string
+	size  int64
+	delay time.Duration
+
+	start time.Time
+	last  time.Time
+	drawn bool
+
+	stage     int // stage of the latest report
+	completed int // stages finished before it
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// startProgress returns a context under which the chain draws a progress
+// bar for a file of size bytes on stderr, and a function that clears it.
+// Without a terminal, or with -q, the bar is disabled.
+func (o *options) startProgress(label string, size int) (context.Context, func()) {
+	if o.quiet || !isTerminal(os.Stderr) {
+		return context.Background(), func() {}
+	}
+	bar := newProgressBar(os.Stderr, label, size)
+	return compress.WithProgress(context.Background(), bar.update), bar.clear
+}
+
+func newProgressBar(w io.Writer, label string, size int) *progressBar {
+	return &progressBar{w: w, label: label, size: int64(size), delay: progressDelay, start: time.Now(), stage: -1}
+}
+
+func (b *progressBar) update(p compress.Progress) {
+	// Stages outside the chain, such as encryption, are not counted.
+	if p.Stages == 0 {
+		return
+	}
+	if p.Stage != b.stage {
+		if b.stage >= 0 {
+			b.completed++
+		}
+		b.stage = p.Stage
+	}
+
+	now := time.Now()
+	if now.Sub(b.start) < b.delay || now.Sub(b.last) < progressRefresh && p.Done != p.Total {
+		return
+	}
+	b.last = now
+
+	// Each stage counts for an equal share of the work.
+	fraction := float64(b.completed) / float64(p.Stages)
+	if p.Total > 0 {
+		fraction += float64(p.Done) / float64(p.Total) / float64(p.Stages)
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	b.draw(p, fraction, now.Sub(b.start))
+}
+
+func (b *progressBar) draw(p compress.Progress, fraction float64, elapsed time.Duration) {
+	filled := int(fraction * progressWidth)
+	bar := strings.Repeat("=", filled)
+	if filled < progressWidth {
+		bar += ">" + strings.Repeat(" ", progressWidth-filled-1)
+	}
+
+	processed := int64(fraction * float64(b.size))
+	rate := "-"
+	eta := "--:--"
+	if seconds := elapsed.Seconds(); seconds > 0 && fraction > 0 {
+		rate = formatBytes(uint64(float64(processed)/seconds)) + "/s"
+		eta = formatETA(time.Duration(float64(elapsed) * (1 - fraction) / fraction))
+	}
+
+	name := p.Name
+	if name == "" {
+		name = "stage"
+	}
+	fmt.Fprintf(b.w, "\r%s  %s %d/%d [%s] %3.0f%%  %s/%s  %s  ETA %s\x1b[K",
+		b.label, name, b.completed+1, p.Stages, bar, fraction*100,
+		formatBytes(uint64(processed)), formatBytes(uint64(b.size)), rate, eta)
+	b.drawn = true
+}
+
+// clear erases the bar, if it was drawn, so later messages start on a clean
+// line.
+func (b *progressBar) clear() {
+	if b.drawn {
+		fmt.Fprint(b.w, "\r\x1b[K")
+		b.drawn = false
+	}
+}
+
+// formatETA formats d as m:ss, or h:mm:ss from an hour up.
+func formatETA(d time.Duration) string {
+	s := int(d.Round(time.Second).Seconds())
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
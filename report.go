@@ -0,0 +1,105 @@
+// report.go
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+)
+
+// fileRecord is the -json description of one processed file. Sizes are in
+// bytes, durations in nanoseconds.
+type fileRecord struct {
+	Command    string  `json:"command"`
+	Input      string  `json:"input"`
+	Output     string  `json:"output,omitempty"`
+	Chain      string  `json:"chain,omitempty"`
+	InputSize  int     `json:"input_size"`
+	OutputSize int     `json:"output_size"`
+	Ratio      float64 `json:"ratio"`
+	// CodecNanos is the time spent compressing or decompressing,
+	// TotalNanos includes reading and writing the files.
+	CodecNanos int64 `json:"codec_ns"`
+	TotalNanos int64 `json:"total_ns"`
+	// Checksum is the SHA-256 of the uncompressed data, so the records of
+	// compressing and decompressing a file can be matched.
+	Checksum string     `json:"checksum,omitempty"`
+	Error    *jsonError `json:"error,omitempty"`
+}
+
+type jsonError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type summaryRecord struct {
+	Summary struct {
+		Files    int   `json:"files"`
+		Failed   int   `json:"failed"`
+		BytesIn  int64 `json:"bytes_in"`
+		BytesOut int64 `json:"bytes_out"`
+	} `json:"summary"`
+}
+
+type errorRecord struct {
+	Error jsonError `json:"error"`
+}
+
+func (o *options) jsonFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&o.json, "json", false, "Print one JSON record per file, and errors as JSON, instead of messages")
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func newJSONError(err error) *jsonError {
+	return &jsonError{Code: errorCode(err), Message: err.Error()}
+}
+
+// report writes the record of one file with -json and returns err, marked
+// as reported if it was.
+func (o *options) report(command string, rec fileRecord, err error) error {
+	if !o.json {
+		return err
+	}
+	rec.Command = command
+	if rec.InputSize > 0 && rec.OutputSize > 0 {
+		if command == "compress" {
+			rec.Ratio = float64(rec.OutputSize) / float64(rec.InputSize) * 100
+		} else {
+			rec.Ratio = float64(rec.InputSize) / float64(rec.OutputSize) * 100
+		}
+	}
+	if err != nil {
+		rec.Error = newJSONError(err)
+	}
+	if werr := json.NewEncoder(o.log).Encode(rec); werr != nil {
+		return werr
+	}
+	if err != nil {
+		return &reportedError{err}
+	}
+	return nil
+}
+
+// finishJSON writes err as an error record with -json unless it was already
+// reported per file.
+func (o *options) finishJSON(err error) error {
+	var reported *reportedError
+	var files *filesError
+	if !o.json || err == nil || errors.As(err, &reported) ||
+		errors.As(err, &files) || errors.Is(err, errWalkFailures) {
+		return err
+	}
+	log := o.log
+	if log == nil {
+		log = os.Stdout
+	}
+	json.NewEncoder(log).Encode(errorRecord{Error: *newJSONError(err)})
+	return err
+}
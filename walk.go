@@ -0,0 +1,221 @@
+// walk.go
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// globList is a repeatable glob flag.
+type globList []string
+
+func (g *globList) String() string { return strings.Join(*g, ",") }
+
+func (g *globList) Set(pattern string) error {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	*g = append(*g, pattern)
+	return nil
+}
+
+// Symlink policies for recursive walks.
+const (
+	symlinksSkip   = "skip"   // ignore symlinks found while walking
+	symlinksFiles  = "files"  // follow symlinks to regular files only
+	symlinksFollow = "follow" // follow symlinks to files and directories
+)
+
+// walkOptions controls how directory arguments are expanded with -r.
+type walkOptions struct {
+	recursive bool
+	include   globList
+	exclude   globList
+	symlinks  string
+
+	// relative maps each file found by a walk to its path below the
+	// directory argument it was found in.
+	relative map[string]string
+}
+
+func (w *walkOptions) flags(fs *flag.FlagSet) {
+	fs.BoolVar(&w.recursive, "r", false, "Recurse into directories")
+	fs.BoolVar(&w.recursive, "recursive", false, "Same as -r")
+	fs.Var(&w.include, "include", "With -r, only process files matching this glob (repeatable)")
+	fs.Var(&w.exclude, "exclude", "With -r, skip files and directories matching this glob (repeatable)")
+	fs.StringVar(&w.symlinks, "symlinks", symlinksSkip, "With -r, symlink policy: skip, files or follow")
+}
+
+// matches reports whether a glob matches the base name of path, or the path
+// relative to the walk root when the pattern contains a separator.
+func matches(patterns globList, rel string) bool {
+	for _, pattern := range patterns {
+		target := filepath.Base(rel)
+		if strings.ContainsRune(pattern, '/') {
+			target = filepath.ToSlash(rel)
+		}
+		if ok, _ := filepath.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// expand replaces directory arguments by the regular files below them that
+// pass the include/exclude globs and wanted. Without -r arguments are
+// returned unchanged. Entries that cannot be read are reported on stderr and
+// counted in the returned number of failures.
+func (w *walkOptions) expand(args []string, wanted func(path string) bool) ([]string, int, error) {
+	if !w.recursive {
+		return args, 0, nil
+	}
+	switch w.symlinks {
+	case symlinksSkip, symlinksFiles, symlinksFollow:
+	default:
+		return nil, 0, withCode(codeUsage, fmt.Errorf("invalid -symlinks policy %q (want skip, files or follow)", w.symlinks))
+	}
+
+	var files []string
+	failures := 0
+	w.relative = make(map[string]string)
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if arg == "-" || err != nil || !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+
+		visited := make(map[string]bool)
+		found, failed := w.walk(arg, arg, wanted, visited)
+		files = append(files, found...)
+		failures += failed
+	}
+	return files, failures, nil
+}
+
+func (w *walkOptions) walk(root, dir string, wanted func(path string) bool, visited map[string]bool) ([]string, int) {
+	var files []string
+	failures := 0
+
+	if real, err := filepath.EvalSymlinks(dir); err == nil {
+		if visited[real] {
+			return nil, 0
+		}
+		visited[real] = true
+	}
+
+	report := func(path string, err error) {
+		fmt.Fprintf(os.Stderr, "Error: %s: %v\n", path, err)
+		failures++
+	}
+
+	// WalkDir does not descend into a symlinked root; a trailing separator
+	// makes it resolve the link first.
+	start := dir
+	if info, err := os.Lstat(dir); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		start = dir + string(filepath.Separator)
+	}
+
+	filepath.WalkDir(start, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			report(path, err)
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		if path != start && matches(w.exclude, rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			// Remember every directory so a followed link never walks a
+			// tree twice or loops.
+			if path != start {
+				if real, err := filepath.EvalSymlinks(path); err == nil {
+					if visited[real] {
+						return filepath.SkipDir
+					}
+					visited[real] = true
+				}
+			}
+			return nil
+		}
+
+		if d.Type()&fs.ModeSymlink != 0 {
+			if w.symlinks == symlinksSkip {
+				return nil
+			}
+			target, err := os.Stat(path)
+			if err != nil {
+				report(path, err)
+				return nil
+			}
+			if target.IsDir() {
+				if w.symlinks == symlinksFollow {
+					found, failed := w.walk(root, path, wanted, visited)
+					files = append(files, found...)
+					failures += failed
+				}
+				return nil
+			}
+			if !target.Mode().IsRegular() {
+				return nil
+			}
+		} else if !d.Type().IsRegular() {
+			return nil
+		}
+
+		if len(w.include) > 0 && !matches(w.include, rel) {
+			return nil
+		}
+		if wanted(path) {
+			files = append(files, path)
+			w.relative[path] = rel
+		}
+		return nil
+	})
+
+	return files, failures
+}
+
+// walkSummary accumulates the totals printed after a recursive run.
+type walkSummary struct {
+	files    int
+	failed   int
+	bytesIn  int64
+	bytesOut int64
+}
+
+func (s *walkSummary) add(in, out int, err error) {
+	if err != nil {
+		s.failed++
+		return
+	}
+	s.files++
+	s.bytesIn += int64(in)
+	s.bytesOut += int64(out)
+}
+
+func (s *walkSummary) String() string {
+	ratio := 0.0
+	if s.bytesIn > 0 {
+		ratio = float64(s.bytesOut) / float64(s.bytesIn) * 100
+	}
+	return fmt.Sprintf("Processed %d files, %d bytes in, %d bytes out (%.2f%%), %d failures",
+		s.files, s.bytesIn, s.bytesOut, ratio, s.failed)
+}
+
+func (s *walkSummary) record() summaryRecord {
+	var r summaryRecord
+	r.Summary.Files, r.Summary.Failed = s.files, s.failed
+	r.Summary.BytesIn, r.Summary.BytesOut = s.bytesIn, s.bytesOut
+	return r
+}
+
+var errWalkFailures = errors.New("some paths could not be read")
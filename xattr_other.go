@@ -0,0 +1,13 @@
+// xattr_other.go
+
+//go:build !linux && !darwin
+
+package main
+
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, errXattrUnsupported
+}
+
+func writeXattrs(path string, attrs map[string][]byte) error {
+	return errXattrUnsupported
+}